@@ -1,12 +1,19 @@
 package main
 
 import (
+	"flag"
+	"fmt"
+	"os"
+
 	hcloud "github.com/AndrewChubatiuk/nomad-hcloud-autoscaler/plugin"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/nomad-autoscaler/plugins"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reset-breaker" {
+		os.Exit(resetBreaker(os.Args[2:]))
+	}
 	plugins.Serve(factory)
 }
 
@@ -14,3 +21,29 @@ func main() {
 func factory(log hclog.Logger) interface{} {
 	return hcloud.NewHCloudServerPlugin(log)
 }
+
+// resetBreaker resets the circuit breakers of the passed groups, so that they
+// close on the next scaling action of the group.
+func resetBreaker(args []string) int {
+	flags := flag.NewFlagSet("reset-breaker", flag.ContinueOnError)
+	dir := flags.String("dir", "", "hcloud_breaker_reset_dir of the plugin")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: hcloud-server reset-breaker -dir <dir> <group_id>...")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *dir == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	for _, groupID := range flags.Args() {
+		if err := hcloud.ResetBreaker(*dir, groupID); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to reset circuit breaker of group %s: %v\n", groupID, err)
+			return 1
+		}
+		fmt.Printf("reset circuit breaker of group %s\n", groupID)
+	}
+	return 0
+}
@@ -0,0 +1,269 @@
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+const (
+	// breakerWindow is the window creates, deletes and scale outs are tracked
+	// in for the circuit breaker.
+	breakerWindow = time.Hour
+
+	// breakerMinScaleOuts is the number of scale outs within the window
+	// required before the failure rate can open the circuit breaker.
+	breakerMinScaleOuts = 3
+
+	// metaKeyBreaker is the status meta key reporting whether the circuit
+	// breaker of the group is open or closed.
+	metaKeyBreaker = "hcloud_breaker"
+
+	// metaKeyBreakerReason is the status meta key holding the reason the
+	// circuit breaker of the group opened.
+	metaKeyBreakerReason = "hcloud_breaker_reason"
+)
+
+// scaleOutResult records the outcome of a single scale out.
+type scaleOutResult struct {
+	at     time.Time
+	failed bool
+}
+
+// breakerState holds the create and delete history of a group and whether
+// its circuit breaker is open.
+type breakerState struct {
+	creates    []time.Time
+	churn      []time.Time
+	scaleOuts  []scaleOutResult
+	openedAt   time.Time
+	reason     string
+	configHash string
+}
+
+// breakerEnabled returns whether creates of the group are limited or its
+// circuit breaker can open.
+func (tc *hcloudTargetConfig) breakerEnabled() bool {
+	return tc.MaxCreatesPerHour > 0 || tc.ChurnThreshold > 0 || tc.FailureRate > 0
+}
+
+// prune drops the history which is older than the window.
+func (b *breakerState) prune(now time.Time) {
+	since := now.Add(-breakerWindow)
+	b.creates = pruneTimes(b.creates, since)
+	b.churn = pruneTimes(b.churn, since)
+	var scaleOuts []scaleOutResult
+	for _, result := range b.scaleOuts {
+		if result.at.After(since) {
+			scaleOuts = append(scaleOuts, result)
+		}
+	}
+	b.scaleOuts = scaleOuts
+}
+
+// pruneTimes returns the times after since.
+func pruneTimes(times []time.Time, since time.Time) []time.Time {
+	var pruned []time.Time
+	for _, t := range times {
+		if t.After(since) {
+			pruned = append(pruned, t)
+		}
+	}
+	return pruned
+}
+
+// breaker returns the circuit breaker state of the group, the caller has to
+// hold the breaker lock.
+func (t *TargetPlugin) breaker(groupID string) *breakerState {
+	if t.breakers == nil {
+		t.breakers = make(map[string]*breakerState)
+	}
+	state, ok := t.breakers[groupID]
+	if !ok {
+		state = &breakerState{}
+		t.breakers[groupID] = state
+	}
+	return state
+}
+
+// breakerOpen returns the reason the circuit breaker of the group is open. The
+// breaker closes once the cooldown has passed, the config changed or an
+// operator reset it, which also clears the history of the group.
+func (t *TargetPlugin) breakerOpen(targetConfig *hcloudTargetConfig, config map[string]string) (string, bool) {
+	t.breakerLock.Lock()
+	defer t.breakerLock.Unlock()
+
+	state := t.breaker(targetConfig.GroupID)
+	if state.reason == "" {
+		return "", false
+	}
+	if time.Since(state.openedAt) >= targetConfig.BreakerCooldown || state.configHash != configHash(config) ||
+		t.breakerReset(targetConfig.GroupID, state.openedAt) {
+		t.logger.Info("closing circuit breaker", "hcloud_group_id", targetConfig.GroupID)
+		t.breakers[targetConfig.GroupID] = &breakerState{}
+		return "", false
+	}
+	return fmt.Sprintf("%s, retry after %s, reset it with the reset-breaker command or change the config",
+		state.reason, state.openedAt.Add(targetConfig.BreakerCooldown).UTC().Format(time.RFC3339)), true
+}
+
+// breakerReset returns whether an operator reset the circuit breaker of the
+// group after it opened, by touching the file named after the group in the
+// reset directory. The reset file is removed once it has been seen.
+func (t *TargetPlugin) breakerReset(groupID string, openedAt time.Time) bool {
+	if t.config.BreakerResetDir == "" {
+		return false
+	}
+	path := filepath.Join(t.config.BreakerResetDir, groupID)
+	info, err := os.Stat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			t.logger.Warn("failed to check circuit breaker reset", "hcloud_group_id", groupID, "error", err)
+		}
+		return false
+	}
+	if err := os.Remove(path); err != nil {
+		t.logger.Warn("failed to remove circuit breaker reset", "hcloud_group_id", groupID, "error", err)
+	}
+	return info.ModTime().After(openedAt)
+}
+
+// ResetBreaker resets the circuit breaker of the group by touching its reset
+// file in the passed directory, which has to be the hcloud_breaker_reset_dir
+// of the plugin. The breaker closes on the next scaling action of the group.
+func ResetBreaker(dir, groupID string) error {
+	if groupID == "" || filepath.Base(groupID) != groupID {
+		return fmt.Errorf("invalid group ID %q", groupID)
+	}
+	path := filepath.Join(dir, groupID)
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		return fmt.Errorf("failed to write reset file: %v", err)
+	}
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil {
+		return fmt.Errorf("failed to touch reset file: %v", err)
+	}
+	return nil
+}
+
+// openBreaker opens the circuit breaker of the group with the passed reason,
+// the caller has to hold the breaker lock.
+func (t *TargetPlugin) openBreaker(state *breakerState, targetConfig *hcloudTargetConfig, config map[string]string, reason string) {
+	if state.reason != "" {
+		return
+	}
+	t.logger.Error("opening circuit breaker", "hcloud_group_id", targetConfig.GroupID,
+		"reason", reason, "cooldown", targetConfig.BreakerCooldown)
+	state.openedAt = time.Now()
+	state.reason = reason
+	state.configHash = configHash(config)
+}
+
+// allowedCreates returns how many servers may still be created for the group
+// within the current hour.
+func (t *TargetPlugin) allowedCreates(targetConfig *hcloudTargetConfig) int64 {
+	t.breakerLock.Lock()
+	defer t.breakerLock.Unlock()
+
+	state := t.breaker(targetConfig.GroupID)
+	state.prune(time.Now())
+	return max(int64(targetConfig.MaxCreatesPerHour-len(state.creates)), 0)
+}
+
+// createLimitError is returned when the maximum creates per hour of the
+// group allow fewer servers to be created than requested, after those
+// allowed have been created.
+type createLimitError struct {
+	limit int
+}
+
+func (e *createLimitError) Error() string {
+	return fmt.Sprintf("reached the maximum of %d server creates per hour", e.limit)
+}
+
+// limitCreates lowers the desired count of servers to create so that the
+// maximum creates per hour of the group is not exceeded. The limit lowering
+// the count is returned as error alongside it.
+func (t *TargetPlugin) limitCreates(servers []*hcloud.Server, count int64, targetConfig *hcloudTargetConfig) (int64, *createLimitError) {
+	requested := count - int64(len(servers))
+	if targetConfig.MaxCreatesPerHour <= 0 || requested <= 0 {
+		return count, nil
+	}
+	allowed := t.allowedCreates(targetConfig)
+	if requested <= allowed {
+		return count, nil
+	}
+	t.logger.Warn("scale out limited by the maximum creates per hour, creating fewer servers than requested",
+		"hcloud_group_id", targetConfig.GroupID, "requested", requested, "allowed", allowed)
+	return int64(len(servers)) + allowed, &createLimitError{limit: targetConfig.MaxCreatesPerHour}
+}
+
+// recordCreates records servers created for the group.
+func (t *TargetPlugin) recordCreates(groupID string, count int) {
+	t.breakerLock.Lock()
+	defer t.breakerLock.Unlock()
+
+	state := t.breaker(groupID)
+	now := time.Now()
+	for i := 0; i < count; i++ {
+		state.creates = append(state.creates, now)
+	}
+}
+
+// recordDeletes records servers deleted from the group. Servers which lived
+// shorter than the window count towards the churn of the group and open the
+// circuit breaker once the churn threshold is reached.
+func (t *TargetPlugin) recordDeletes(targetConfig *hcloudTargetConfig, config map[string]string, servers []*hcloud.Server) {
+	t.breakerLock.Lock()
+	defer t.breakerLock.Unlock()
+
+	state := t.breaker(targetConfig.GroupID)
+	now := time.Now()
+	state.prune(now)
+	for _, server := range servers {
+		if now.Sub(server.Created) < breakerWindow {
+			state.churn = append(state.churn, now)
+		}
+	}
+	if targetConfig.ChurnThreshold > 0 && len(state.churn) >= targetConfig.ChurnThreshold {
+		t.openBreaker(state, targetConfig, config, fmt.Sprintf(
+			"%d servers were deleted within %s of their creation", len(state.churn), breakerWindow))
+	}
+}
+
+// scaleOutHeldBack returns whether the scale out was held back by a project
+// quota, a cap or the maximum creates per hour rather than failing to create
+// or join servers. Such scale outs do not count towards the failure rate.
+func scaleOutHeldBack(err error) bool {
+	return errors.As(err, new(*quotaError)) || errors.As(err, new(*capError)) || errors.As(err, new(*createLimitError))
+}
+
+// recordScaleOut records the outcome of a scale out of the group and opens
+// the circuit breaker once the failure rate threshold is reached.
+func (t *TargetPlugin) recordScaleOut(targetConfig *hcloudTargetConfig, config map[string]string, failed bool) {
+	t.breakerLock.Lock()
+	defer t.breakerLock.Unlock()
+
+	state := t.breaker(targetConfig.GroupID)
+	now := time.Now()
+	state.prune(now)
+	state.scaleOuts = append(state.scaleOuts, scaleOutResult{at: now, failed: failed})
+
+	if targetConfig.FailureRate <= 0 || len(state.scaleOuts) < breakerMinScaleOuts {
+		return
+	}
+	var failures int
+	for _, result := range state.scaleOuts {
+		if result.failed {
+			failures++
+		}
+	}
+	if rate := float64(failures) / float64(len(state.scaleOuts)); rate >= targetConfig.FailureRate {
+		t.openBreaker(state, targetConfig, config, fmt.Sprintf(
+			"%d of %d scale outs within %s failed", failures, len(state.scaleOuts), breakerWindow))
+	}
+}
@@ -0,0 +1,235 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetPlugin_recordDeletes(t *testing.T) {
+	config := map[string]string{"hcloud_group_id": "test"}
+	targetConfig := &hcloudTargetConfig{GroupID: "test", ChurnThreshold: 2, BreakerCooldown: time.Hour}
+	tp := TargetPlugin{logger: hclog.NewNullLogger()}
+
+	now := time.Now()
+	tp.recordDeletes(targetConfig, config, []*hcloud.Server{
+		{Name: "nomad-1", Created: now.Add(-2 * time.Hour)},
+		{Name: "nomad-2", Created: now.Add(-time.Minute)},
+	})
+	_, ok := tp.breakerOpen(targetConfig, config)
+	assert.False(t, ok, "one short lived server")
+
+	tp.recordDeletes(targetConfig, config, []*hcloud.Server{{Name: "nomad-3", Created: now}})
+	reason, ok := tp.breakerOpen(targetConfig, config)
+	assert.True(t, ok)
+	assert.Contains(t, reason, "2 servers were deleted within 1h0m0s of their creation")
+
+	_, ok = tp.breakerOpen(targetConfig, map[string]string{"hcloud_group_id": "test", "hcloud_image": "new"})
+	assert.False(t, ok, "config changed")
+}
+
+func TestTargetPlugin_recordScaleOut(t *testing.T) {
+	config := map[string]string{"hcloud_group_id": "test"}
+
+	testCases := []struct {
+		inputFailed  []bool
+		inputRate    float64
+		expectedOpen bool
+		name         string
+	}{
+		{
+			inputFailed:  []bool{true, true},
+			inputRate:    0.5,
+			expectedOpen: false,
+			name:         "too few scale outs",
+		},
+		{
+			inputFailed:  []bool{true, false, false},
+			inputRate:    0.5,
+			expectedOpen: false,
+			name:         "rate below threshold",
+		},
+		{
+			inputFailed:  []bool{true, false, true},
+			inputRate:    0.5,
+			expectedOpen: true,
+			name:         "rate reached",
+		},
+		{
+			inputFailed:  []bool{true, true, true},
+			inputRate:    0,
+			expectedOpen: false,
+			name:         "disabled",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			targetConfig := &hcloudTargetConfig{GroupID: "test", FailureRate: tc.inputRate, BreakerCooldown: time.Hour}
+			tp := TargetPlugin{logger: hclog.NewNullLogger()}
+			for _, failed := range tc.inputFailed {
+				tp.recordScaleOut(targetConfig, config, failed)
+			}
+			_, ok := tp.breakerOpen(targetConfig, config)
+			assert.Equal(t, tc.expectedOpen, ok, tc.name)
+		})
+	}
+}
+
+func TestTargetPlugin_breakerOpen_cooldown(t *testing.T) {
+	config := map[string]string{"hcloud_group_id": "test"}
+	targetConfig := &hcloudTargetConfig{GroupID: "test", BreakerCooldown: time.Minute}
+	tp := TargetPlugin{
+		logger: hclog.NewNullLogger(),
+		breakers: map[string]*breakerState{
+			"test": {openedAt: time.Now().Add(-2 * time.Minute), reason: "failed", configHash: configHash(config)},
+		},
+	}
+	_, ok := tp.breakerOpen(targetConfig, config)
+	assert.False(t, ok)
+}
+
+func TestTargetPlugin_breakerOpen_reset(t *testing.T) {
+	dir := t.TempDir()
+	config := map[string]string{"hcloud_group_id": "test"}
+	targetConfig := &hcloudTargetConfig{GroupID: "test", BreakerCooldown: time.Hour}
+	tp := TargetPlugin{
+		logger: hclog.NewNullLogger(),
+		config: hcloudPluginConfig{BreakerResetDir: dir},
+		breakers: map[string]*breakerState{
+			"test": {openedAt: time.Now().Add(-time.Minute), reason: "failed", configHash: configHash(config)},
+		},
+	}
+	reason, ok := tp.breakerOpen(targetConfig, config)
+	assert.True(t, ok)
+	assert.Contains(t, reason, "reset it with the reset-breaker command")
+
+	assert.Error(t, ResetBreaker(dir, "../test"))
+	assert.NoError(t, ResetBreaker(dir, "test"))
+	_, ok = tp.breakerOpen(targetConfig, config)
+	assert.False(t, ok)
+	assert.NoFileExists(t, filepath.Join(dir, "test"), "reset file is removed once seen")
+}
+
+func TestTargetPlugin_allowedCreates(t *testing.T) {
+	targetConfig := &hcloudTargetConfig{GroupID: "test", MaxCreatesPerHour: 3}
+	tp := TargetPlugin{
+		breakers: map[string]*breakerState{
+			"test": {creates: []time.Time{time.Now().Add(-2 * time.Hour), time.Now().Add(-time.Minute)}},
+		},
+	}
+	assert.Equal(t, int64(2), tp.allowedCreates(targetConfig))
+
+	tp.recordCreates("test", 4)
+	assert.Equal(t, int64(0), tp.allowedCreates(targetConfig))
+}
+
+func TestTargetPlugin_limitCreates(t *testing.T) {
+	targetConfig := &hcloudTargetConfig{GroupID: "test", MaxCreatesPerHour: 3}
+	tp := TargetPlugin{
+		logger: hclog.NewNullLogger(),
+		breakers: map[string]*breakerState{
+			"test": {creates: []time.Time{time.Now().Add(-time.Minute)}},
+		},
+	}
+	servers := []*hcloud.Server{{Name: "nomad-1"}}
+
+	count, limited := tp.limitCreates(servers, 3, targetConfig)
+	assert.Equal(t, int64(3), count)
+	assert.Nil(t, limited)
+
+	count, limited = tp.limitCreates(servers, 5, targetConfig)
+	assert.Equal(t, int64(3), count)
+	assert.EqualError(t, limited, "reached the maximum of 3 server creates per hour")
+}
+
+func Test_scaleOutHeldBack(t *testing.T) {
+	testCases := []struct {
+		input          error
+		expectedOutput bool
+		name           string
+	}{
+		{
+			name: "no error",
+		},
+		{
+			input:          &quotaError{resource: quotaServers, limit: 10},
+			expectedOutput: true,
+			name:           "quota",
+		},
+		{
+			input:          &capError{limit: capGroupCost},
+			expectedOutput: true,
+			name:           "cap",
+		},
+		{
+			input:          &createLimitError{limit: 3},
+			expectedOutput: true,
+			name:           "creates per hour",
+		},
+		{
+			input:          fmt.Errorf("failed to create canary server: %w", &capError{limit: capPluginServers}),
+			expectedOutput: true,
+			name:           "held back canary",
+		},
+		{
+			input: errors.New("1 of 1 servers did not join the Nomad cluster"),
+			name:  "join failure",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedOutput, scaleOutHeldBack(tc.input), tc.name)
+		})
+	}
+}
+
+func TestTargetPlugin_scaleOut_limited(t *testing.T) {
+	var created int
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /servers", func(w http.ResponseWriter, r *http.Request) {
+		servers := []schema.Server{{ID: 1, Name: "test-1"}}
+		if created > 0 {
+			servers = append(servers, schema.Server{ID: 2, Name: "test-2"})
+		}
+		writeJSON(w, schema.ServerListResponse{Servers: servers})
+	})
+	mux.HandleFunc("POST /servers", func(w http.ResponseWriter, r *http.Request) {
+		created++
+		writeJSON(w, schema.ServerCreateResponse{
+			Server: schema.Server{ID: 2, Name: "test-2"},
+			Action: schema.Action{ID: 2, Status: "success", Progress: 100},
+		})
+	})
+	mux.HandleFunc("GET /actions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, schema.ActionListResponse{})
+	})
+
+	tp := TargetPlugin{
+		config: hcloudPluginConfig{GroupIDLabelSelector: "group-id", RandomSuffixLen: 10, RetryLimit: 1},
+		logger: hclog.NewNullLogger(),
+		hcloud: newTestHCloudClient(t, mux),
+	}
+	targetConfig := &hcloudTargetConfig{
+		GroupID:           "test",
+		NameTemplate:      "{{ .GroupID }}-{{ .Index }}",
+		MaxCreatesPerHour: 1,
+		ServerType:        &hcloud.ServerType{Name: "cx22"},
+		Image:             &hcloud.Image{Name: "ubuntu-24.04"},
+	}
+	servers := []*hcloud.Server{{ID: 1, Name: "test-1"}}
+
+	err := tp.scaleOut(context.Background(), servers, 3, nil, targetConfig)
+	assert.EqualError(t, err, "reached the maximum of 1 server creates per hour")
+	assert.Equal(t, 1, created, "the allowed server is created")
+}
@@ -0,0 +1,118 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+const (
+	// metaKeyCanaryHealth is the status meta key reporting whether the last
+	// canary of the group failed.
+	metaKeyCanaryHealth = "hcloud_canary_health"
+
+	// metaKeyCanaryReason is the status meta key holding the reason the last
+	// canary of the group failed.
+	metaKeyCanaryReason = "hcloud_canary_reason"
+)
+
+// canaryFailure records a failed canary of a group together with the config
+// it was created with.
+type canaryFailure struct {
+	configHash string
+	reason     string
+}
+
+// configHash returns a hash of the passed config which changes whenever any of
+// its values changes.
+func configHash(config map[string]string) string {
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s=%s\n", key, config[key])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// canaryFailed returns the failure of the last canary of the group if it was
+// created with the passed config. A failure recorded for a previous config is
+// forgotten.
+func (t *TargetPlugin) canaryFailed(groupID string, config map[string]string) (canaryFailure, bool) {
+	t.canaryLock.Lock()
+	defer t.canaryLock.Unlock()
+
+	failure, ok := t.canaryFailures[groupID]
+	if !ok {
+		return canaryFailure{}, false
+	}
+	if failure.configHash != configHash(config) {
+		delete(t.canaryFailures, groupID)
+		return canaryFailure{}, false
+	}
+	return failure, true
+}
+
+// checkCanaryHealth returns an error blocking the scale out if the last canary
+// of the group failed with the current config.
+func (t *TargetPlugin) checkCanaryHealth(groupID string, config map[string]string) error {
+	if failure, ok := t.canaryFailed(groupID, config); ok {
+		return fmt.Errorf("scale out is blocked until the target config changes, canary failed: %s", failure.reason)
+	}
+	return nil
+}
+
+func (t *TargetPlugin) recordCanaryFailure(groupID string, config map[string]string, reason string) {
+	t.canaryLock.Lock()
+	defer t.canaryLock.Unlock()
+
+	if t.canaryFailures == nil {
+		t.canaryFailures = make(map[string]canaryFailure)
+	}
+	t.canaryFailures[groupID] = canaryFailure{configHash: configHash(config), reason: reason}
+}
+
+// validateCanary waits for the canary server to join the Nomad cluster as a
+// ready and eligible node. A canary which fails to do so within the timeout
+// is deleted and further scale outs are blocked until the config changes.
+func (t *TargetPlugin) validateCanary(ctx context.Context, targetConfig *hcloudTargetConfig, canary *hcloud.Server, config map[string]string) error {
+	log := t.logger.With("action", "canary", "hcloud_group_id", targetConfig.GroupID, "server", canary.Name)
+	log.Info("waiting for canary server to join the Nomad cluster", "timeout", targetConfig.CanaryTimeout)
+
+	_, err := t.waitForNomadNode(ctx, canary, targetConfig.CanaryTimeout)
+	if err == nil {
+		t.observeNomadJoin(log, targetConfig, canary)
+		return nil
+	}
+
+	nomadJoinTimeouts.WithLabelValues(targetConfig.GroupID).Inc()
+	reason := fmt.Sprintf("server %s did not become a ready Nomad node: %v", canary.Name, err)
+	t.recordCanaryFailure(targetConfig.GroupID, config, reason)
+	log.Error("canary failed, deleting server", "error", err)
+
+	result, _, deleteErr := t.client(ctx).Server.DeleteWithResult(ctx, canary)
+	if deleteErr != nil {
+		log.Error("failed to delete canary server", "error", deleteErr)
+	} else {
+		t.recordDeletes(targetConfig, config, []*hcloud.Server{canary})
+	}
+	if deleteErr == nil && result.Action != nil {
+		if err := t.waitForActions(ctx, []int64{result.Action.ID}); err != nil {
+			log.Error("failed to wait for canary server to be deleted", "error", err)
+		} else {
+			t.cleanupDeletedServers(ctx, log, targetConfig, []*hcloud.Server{canary})
+		}
+	}
+	if err := t.deleteDNSRecords(ctx, targetConfig, []*hcloud.Server{canary}); err != nil {
+		log.Error("failed to delete DNS records", "error", err)
+	}
+	return fmt.Errorf("canary failed: %s", reason)
+}
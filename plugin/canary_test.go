@@ -0,0 +1,24 @@
+package plugin
+
+import (
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetPlugin_checkCanaryHealth(t *testing.T) {
+	config := map[string]string{"hcloud_group_id": "test", "hcloud_image": "broken"}
+	changed := map[string]string{"hcloud_group_id": "test", "hcloud_image": "fixed"}
+
+	tp := TargetPlugin{logger: hclog.NewNullLogger()}
+	assert.NoError(t, tp.checkCanaryHealth("test", config))
+
+	tp.recordCanaryFailure("test", config, "node did not register")
+	assert.EqualError(t, tp.checkCanaryHealth("test", config),
+		"scale out is blocked until the target config changes, canary failed: node did not register")
+	assert.NoError(t, tp.checkCanaryHealth("other", config))
+
+	assert.NoError(t, tp.checkCanaryHealth("test", changed))
+	assert.NoError(t, tp.checkCanaryHealth("test", config), "failure is forgotten once the config changed")
+}
@@ -0,0 +1,238 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+const (
+	// metaKeyHourlyCost is the status meta key holding the hourly cost of the
+	// running servers of the group.
+	metaKeyHourlyCost = "hcloud_hourly_cost"
+
+	// metaKeyCapReached is the status meta key naming the cap which prevents
+	// the group from scaling out, or "none".
+	metaKeyCapReached = "hcloud_cap_reached"
+
+	// The caps limiting scale outs.
+	capGroupCost     = "group_hourly_cost"
+	capPluginCost    = "plugin_hourly_cost"
+	capPluginServers = "plugin_max_servers"
+	capNone          = "none"
+)
+
+// capError is returned when a cap allows fewer servers to be created than
+// requested, after those allowed have been created.
+type capError struct {
+	limit     string
+	requested int64
+	allowed   int64
+}
+
+func (e *capError) Error() string {
+	return fmt.Sprintf("cap %s allows only %d of %d requested servers", e.limit, e.allowed, e.requested)
+}
+
+// capsEnabled returns whether any cap limits scale outs of the group.
+func (t *TargetPlugin) capsEnabled(targetConfig *hcloudTargetConfig) bool {
+	return targetConfig.MaxHourlyCost > 0 || t.config.MaxHourlyCost > 0 || t.config.MaxServers > 0
+}
+
+// getAllServers returns the servers of all groups managed in any project,
+// optionally only those with the passed statuses.
+func (t *TargetPlugin) getAllServers(ctx context.Context, statuses ...hcloud.ServerStatus) ([]*hcloud.Server, error) {
+	opts := hcloud.ServerListOpts{
+		ListOpts: hcloud.ListOpts{
+			LabelSelector: t.config.GroupIDLabelSelector,
+			PerPage:       t.config.ItemsPerPage,
+		},
+		Status: statuses,
+	}
+	if len(t.projects) == 0 {
+		return t.client(ctx).Server.AllWithOpts(ctx, opts)
+	}
+	var servers []*hcloud.Server
+	for project, client := range t.projects {
+		projectServers, err := client.Server.AllWithOpts(ctx, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list servers of project %q: %v", project, err)
+		}
+		servers = append(servers, projectServers...)
+	}
+	return servers, nil
+}
+
+// serverTypePrice returns the hourly price of the server type in the passed
+// location, looking the prices up if the server type does not carry them.
+func (t *TargetPlugin) serverTypePrice(ctx context.Context, serverType *hcloud.ServerType, location *hcloud.Location) (float64, error) {
+	if price, err := hourlyPrice(serverType, location); err == nil {
+		return price, nil
+	}
+	types, err := t.availableServerTypes(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, available := range types {
+		if available.Name == serverType.Name {
+			return hourlyPrice(available, location)
+		}
+	}
+	return 0, fmt.Errorf("server type %s was not found", serverType.Name)
+}
+
+// hourlyCost returns the summed hourly price of the passed servers.
+func (t *TargetPlugin) hourlyCost(ctx context.Context, servers []*hcloud.Server) (float64, error) {
+	var cost float64
+	for _, server := range servers {
+		var location *hcloud.Location
+		if server.Datacenter != nil {
+			location = server.Datacenter.Location
+		}
+		price, err := t.serverTypePrice(ctx, server.ServerType, location)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get price of server %s: %v", server.Name, err)
+		}
+		cost += price
+	}
+	return cost, nil
+}
+
+// newServerPrice returns the hourly price of a server created for the group.
+func (t *TargetPlugin) newServerPrice(ctx context.Context, targetConfig *hcloudTargetConfig) (float64, error) {
+	if targetConfig.AutoServerType {
+		_, price, err := t.cheapestServerType(ctx, targetConfig)
+		return price, err
+	}
+	return t.serverTypePrice(ctx, targetConfig.ServerType, targetConfig.targetLocation())
+}
+
+// scaleOutCapacity returns how many servers can be added to the group before
+// any of the caps is reached together with the name of the most limiting cap.
+func (t *TargetPlugin) scaleOutCapacity(ctx context.Context, servers []*hcloud.Server, targetConfig *hcloudTargetConfig) (int64, string, error) {
+	capacity, limit := int64(math.MaxInt64), capNone
+	fit := func(n int64, name string) {
+		if n < 0 {
+			n = 0
+		}
+		if n < capacity {
+			capacity, limit = n, name
+		}
+	}
+
+	var price float64
+	if targetConfig.MaxHourlyCost > 0 || t.config.MaxHourlyCost > 0 {
+		var err error
+		price, err = t.newServerPrice(ctx, targetConfig)
+		if err != nil {
+			return 0, "", fmt.Errorf("failed to get price of new servers: %v", err)
+		}
+	}
+
+	// Servers without a price never reach the cost caps.
+	if targetConfig.MaxHourlyCost > 0 && price > 0 {
+		cost, err := t.hourlyCost(ctx, servers)
+		if err != nil {
+			return 0, "", err
+		}
+		fit(int64(math.Floor((targetConfig.MaxHourlyCost-cost)/price)), capGroupCost)
+	}
+
+	if t.config.MaxHourlyCost > 0 && price > 0 {
+		running, err := t.getAllServers(ctx, hcloud.ServerStatusRunning)
+		if err != nil {
+			return 0, "", fmt.Errorf("failed to get servers of all groups: %v", err)
+		}
+		cost, err := t.hourlyCost(ctx, running)
+		if err != nil {
+			return 0, "", err
+		}
+		fit(int64(math.Floor((t.config.MaxHourlyCost-cost)/price)), capPluginCost)
+	}
+
+	if t.config.MaxServers > 0 {
+		all, err := t.getAllServers(ctx)
+		if err != nil {
+			return 0, "", fmt.Errorf("failed to get servers of all groups: %v", err)
+		}
+		fit(int64(t.config.MaxServers-len(all)), capPluginServers)
+	}
+	return capacity, limit, nil
+}
+
+// capCreates lowers the desired count of servers to create so that no cap is
+// exceeded. The cap lowering the count is returned as error alongside it.
+func (t *TargetPlugin) capCreates(ctx context.Context, servers []*hcloud.Server, count int64, targetConfig *hcloudTargetConfig) (int64, *capError, error) {
+	if !t.capsEnabled(targetConfig) {
+		return count, nil, nil
+	}
+	capacity, limit, err := t.scaleOutCapacity(ctx, servers, targetConfig)
+	if err != nil {
+		return 0, nil, err
+	}
+	requested := count - int64(len(servers))
+	if requested <= capacity {
+		return count, nil, nil
+	}
+	t.logger.Warn("scale out limited by cap, creating fewer servers than requested",
+		"hcloud_group_id", targetConfig.GroupID, "cap", limit,
+		"requested", requested, "allowed", capacity)
+	return int64(len(servers)) + capacity, &capError{limit: limit, requested: requested, allowed: capacity}, nil
+}
+
+// capResize returns an error if changing the server type of the passed
+// servers of the group to the passed one exceeds a cost cap. Only the price
+// difference to their current server type counts against the caps.
+func (t *TargetPlugin) capResize(ctx context.Context, servers []*hcloud.Server, serverType *hcloud.ServerType, targetConfig *hcloudTargetConfig) error {
+	if targetConfig.MaxHourlyCost <= 0 && t.config.MaxHourlyCost <= 0 {
+		return nil
+	}
+	var increase float64
+	for _, server := range servers {
+		if server.ServerType != nil && server.ServerType.Name == serverType.Name {
+			continue
+		}
+		var location *hcloud.Location
+		if server.Datacenter != nil {
+			location = server.Datacenter.Location
+		}
+		price, err := t.serverTypePrice(ctx, serverType, location)
+		if err != nil {
+			return fmt.Errorf("failed to get price of server type %s: %v", serverType.Name, err)
+		}
+		current, err := t.hourlyCost(ctx, []*hcloud.Server{server})
+		if err != nil {
+			return err
+		}
+		increase += price - current
+	}
+	if increase <= 0 {
+		return nil
+	}
+
+	if targetConfig.MaxHourlyCost > 0 {
+		cost, err := t.hourlyCost(ctx, servers)
+		if err != nil {
+			return err
+		}
+		if cost+increase > targetConfig.MaxHourlyCost {
+			return fmt.Errorf("changing the server type to %s exceeds cap %s", serverType.Name, capGroupCost)
+		}
+	}
+	if t.config.MaxHourlyCost > 0 {
+		running, err := t.getAllServers(ctx, hcloud.ServerStatusRunning)
+		if err != nil {
+			return fmt.Errorf("failed to get servers of all groups: %v", err)
+		}
+		cost, err := t.hourlyCost(ctx, running)
+		if err != nil {
+			return err
+		}
+		if cost+increase > t.config.MaxHourlyCost {
+			return fmt.Errorf("changing the server type to %s exceeds cap %s", serverType.Name, capPluginCost)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package plugin
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetPlugin_scaleOutCapacity(t *testing.T) {
+	fsn1 := &hcloud.Location{Name: "fsn1"}
+	cx22 := &hcloud.ServerType{Name: "cx22", Pricings: []hcloud.ServerTypeLocationPricing{
+		{Location: fsn1, Hourly: hcloud.Price{Gross: "0.01"}},
+	}}
+	groupServers := []*hcloud.Server{
+		{Name: "nomad-1", ServerType: cx22, Datacenter: &hcloud.Datacenter{Location: fsn1}},
+		{Name: "nomad-2", ServerType: cx22, Datacenter: &hcloud.Datacenter{Location: fsn1}},
+	}
+	schemaServer := schema.Server{
+		ServerType: schema.ServerType{Name: "cx22", Prices: []schema.PricingServerTypePrice{
+			{Location: "fsn1", PriceHourly: schema.Price{Gross: "0.01"}},
+		}},
+		Datacenter: schema.Datacenter{Location: schema.Location{Name: "fsn1"}},
+	}
+
+	testCases := []struct {
+		inputGroupCap    float64
+		inputPluginCap   float64
+		inputMaxServers  int
+		expectedCapacity int64
+		expectedCap      string
+		name             string
+	}{
+		{
+			expectedCapacity: math.MaxInt64,
+			expectedCap:      capNone,
+			name:             "no caps",
+		},
+		{
+			inputGroupCap:    0.055,
+			expectedCapacity: 3,
+			expectedCap:      capGroupCost,
+			name:             "group cost cap",
+		},
+		{
+			inputGroupCap:    0.1,
+			inputPluginCap:   0.06,
+			expectedCapacity: 1,
+			expectedCap:      capPluginCost,
+			name:             "plugin cost cap",
+		},
+		{
+			inputMaxServers:  4,
+			expectedCapacity: 0,
+			expectedCap:      capPluginServers,
+			name:             "plugin max servers reached",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /servers", func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "group-id", r.URL.Query().Get("label_selector"))
+				// Five servers of all groups, of which four are running.
+				servers := []schema.Server{schemaServer, schemaServer, schemaServer, schemaServer}
+				if r.URL.Query().Get("status") == "" {
+					servers = append(servers, schemaServer)
+				}
+				writeJSON(w, schema.ServerListResponse{Servers: servers})
+			})
+
+			tp := TargetPlugin{
+				config: hcloudPluginConfig{GroupIDLabelSelector: "group-id", MaxHourlyCost: tc.inputPluginCap, MaxServers: tc.inputMaxServers},
+				hcloud: newTestHCloudClient(t, mux),
+			}
+			targetConfig := &hcloudTargetConfig{GroupID: "test", ServerType: cx22, Location: fsn1, MaxHourlyCost: tc.inputGroupCap}
+
+			capacity, limit, err := tp.scaleOutCapacity(context.Background(), groupServers, targetConfig)
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.expectedCapacity, capacity, tc.name)
+			assert.Equal(t, tc.expectedCap, limit, tc.name)
+		})
+	}
+}
+
+func TestTargetPlugin_createServers_capped(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /servers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, schema.ServerListResponse{Servers: []schema.Server{{ID: 1}, {ID: 2}}})
+	})
+	mux.HandleFunc("POST /servers", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("server created beyond the cap")
+	})
+
+	tp := TargetPlugin{
+		config: hcloudPluginConfig{GroupIDLabelSelector: "group-id", MaxServers: 2},
+		logger: hclog.NewNullLogger(),
+		hcloud: newTestHCloudClient(t, mux),
+	}
+	targetConfig := &hcloudTargetConfig{GroupID: "test"}
+
+	created, err := tp.createServers(context.Background(), nil, 1, targetConfig)
+	assert.Empty(t, created)
+	assert.EqualError(t, err, "cap plugin_max_servers allows only 0 of 1 requested servers")
+}
+
+func TestTargetPlugin_capResize(t *testing.T) {
+	fsn1 := &hcloud.Location{Name: "fsn1"}
+	cx22 := &hcloud.ServerType{Name: "cx22", Pricings: []hcloud.ServerTypeLocationPricing{
+		{Location: fsn1, Hourly: hcloud.Price{Gross: "0.01"}},
+	}}
+	cx32 := &hcloud.ServerType{Name: "cx32", Pricings: []hcloud.ServerTypeLocationPricing{
+		{Location: fsn1, Hourly: hcloud.Price{Gross: "0.02"}},
+	}}
+	servers := []*hcloud.Server{
+		{Name: "nomad-1", ServerType: cx22, Datacenter: &hcloud.Datacenter{Location: fsn1}},
+		{Name: "nomad-2", ServerType: cx22, Datacenter: &hcloud.Datacenter{Location: fsn1}},
+	}
+
+	testCases := []struct {
+		inputServerType *hcloud.ServerType
+		inputGroupCap   float64
+		expectedError   string
+		name            string
+	}{
+		{
+			inputServerType: cx32,
+			inputGroupCap:   0.04,
+			name:            "within group cost cap",
+		},
+		{
+			inputServerType: cx32,
+			inputGroupCap:   0.03,
+			expectedError:   "changing the server type to cx32 exceeds cap group_hourly_cost",
+			name:            "exceeds group cost cap",
+		},
+		{
+			inputServerType: cx22,
+			inputGroupCap:   0.01,
+			name:            "no price increase",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tp := TargetPlugin{}
+			targetConfig := &hcloudTargetConfig{GroupID: "test", MaxHourlyCost: tc.inputGroupCap}
+
+			err := tp.capResize(context.Background(), servers, tc.inputServerType, targetConfig)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError, tc.name)
+				return
+			}
+			assert.NoError(t, err, tc.name)
+		})
+	}
+}
+
+func TestTargetPlugin_scaleOut_capped(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /servers", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, schema.ServerListResponse{Servers: []schema.Server{{ID: 1}, {ID: 2}}})
+	})
+	mux.HandleFunc("POST /servers", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("server created beyond the cap")
+	})
+
+	tp := TargetPlugin{
+		config: hcloudPluginConfig{GroupIDLabelSelector: "group-id", MaxServers: 2},
+		logger: hclog.NewNullLogger(),
+		hcloud: newTestHCloudClient(t, mux),
+	}
+	targetConfig := &hcloudTargetConfig{GroupID: "test"}
+	servers := []*hcloud.Server{{ID: 1, Name: "test-1"}, {ID: 2, Name: "test-2"}}
+
+	err := tp.scaleOut(context.Background(), servers, 4, nil, targetConfig)
+	assert.EqualError(t, err, "cap plugin_max_servers allows only 0 of 2 requested servers")
+	assert.True(t, scaleOutHeldBack(err))
+}
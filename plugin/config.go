@@ -1,14 +1,15 @@
 package plugin
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"reflect"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/creasty/defaults"
-	"github.com/google/uuid"
 	"github.com/hetznercloud/hcloud-go/v2/hcloud"
 	"github.com/mitchellh/mapstructure"
 )
@@ -98,31 +99,265 @@ func CustomDecodeHookFunc(client *hcloud.Client, sep string, entrySep string) ma
 }
 
 type hcloudPluginConfig struct {
-	Token                string        `mapstructure:"hcloud_token" validate:"required"`
-	RandomSuffixLen      int           `mapstructure:"hcloud_random_suffix_len" default:"10"`
-	RetryInterval        time.Duration `mapstructure:"hcloud_retry_interval" default:"60s"`
-	RetryLimit           int           `mapstructure:"hcloud_retry_limit" default:"5"`
-	ItemsPerPage         int           `mapstructure:"hcloud_items_per_page" default:"50"`
-	GroupIDLabelSelector string        `mapstructure:"hcloud_group_id_label_selector" default:"group-id"`
-	NodeAttrID           string        `mapstructure:"hcloud_node_attr_id" default:"unique.hostname"`
+	Token                string            `mapstructure:"hcloud_token" validate:"required"`
+	RandomSuffixLen      int               `mapstructure:"hcloud_random_suffix_len" default:"10" validate:"min=1,max=32"`
+	RetryInterval        time.Duration     `mapstructure:"hcloud_retry_interval" default:"60s"`
+	RetryLimit           int               `mapstructure:"hcloud_retry_limit" default:"5"`
+	ItemsPerPage         int               `mapstructure:"hcloud_items_per_page" default:"50"`
+	GroupIDLabelSelector string            `mapstructure:"hcloud_group_id_label_selector" default:"group-id"`
+	NodeAttrID           string            `mapstructure:"hcloud_node_attr_id" default:"unique.hostname"`
+	DNSToken             string            `mapstructure:"hcloud_dns_token"`
+	DNSEndpoint          string            `mapstructure:"hcloud_dns_endpoint" default:"https://dns.hetzner.com/api/v1"`
+	MetricsAddress       string            `mapstructure:"hcloud_metrics_address"`
+	MaxHourlyCost        float64           `mapstructure:"hcloud_max_hourly_cost" validate:"min=0"`
+	MaxServers           int               `mapstructure:"hcloud_max_servers" validate:"min=0"`
+	QuotaServers         int               `mapstructure:"hcloud_quota_servers" validate:"min=0"`
+	QuotaCores           int               `mapstructure:"hcloud_quota_cores" validate:"min=0"`
+	ProjectTokens        map[string]string `mapstructure:"hcloud_project_tokens"`
+	ProjectQuotaServers  map[string]string `mapstructure:"hcloud_project_quota_servers"`
+	ProjectQuotaCores    map[string]string `mapstructure:"hcloud_project_quota_cores"`
+	BreakerResetDir      string            `mapstructure:"hcloud_breaker_reset_dir"`
 }
 
 type hcloudTargetConfig struct {
-	Datacenter          *hcloud.Datacenter             `mapstructure:"hcloud_datacenter" validate:"required_without=Location"`
-	Location            *hcloud.Location               `mapstructure:"hcloud_location" validate:"required_without=Datacenter"`
-	PlacementGroup      *hcloud.PlacementGroup         `mapstructure:"hcloud_placement_group"`
-	Firewalls           []*hcloud.ServerCreateFirewall `mapstructure:"hcloud_firewalls"`
-	Image               *hcloud.Image                  `mapstructure:"hcloud_image" default:"{\"Name\": \"ubuntu-20.04\"}" validate:"required"`
-	UserData            string                         `mapstructure:"hcloud_user_data" validate:"required_without=UserDataFile"`
-	UserDataFile        string                         `mapstructure:"hcloud_user_data_file" validate:"required_without=UserData"`
-	SSHKeys             []*hcloud.SSHKey               `mapstructure:"hcloud_ssh_keys" validate:"required"`
-	Labels              map[string]string              `mapstructure:"hcloud_labels"`
-	ServerType          *hcloud.ServerType             `mapstructure:"hcloud_server_type" default:"{\"Name\":\"cx11\"}" validate:"required"`
-	GroupID             string                         `mapstructure:"hcloud_group_id" validate:"required"`
-	Networks            []*hcloud.Network              `mapstructure:"hcloud_networks"`
-	B64UserDataEncoded  bool                           `mapstructure:"hcloud_b64_user_data_encoded"`
-	PublicNetEnableIPv4 bool                           `mapstructure:"hcloud_public_net_enable_ipv4" default:"true"`
-	PublicNetEnableIPv6 bool                           `mapstructure:"hcloud_public_net_enable_ipv6"`
+	Datacenter           *hcloud.Datacenter             `mapstructure:"hcloud_datacenter" validate:"required_without=Location"`
+	Location             *hcloud.Location               `mapstructure:"hcloud_location" validate:"required_without=Datacenter"`
+	PlacementGroup       *hcloud.PlacementGroup         `mapstructure:"hcloud_placement_group"`
+	PlacementGroupPrefix string                         `mapstructure:"hcloud_placement_group_prefix" validate:"excluded_with=PlacementGroup"`
+	Firewalls            []*hcloud.ServerCreateFirewall `mapstructure:"hcloud_firewalls"`
+	Image                *hcloud.Image                  `mapstructure:"hcloud_image" default:"{\"Name\": \"ubuntu-20.04\"}" validate:"required"`
+	UserData             string                         `mapstructure:"hcloud_user_data" validate:"required_without=UserDataFile"`
+	UserDataFile         string                         `mapstructure:"hcloud_user_data_file" validate:"required_without=UserData"`
+	UserDataTemplate     bool                           `mapstructure:"hcloud_user_data_template"`
+	SSHKeys              []*hcloud.SSHKey               `mapstructure:"hcloud_ssh_keys" validate:"required"`
+	Labels               map[string]string              `mapstructure:"hcloud_labels"`
+	ServerType           *hcloud.ServerType             `mapstructure:"hcloud_server_type" default:"{\"Name\":\"cx11\"}" validate:"required"`
+	GroupID              string                         `mapstructure:"hcloud_group_id" validate:"required"`
+	Networks             []*hcloud.Network              `mapstructure:"hcloud_networks"`
+	B64UserDataEncoded   bool                           `mapstructure:"hcloud_b64_user_data_encoded"`
+	PublicNetEnableIPv4  bool                           `mapstructure:"hcloud_public_net_enable_ipv4" default:"true"`
+	PublicNetEnableIPv6  bool                           `mapstructure:"hcloud_public_net_enable_ipv6"`
+	DNSZone              string                         `mapstructure:"hcloud_dns_zone"`
+	DNSRecordTemplate    string                         `mapstructure:"hcloud_dns_record_template" default:"{{ .Name }}"`
+	DNSTTL               int                            `mapstructure:"hcloud_dns_ttl" default:"300"`
+	DNSPrivateIP         bool                           `mapstructure:"hcloud_dns_private_ip"`
+	VolumeSize           int                            `mapstructure:"hcloud_volume_size" validate:"omitempty,min=10,max=10240"`
+	VolumeFormat         string                         `mapstructure:"hcloud_volume_format" validate:"omitempty,oneof=ext4 xfs"`
+	VolumeAutomount      bool                           `mapstructure:"hcloud_volume_automount"`
+	VolumeNameTemplate   string                         `mapstructure:"hcloud_volume_name_template" default:"{{ .Name }}-data"`
+	VolumeRetention      string                         `mapstructure:"hcloud_volume_retention" default:"delete" validate:"oneof=delete retain pool"`
+	NetworkIPRanges      map[string]string              `mapstructure:"hcloud_network_ip_ranges"`
+	NetworkAliasIPs      int                            `mapstructure:"hcloud_network_alias_ips" validate:"min=0,max=3"`
+	PrimaryIPPool        string                         `mapstructure:"hcloud_primary_ip_pool"`
+	PrimaryIPPoolPolicy  string                         `mapstructure:"hcloud_primary_ip_pool_policy" default:"fail" validate:"oneof=fail fallback"`
+	PublicNetIPv4        *hcloud.PrimaryIP              `mapstructure:"hcloud_public_net_ipv4" validate:"excluded_with=PrimaryIPPool"`
+	PublicNetIPv6        *hcloud.PrimaryIP              `mapstructure:"hcloud_public_net_ipv6" validate:"excluded_with=PrimaryIPPool"`
+	StartAfterCreate     bool                           `mapstructure:"hcloud_start_after_create" default:"true"`
+	Volumes              []*hcloud.Volume               `mapstructure:"hcloud_volumes"`
+	Automount            bool                           `mapstructure:"hcloud_automount"`
+	Backups              bool                           `mapstructure:"hcloud_backups"`
+	NameTemplate         string                         `mapstructure:"hcloud_name_template" default:"{{ .GroupID }}-{{ .RandomSuffix }}"`
+	Canary               bool                           `mapstructure:"hcloud_canary"`
+	CanaryTimeout        time.Duration                  `mapstructure:"hcloud_canary_timeout" default:"10m"`
+	WaitForNomadJoin     bool                           `mapstructure:"hcloud_wait_for_nomad_join"`
+	NomadJoinTimeout     time.Duration                  `mapstructure:"hcloud_nomad_join_timeout" default:"10m"`
+	ShutdownTimeout      time.Duration                  `mapstructure:"hcloud_shutdown_timeout" default:"1m"`
+	SnapshotBeforeDelete string                         `mapstructure:"hcloud_snapshot_before_delete" default:"never" validate:"oneof=never always unhealthy"`
+	SnapshotRetainCount  int                            `mapstructure:"hcloud_snapshot_retention_count" validate:"min=0"`
+	SnapshotRetainDays   int                            `mapstructure:"hcloud_snapshot_retention_days" validate:"min=0"`
+	WarmPoolSize         int                            `mapstructure:"hcloud_warm_pool_size" validate:"min=0"`
+	WarmPoolScaleIn      bool                           `mapstructure:"hcloud_warm_pool_scale_in"`
+	RefreshInterval      time.Duration                  `mapstructure:"hcloud_refresh_interval"`
+	MaxUnavailable       int                            `mapstructure:"hcloud_refresh_max_unavailable" default:"1" validate:"min=1"`
+	MaxServerAge         time.Duration                  `mapstructure:"hcloud_max_server_age"`
+	ScalingMode          string                         `mapstructure:"hcloud_scaling_mode" default:"horizontal" validate:"oneof=horizontal vertical weighted"`
+	VerticalServerTypes  []*hcloud.ServerType           `mapstructure:"hcloud_vertical_server_types"`
+	UpgradeDisk          bool                           `mapstructure:"hcloud_upgrade_disk"`
+	CapacityWeights      map[string]string              `mapstructure:"hcloud_capacity_weights"`
+	AutoServerType       bool                           `mapstructure:"hcloud_auto_server_type"`
+	MinCores             int                            `mapstructure:"hcloud_min_cores" validate:"min=0"`
+	MinMemory            float32                        `mapstructure:"hcloud_min_memory" validate:"min=0"`
+	MinDisk              int                            `mapstructure:"hcloud_min_disk" validate:"min=0"`
+	Architecture         string                         `mapstructure:"hcloud_architecture" validate:"omitempty,oneof=x86 arm"`
+	CPUType              string                         `mapstructure:"hcloud_cpu_type" validate:"omitempty,oneof=shared dedicated"`
+	MaxHourlyCost        float64                        `mapstructure:"hcloud_max_hourly_cost" validate:"min=0"`
+	MaxCreatesPerHour    int                            `mapstructure:"hcloud_max_creates_per_hour" validate:"min=0"`
+	ChurnThreshold       int                            `mapstructure:"hcloud_breaker_churn_threshold" validate:"min=0"`
+	FailureRate          float64                        `mapstructure:"hcloud_breaker_failure_rate" validate:"min=0,max=1"`
+	BreakerCooldown      time.Duration                  `mapstructure:"hcloud_breaker_cooldown" default:"30m"`
+	MaxScaleOutStep      int                            `mapstructure:"hcloud_max_scale_out_step" validate:"min=0"`
+	MaxScaleInStep       int                            `mapstructure:"hcloud_max_scale_in_step" validate:"min=0"`
+	Project              string                         `mapstructure:"hcloud_project"`
+	SpilloverProjects    map[string]string              `mapstructure:"hcloud_spillover_projects"`
+
+	// warmPool is set on the copy of the config used for the servers of the
+	// warm pool.
+	warmPool bool
+}
+
+// validateConstraints checks the config against the constraints the HCloud
+// API puts on combinations of server create options.
+func (tc *hcloudTargetConfig) validateConstraints() error {
+	if tc.Datacenter != nil && tc.Location != nil && !sameLocation(tc.Datacenter.Location, tc.Location) {
+		return fmt.Errorf("hcloud_datacenter %s is not in hcloud_location %s", tc.Datacenter.Name, tc.Location.Name)
+	}
+	if !tc.PublicNetEnableIPv4 && !tc.PublicNetEnableIPv6 {
+		if len(tc.Networks) == 0 {
+			return fmt.Errorf("hcloud_networks is required when both public IPv4 and IPv6 are disabled")
+		}
+		if len(tc.Firewalls) > 0 {
+			return fmt.Errorf("hcloud_firewalls require a public IPv4 or IPv6 to be enabled")
+		}
+	}
+
+	var datacenter *hcloud.Datacenter
+	for _, primaryIP := range []struct {
+		ip      *hcloud.PrimaryIP
+		ipType  hcloud.PrimaryIPType
+		enabled bool
+		key     string
+	}{
+		{tc.PublicNetIPv4, hcloud.PrimaryIPTypeIPv4, tc.PublicNetEnableIPv4, "hcloud_public_net_ipv4"},
+		{tc.PublicNetIPv6, hcloud.PrimaryIPTypeIPv6, tc.PublicNetEnableIPv6, "hcloud_public_net_ipv6"},
+	} {
+		if primaryIP.ip == nil {
+			continue
+		}
+		if !primaryIP.enabled {
+			return fmt.Errorf("%s is set while the IP family is disabled", primaryIP.key)
+		}
+		if primaryIP.ip.Type != primaryIP.ipType {
+			return fmt.Errorf("%s must be a Primary IP of type %s", primaryIP.key, primaryIP.ipType)
+		}
+		if primaryIP.ip.Datacenter == nil {
+			continue
+		}
+		if datacenter != nil && datacenter.Name != primaryIP.ip.Datacenter.Name {
+			return fmt.Errorf("hcloud_public_net_ipv4 and hcloud_public_net_ipv6 must be in the same datacenter")
+		}
+		datacenter = primaryIP.ip.Datacenter
+	}
+	if datacenter != nil {
+		if tc.Datacenter != nil && tc.Datacenter.Name != datacenter.Name {
+			return fmt.Errorf("the Primary IPs are not in hcloud_datacenter %s", tc.Datacenter.Name)
+		}
+		if tc.Location != nil && !sameLocation(datacenter.Location, tc.Location) {
+			return fmt.Errorf("the Primary IPs are not in hcloud_location %s", tc.Location.Name)
+		}
+	}
+
+	name, err := tc.renderName(1, "0")
+	if err != nil {
+		return err
+	}
+	if err := validateHostname(name); err != nil {
+		return fmt.Errorf("hcloud_name_template renders an invalid name: %v", err)
+	}
+
+	if tc.WarmPoolScaleIn && tc.WarmPoolSize == 0 {
+		return fmt.Errorf("hcloud_warm_pool_scale_in requires hcloud_warm_pool_size to be set")
+	}
+	if _, ok := tc.Labels[warmPoolLabel]; ok && tc.WarmPoolSize > 0 {
+		return fmt.Errorf("hcloud_labels must not contain the %q label when the warm pool is enabled", warmPoolLabel)
+	}
+
+	if tc.ScalingMode == scalingModeVertical && len(tc.VerticalServerTypes) == 0 {
+		return fmt.Errorf("hcloud_vertical_server_types is required in vertical scaling mode")
+	}
+
+	if tc.ScalingMode == scalingModeWeighted {
+		if len(tc.CapacityWeights) == 0 {
+			return fmt.Errorf("hcloud_capacity_weights is required in weighted scaling mode")
+		}
+		if _, err := tc.capacityWeights(); err != nil {
+			return err
+		}
+	}
+
+	if tc.AutoServerType {
+		if tc.ScalingMode != scalingModeHorizontal {
+			return fmt.Errorf("hcloud_auto_server_type is only supported in horizontal scaling mode")
+		}
+		if tc.Architecture != "" && tc.Image != nil && tc.Image.Architecture != "" && tc.Image.Architecture != hcloud.Architecture(tc.Architecture) {
+			return fmt.Errorf("hcloud_architecture %s does not match the architecture of image %s", tc.Architecture, tc.Image.Name)
+		}
+	}
+
+	if tc.spilloverEnabled() {
+		if tc.ScalingMode != scalingModeHorizontal {
+			return fmt.Errorf("hcloud_spillover_projects is only supported in horizontal scaling mode")
+		}
+		if tc.WarmPoolSize > 0 {
+			return fmt.Errorf("hcloud_spillover_projects can not be combined with hcloud_warm_pool_size")
+		}
+		if _, ok := tc.SpilloverProjects[tc.Project]; ok {
+			return fmt.Errorf("hcloud_spillover_projects must not contain the project of the group")
+		}
+		if _, err := tc.spilloverWeights(); err != nil {
+			return err
+		}
+	}
+	if _, ok := tc.Labels[projectLabel]; ok && tc.spilloverEnabled() {
+		return fmt.Errorf("hcloud_labels must not contain the %q label when spillover projects are set", projectLabel)
+	}
+
+	// The create API has a single automount flag for all volumes of a server.
+	if len(tc.Volumes) > 0 && tc.volumesEnabled() && tc.Automount != tc.VolumeAutomount {
+		return fmt.Errorf("hcloud_automount and hcloud_volume_automount must match when both hcloud_volumes and hcloud_volume_size are set")
+	}
+
+	for _, volume := range tc.Volumes {
+		if location := tc.targetLocation(); location != nil && !sameLocation(volume.Location, location) {
+			return fmt.Errorf("volume %s is not in the location of the servers", volume.Name)
+		}
+	}
+	return nil
+}
+
+// serverCreateOpts returns the create options shared by all servers of the
+// group.
+func (tc *hcloudTargetConfig) serverCreateOpts(labelName string) hcloud.ServerCreateOpts {
+	opts := hcloud.ServerCreateOpts{
+		Image:            tc.Image,
+		Datacenter:       tc.Datacenter,
+		Location:         tc.Location,
+		ServerType:       tc.ServerType,
+		PlacementGroup:   tc.PlacementGroup,
+		Firewalls:        tc.Firewalls,
+		SSHKeys:          tc.SSHKeys,
+		Labels:           tc.serverLabels(labelName),
+		Networks:         tc.Networks,
+		Volumes:          tc.Volumes,
+		StartAfterCreate: hcloud.Ptr(!tc.createdStopped()),
+		PublicNet: &hcloud.ServerCreatePublicNet{
+			EnableIPv4: tc.PublicNetEnableIPv4,
+			EnableIPv6: tc.PublicNetEnableIPv6,
+			IPv4:       tc.PublicNetIPv4,
+			IPv6:       tc.PublicNetIPv6,
+		},
+	}
+	if len(tc.Volumes) > 0 {
+		opts.Automount = hcloud.Ptr(tc.Automount)
+	}
+
+	// Location and datacenter are mutually exclusive, the datacenter is the
+	// more specific one. Primary IPs can only be assigned to servers in their
+	// datacenter.
+	for _, primaryIP := range []*hcloud.PrimaryIP{tc.PublicNetIPv4, tc.PublicNetIPv6} {
+		if primaryIP != nil && primaryIP.Datacenter != nil {
+			opts.Datacenter = primaryIP.Datacenter
+		}
+	}
+	if opts.Datacenter != nil {
+		opts.Location = nil
+	}
+	return opts
+}
+
+// createdStopped returns whether servers are created stopped and only started
+// once set up.
+func (tc *hcloudTargetConfig) createdStopped() bool {
+	return !tc.StartAfterCreate || len(tc.NetworkIPRanges) > 0
 }
 
 func (tc *hcloudTargetConfig) getSelector(labelName string) string {
@@ -137,10 +372,39 @@ func (tc *hcloudTargetConfig) getSelector(labelName string) string {
 	return strings.Join(selectorSlice, ",")
 }
 
-func (tc *hcloudTargetConfig) randomName(suffixLen int) string {
-	id := uuid.New()
-	suffix := strings.Replace(id.String(), "-", "", -1)[:suffixLen]
-	return fmt.Sprintf("%s-%s", tc.GroupID, suffix)
+// serverLabels returns the labels set on every server and resource created
+// for the group.
+func (tc *hcloudTargetConfig) serverLabels(labelName string) map[string]string {
+	labels := make(map[string]string, len(tc.Labels)+1)
+	for key, value := range tc.Labels {
+		labels[key] = value
+	}
+	labels[labelName] = tc.GroupID
+	return labels
+}
+
+// targetLocation returns the location servers of the group are created in.
+func (tc *hcloudTargetConfig) targetLocation() *hcloud.Location {
+	if tc.Location != nil {
+		return tc.Location
+	}
+	if tc.Datacenter != nil {
+		return tc.Datacenter.Location
+	}
+	return nil
+}
+
+// renderTemplate executes the named config template with the passed data.
+func renderTemplate(name, text string, data interface{}) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %s template: %v", name, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render %s template: %v", name, err)
+	}
+	return buf.String(), nil
 }
 
 func parse(client *hcloud.Client, input interface{}, output interface{}) error {
@@ -173,5 +437,8 @@ func parse(client *hcloud.Client, input interface{}, output interface{}) error {
 	if err != nil {
 		return err
 	}
+	if v, ok := output.(interface{ validateConstraints() error }); ok {
+		return v.validateConstraints()
+	}
 	return nil
 }
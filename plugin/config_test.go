@@ -2,10 +2,12 @@ package plugin
 
 import (
 	"fmt"
+	"net/http"
 	"os"
 	"testing"
 
 	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -69,3 +71,252 @@ func Test_parse(t *testing.T) {
 		})
 	}
 }
+
+func Test_hcloudTargetConfig_targetLocation(t *testing.T) {
+	fsn1 := &hcloud.Location{Name: "fsn1"}
+	nbg1 := &hcloud.Location{Name: "nbg1"}
+
+	testCases := []struct {
+		targetConfig   hcloudTargetConfig
+		expectedOutput *hcloud.Location
+		name           string
+	}{
+		{
+			targetConfig:   hcloudTargetConfig{Location: fsn1},
+			expectedOutput: fsn1,
+			name:           "location configured",
+		},
+		{
+			targetConfig:   hcloudTargetConfig{Datacenter: &hcloud.Datacenter{Name: "nbg1-dc3", Location: nbg1}},
+			expectedOutput: nbg1,
+			name:           "datacenter configured",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedOutput, tc.targetConfig.targetLocation(), tc.name)
+		})
+	}
+}
+
+// newTestParseClient returns an HCloud client serving the resources the
+// target config parse tests refer to.
+func newTestParseClient(t *testing.T) *hcloud.Client {
+	fsn1 := schema.Location{ID: 1, Name: "fsn1"}
+	nbg1 := schema.Location{ID: 2, Name: "nbg1"}
+	fsn1dc14 := schema.Datacenter{ID: 4, Name: "fsn1-dc14", Location: fsn1}
+	nbg1dc3 := schema.Datacenter{ID: 3, Name: "nbg1-dc3", Location: nbg1}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ssh_keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, schema.SSHKeyListResponse{SSHKeys: []schema.SSHKey{{ID: 1, Name: r.URL.Query().Get("name")}}})
+	})
+	mux.HandleFunc("GET /locations", func(w http.ResponseWriter, r *http.Request) {
+		for _, location := range []schema.Location{fsn1, nbg1} {
+			if location.Name == r.URL.Query().Get("name") {
+				writeJSON(w, schema.LocationListResponse{Locations: []schema.Location{location}})
+				return
+			}
+		}
+		writeJSON(w, schema.LocationListResponse{})
+	})
+	mux.HandleFunc("GET /datacenters", func(w http.ResponseWriter, r *http.Request) {
+		for _, datacenter := range []schema.Datacenter{fsn1dc14, nbg1dc3} {
+			if datacenter.Name == r.URL.Query().Get("name") {
+				writeJSON(w, schema.DatacenterListResponse{Datacenters: []schema.Datacenter{datacenter}})
+				return
+			}
+		}
+		writeJSON(w, schema.DatacenterListResponse{})
+	})
+	mux.HandleFunc("GET /networks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, schema.NetworkListResponse{Networks: []schema.Network{{ID: 1, Name: r.URL.Query().Get("name"), IPRange: "10.0.0.0/16"}}})
+	})
+	mux.HandleFunc("GET /firewalls", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, schema.FirewallListResponse{Firewalls: []schema.Firewall{{ID: 1, Name: r.URL.Query().Get("name")}}})
+	})
+	mux.HandleFunc("GET /primary_ips", func(w http.ResponseWriter, r *http.Request) {
+		primaryIPs := map[string]schema.PrimaryIP{
+			"ipv4":      {ID: 1, Name: "ipv4", IP: "192.0.2.1", Type: "ipv4", Datacenter: fsn1dc14},
+			"ipv6":      {ID: 2, Name: "ipv6", IP: "2001:db8::/64", Type: "ipv6", Datacenter: fsn1dc14},
+			"ipv6-nbg1": {ID: 3, Name: "ipv6-nbg1", IP: "2001:db8:1::/64", Type: "ipv6", Datacenter: nbg1dc3},
+		}
+		writeJSON(w, schema.PrimaryIPListResult{PrimaryIPs: []schema.PrimaryIP{primaryIPs[r.URL.Query().Get("name")]}})
+	})
+	mux.HandleFunc("GET /volumes", func(w http.ResponseWriter, r *http.Request) {
+		volumes := map[string]schema.Volume{
+			"data":      {ID: 1, Name: "data", Location: fsn1},
+			"data-nbg1": {ID: 2, Name: "data-nbg1", Location: nbg1},
+		}
+		writeJSON(w, schema.VolumeListResponse{Volumes: []schema.Volume{volumes[r.URL.Query().Get("name")]}})
+	})
+	return newTestHCloudClient(t, mux)
+}
+
+func Test_parse_serverCreateOpts(t *testing.T) {
+	testCases := []struct {
+		input          map[string]string
+		expectedOutput func(t *testing.T, tc hcloudTargetConfig)
+		expectedError  string
+		name           string
+	}{
+		{
+			input: map[string]string{},
+			expectedOutput: func(t *testing.T, tc hcloudTargetConfig) {
+				assert.True(t, tc.StartAfterCreate)
+				assert.False(t, tc.Automount)
+				assert.False(t, tc.Backups)
+				assert.Empty(t, tc.Volumes)
+				assert.Nil(t, tc.PublicNetIPv4)
+				assert.Nil(t, tc.PublicNetIPv6)
+			},
+			name: "defaults",
+		},
+		{
+			input: map[string]string{
+				"hcloud_start_after_create": "false",
+				"hcloud_backups":            "true",
+			},
+			expectedOutput: func(t *testing.T, tc hcloudTargetConfig) {
+				assert.False(t, tc.StartAfterCreate)
+				assert.True(t, tc.Backups)
+				assert.True(t, tc.createdStopped())
+			},
+			name: "start after create and backups",
+		},
+		{
+			input: map[string]string{
+				"hcloud_volumes":   "data",
+				"hcloud_automount": "true",
+			},
+			expectedOutput: func(t *testing.T, tc hcloudTargetConfig) {
+				assert.Len(t, tc.Volumes, 1)
+				assert.Equal(t, int64(1), tc.Volumes[0].ID)
+				assert.True(t, tc.Automount)
+			},
+			name: "volumes",
+		},
+		{
+			input: map[string]string{
+				"hcloud_public_net_enable_ipv6": "true",
+				"hcloud_public_net_ipv4":        "ipv4",
+				"hcloud_public_net_ipv6":        "ipv6",
+			},
+			expectedOutput: func(t *testing.T, tc hcloudTargetConfig) {
+				assert.Equal(t, int64(1), tc.PublicNetIPv4.ID)
+				assert.Equal(t, int64(2), tc.PublicNetIPv6.ID)
+
+				opts := tc.serverCreateOpts("group-id")
+				assert.Equal(t, "fsn1-dc14", opts.Datacenter.Name)
+				assert.Nil(t, opts.Location)
+				assert.Equal(t, tc.PublicNetIPv4, opts.PublicNet.IPv4)
+				assert.Equal(t, tc.PublicNetIPv6, opts.PublicNet.IPv6)
+			},
+			name: "primary IPs",
+		},
+		{
+			input: map[string]string{
+				"hcloud_public_net_enable_ipv4": "false",
+				"hcloud_public_net_enable_ipv6": "true",
+				"hcloud_firewalls":              "web",
+			},
+			expectedOutput: func(t *testing.T, tc hcloudTargetConfig) {
+				assert.Len(t, tc.Firewalls, 1)
+			},
+			name: "IPv6 only with firewalls",
+		},
+		{
+			input: map[string]string{
+				"hcloud_public_net_enable_ipv4": "false",
+			},
+			expectedError: "hcloud_networks is required when both public IPv4 and IPv6 are disabled",
+			name:          "no public IPs without network",
+		},
+		{
+			input: map[string]string{
+				"hcloud_public_net_enable_ipv4": "false",
+				"hcloud_networks":               "private",
+				"hcloud_firewalls":              "web",
+			},
+			expectedError: "hcloud_firewalls require a public IPv4 or IPv6 to be enabled",
+			name:          "firewalls without public IPs",
+		},
+		{
+			input: map[string]string{
+				"hcloud_datacenter": "nbg1-dc3",
+			},
+			expectedError: "hcloud_datacenter nbg1-dc3 is not in hcloud_location fsn1",
+			name:          "datacenter outside of location",
+		},
+		{
+			input: map[string]string{
+				"hcloud_public_net_ipv6": "ipv6",
+			},
+			expectedError: "hcloud_public_net_ipv6 is set while the IP family is disabled",
+			name:          "primary IP of disabled family",
+		},
+		{
+			input: map[string]string{
+				"hcloud_public_net_ipv4": "ipv6",
+			},
+			expectedError: "hcloud_public_net_ipv4 must be a Primary IP of type ipv4",
+			name:          "primary IP of wrong type",
+		},
+		{
+			input: map[string]string{
+				"hcloud_public_net_enable_ipv6": "true",
+				"hcloud_public_net_ipv4":        "ipv4",
+				"hcloud_public_net_ipv6":        "ipv6-nbg1",
+			},
+			expectedError: "hcloud_public_net_ipv4 and hcloud_public_net_ipv6 must be in the same datacenter",
+			name:          "primary IPs in different datacenters",
+		},
+		{
+			input: map[string]string{
+				"hcloud_name_template": "{{ .GroupID }}_{{ .Index }}",
+			},
+			expectedError: "hcloud_name_template renders an invalid name: server name \"test_1\" is not a valid hostname",
+			name:          "invalid name template",
+		},
+		{
+			input: map[string]string{
+				"hcloud_volumes": "data-nbg1",
+			},
+			expectedError: "volume data-nbg1 is not in the location of the servers",
+			name:          "volume in other location",
+		},
+		{
+			input: map[string]string{
+				"hcloud_volumes":     "data",
+				"hcloud_automount":   "true",
+				"hcloud_volume_size": "10",
+			},
+			expectedError: "hcloud_automount and hcloud_volume_automount must match when both hcloud_volumes and hcloud_volume_size are set",
+			name:          "automount options differ",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			input := map[string]string{
+				"hcloud_location":  "fsn1",
+				"hcloud_user_data": "#!/bin/bash",
+				"hcloud_ssh_keys":  "my-key",
+				"hcloud_group_id":  "test",
+			}
+			for key, value := range tc.input {
+				input[key] = value
+			}
+
+			var actualOutput hcloudTargetConfig
+			err := parse(newTestParseClient(t), input, &actualOutput)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError, tc.name)
+				return
+			}
+			assert.NoError(t, err, tc.name)
+			tc.expectedOutput(t, actualOutput)
+		})
+	}
+}
@@ -0,0 +1,412 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+const (
+	dnsRecordTypeA    = "A"
+	dnsRecordTypeAAAA = "AAAA"
+	dnsRecordTypeTXT  = "TXT"
+
+	// dnsOwnerHeritage is written into the ownership TXT record which is
+	// created next to every address record, so that records belonging to a
+	// group can be found again without relying on naming conventions.
+	dnsOwnerHeritage = "nomad-hcloud-autoscaler"
+)
+
+// dnsZone is a zone as returned by the Hetzner DNS API.
+type dnsZone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// dnsRecord is a record as returned by the Hetzner DNS API.
+type dnsRecord struct {
+	ID     string `json:"id,omitempty"`
+	ZoneID string `json:"zone_id"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	TTL    int    `json:"ttl,omitempty"`
+}
+
+// dnsClient is a minimal client for the Hetzner DNS API which covers the
+// calls needed to manage server records.
+type dnsClient struct {
+	endpoint   string
+	token      string
+	perPage    int
+	httpClient *http.Client
+}
+
+// setupDNSClient instantiates the Hetzner DNS client if a DNS token has been
+// configured.
+func (t *TargetPlugin) setupDNSClient() {
+	if t.config.DNSToken == "" {
+		t.dns = nil
+		return
+	}
+	t.dns = &dnsClient{
+		endpoint:   strings.TrimSuffix(t.config.DNSEndpoint, "/"),
+		token:      t.config.DNSToken,
+		perPage:    t.config.ItemsPerPage,
+		httpClient: &http.Client{},
+	}
+}
+
+func (c *dnsClient) do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Auth-API-Token", c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s returned %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+	if out != nil && len(respBody) > 0 {
+		return json.Unmarshal(respBody, out)
+	}
+	return nil
+}
+
+func (c *dnsClient) getZone(ctx context.Context, name string) (*dnsZone, error) {
+	var resp struct {
+		Zones []*dnsZone `json:"zones"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(name), nil, &resp); err != nil {
+		return nil, err
+	}
+	for _, zone := range resp.Zones {
+		if zone.Name == name {
+			return zone, nil
+		}
+	}
+	return nil, fmt.Errorf("DNS zone %s was not found", name)
+}
+
+// listRecords returns all records of the zone, following the pages of the
+// records list.
+func (c *dnsClient) listRecords(ctx context.Context, zoneID string) ([]*dnsRecord, error) {
+	var records []*dnsRecord
+	for page := 1; ; page++ {
+		var resp struct {
+			Records []*dnsRecord `json:"records"`
+			Meta    struct {
+				Pagination struct {
+					LastPage int `json:"last_page"`
+				} `json:"pagination"`
+			} `json:"meta"`
+		}
+		query := url.Values{"zone_id": {zoneID}, "page": {strconv.Itoa(page)}}
+		if c.perPage > 0 {
+			query.Set("per_page", strconv.Itoa(c.perPage))
+		}
+		if err := c.do(ctx, http.MethodGet, "/records?"+query.Encode(), nil, &resp); err != nil {
+			return nil, err
+		}
+		records = append(records, resp.Records...)
+		if page >= resp.Meta.Pagination.LastPage || len(resp.Records) == 0 {
+			return records, nil
+		}
+	}
+}
+
+func (c *dnsClient) createRecord(ctx context.Context, record *dnsRecord) error {
+	return c.do(ctx, http.MethodPost, "/records", record, nil)
+}
+
+func (c *dnsClient) deleteRecord(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/records/"+url.PathEscape(id), nil, nil)
+}
+
+// dnsEnabled returns whether DNS records should be managed for the target.
+func (t *TargetPlugin) dnsEnabled(targetConfig *hcloudTargetConfig) bool {
+	return t.dns != nil && targetConfig.DNSZone != ""
+}
+
+// dnsRecordName renders the record name template for the passed server.
+func (tc *hcloudTargetConfig) dnsRecordName(server *hcloud.Server) (string, error) {
+	return renderTemplate("DNS record", tc.DNSRecordTemplate, map[string]interface{}{
+		"Name":    server.Name,
+		"ID":      server.ID,
+		"GroupID": tc.GroupID,
+	})
+}
+
+// dnsOwnerValue is the value of the TXT record marking a record name as owned
+// by the group.
+func (tc *hcloudTargetConfig) dnsOwnerValue() string {
+	return fmt.Sprintf("\"heritage=%s,group-id=%s\"", dnsOwnerHeritage, tc.GroupID)
+}
+
+// dnsAddressRecords returns the address records which should exist for the
+// passed server.
+func (tc *hcloudTargetConfig) dnsAddressRecords(server *hcloud.Server) []*dnsRecord {
+	var records []*dnsRecord
+	if tc.DNSPrivateIP {
+		for _, privateNet := range server.PrivateNet {
+			if privateNet.IP != nil {
+				records = append(records, &dnsRecord{Type: dnsRecordTypeA, Value: privateNet.IP.String()})
+				break
+			}
+		}
+		return records
+	}
+	if !server.PublicNet.IPv4.IsUnspecified() {
+		records = append(records, &dnsRecord{Type: dnsRecordTypeA, Value: server.PublicNet.IPv4.IP.String()})
+	}
+	if !server.PublicNet.IPv6.IsUnspecified() {
+		// Hetzner assigns a /64 network to each server, the server itself
+		// configures the first address of it.
+		ip := make(net.IP, len(server.PublicNet.IPv6.IP))
+		copy(ip, server.PublicNet.IPv6.IP)
+		ip[len(ip)-1] |= 1
+		records = append(records, &dnsRecord{Type: dnsRecordTypeAAAA, Value: ip.String()})
+	}
+	return records
+}
+
+// serverDNSRecords returns the address and ownership records which should
+// exist for the passed server. None are returned if the server has no IP
+// address yet.
+func (tc *hcloudTargetConfig) serverDNSRecords(server *hcloud.Server) ([]*dnsRecord, error) {
+	name, err := tc.dnsRecordName(server)
+	if err != nil {
+		return nil, err
+	}
+	records := tc.dnsAddressRecords(server)
+	if len(records) == 0 {
+		return nil, nil
+	}
+	records = append(records, &dnsRecord{Type: dnsRecordTypeTXT, Value: tc.dnsOwnerValue()})
+	for _, record := range records {
+		record.Name = name
+		record.TTL = tc.DNSTTL
+	}
+	return records, nil
+}
+
+// dnsRecordKey identifies a record by its type, name and value, so that
+// servers sharing a record name are told apart by their IP address.
+type dnsRecordKey struct {
+	recordType string
+	name       string
+	value      string
+}
+
+func (r *dnsRecord) key() dnsRecordKey {
+	return dnsRecordKey{recordType: r.Type, name: r.Name, value: r.Value}
+}
+
+// dnsRecordKeys returns the keys of the passed records.
+func dnsRecordKeys(records []*dnsRecord) map[dnsRecordKey]struct{} {
+	keys := make(map[dnsRecordKey]struct{}, len(records))
+	for _, record := range records {
+		keys[record.key()] = struct{}{}
+	}
+	return keys
+}
+
+// createDNSRecords creates address and ownership records for each of the
+// passed servers.
+func (t *TargetPlugin) createDNSRecords(ctx context.Context, targetConfig *hcloudTargetConfig, servers []*hcloud.Server) error {
+	if !t.dnsEnabled(targetConfig) || len(servers) == 0 {
+		return nil
+	}
+	zone, err := t.dns.getZone(ctx, targetConfig.DNSZone)
+	if err != nil {
+		return err
+	}
+	records, err := t.dns.listRecords(ctx, zone.ID)
+	if err != nil {
+		return err
+	}
+	existing := dnsRecordKeys(records)
+	for _, server := range servers {
+		if err := t.createServerDNSRecords(ctx, zone, targetConfig, server, existing); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createServerDNSRecords creates the records of the server which do not exist
+// yet. The ownership record is shared by all servers with the same record
+// name, so it is only created once. Created records are added to existing.
+func (t *TargetPlugin) createServerDNSRecords(ctx context.Context, zone *dnsZone, targetConfig *hcloudTargetConfig, server *hcloud.Server, existing map[dnsRecordKey]struct{}) error {
+	records, err := targetConfig.serverDNSRecords(server)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		t.logger.Warn("no IP address to create a DNS record for", "server", server.Name)
+		return nil
+	}
+	var created bool
+	for _, record := range records {
+		if _, ok := existing[record.key()]; ok {
+			continue
+		}
+		record.ZoneID = zone.ID
+		if err := t.dns.createRecord(ctx, record); err != nil {
+			return fmt.Errorf("failed to create %s record %s for server %s: %v", record.Type, record.Name, server.Name, err)
+		}
+		existing[record.key()] = struct{}{}
+		created = true
+	}
+	if created {
+		t.logger.Info("created DNS records", "server", server.Name, "record", records[0].Name, "zone", zone.Name)
+	}
+	return nil
+}
+
+// deleteDNSRecords removes the records of the passed servers. Records of
+// other servers sharing the record name are kept.
+func (t *TargetPlugin) deleteDNSRecords(ctx context.Context, targetConfig *hcloudTargetConfig, servers []*hcloud.Server) error {
+	if !t.dnsEnabled(targetConfig) || len(servers) == 0 {
+		return nil
+	}
+	var removed []*dnsRecord
+	for _, server := range servers {
+		records, err := targetConfig.serverDNSRecords(server)
+		if err != nil {
+			return err
+		}
+		removed = append(removed, records...)
+	}
+	zone, err := t.dns.getZone(ctx, targetConfig.DNSZone)
+	if err != nil {
+		return err
+	}
+	records, err := t.dns.listRecords(ctx, zone.ID)
+	if err != nil {
+		return err
+	}
+	stale := dnsRecordKeys(removed)
+	return t.deleteOwnedDNSRecords(ctx, targetConfig, records, func(record *dnsRecord) bool {
+		_, ok := stale[record.key()]
+		return ok
+	})
+}
+
+// reconcileDNSRecords makes the records owned by the group match the passed
+// servers. Records of servers which no longer exist are deleted and missing
+// records of existing servers are created.
+func (t *TargetPlugin) reconcileDNSRecords(ctx context.Context, targetConfig *hcloudTargetConfig, servers []*hcloud.Server) error {
+	if !t.dnsEnabled(targetConfig) {
+		return nil
+	}
+	zone, err := t.dns.getZone(ctx, targetConfig.DNSZone)
+	if err != nil {
+		return err
+	}
+	records, err := t.dns.listRecords(ctx, zone.ID)
+	if err != nil {
+		return err
+	}
+
+	existing := dnsRecordKeys(records)
+	desired := make(map[dnsRecordKey]struct{})
+	for _, server := range servers {
+		serverRecords, err := targetConfig.serverDNSRecords(server)
+		if err != nil {
+			return err
+		}
+		for _, record := range serverRecords {
+			desired[record.key()] = struct{}{}
+		}
+		if err := t.createServerDNSRecords(ctx, zone, targetConfig, server, existing); err != nil {
+			return err
+		}
+	}
+
+	return t.deleteOwnedDNSRecords(ctx, targetConfig, records, func(record *dnsRecord) bool {
+		_, ok := desired[record.key()]
+		return !ok
+	})
+}
+
+// ownedDNSNames returns the record names marked with the group's ownership
+// TXT record.
+func (tc *hcloudTargetConfig) ownedDNSNames(records []*dnsRecord) map[string]struct{} {
+	owner := tc.dnsOwnerValue()
+	owned := make(map[string]struct{})
+	for _, record := range records {
+		if record.Type == dnsRecordTypeTXT && record.Value == owner {
+			owned[record.Name] = struct{}{}
+		}
+	}
+	return owned
+}
+
+// deleteOwnedDNSRecords deletes the stale address records under the names
+// owned by the group. The ownership record of a name is only deleted once no
+// address record is left under the name.
+func (t *TargetPlugin) deleteOwnedDNSRecords(ctx context.Context, targetConfig *hcloudTargetConfig, records []*dnsRecord, stale func(*dnsRecord) bool) error {
+	owned := targetConfig.ownedDNSNames(records)
+	owner := targetConfig.dnsOwnerValue()
+
+	var deleted []*dnsRecord
+	remaining := make(map[string]int)
+	for _, record := range records {
+		if _, ok := owned[record.Name]; !ok {
+			continue
+		}
+		if record.Type != dnsRecordTypeA && record.Type != dnsRecordTypeAAAA {
+			continue
+		}
+		if stale(record) {
+			deleted = append(deleted, record)
+		} else {
+			remaining[record.Name]++
+		}
+	}
+	for _, record := range records {
+		if record.Type == dnsRecordTypeTXT && record.Value == owner && remaining[record.Name] == 0 && stale(record) {
+			deleted = append(deleted, record)
+		}
+	}
+
+	for _, record := range deleted {
+		if err := t.dns.deleteRecord(ctx, record.ID); err != nil {
+			return fmt.Errorf("failed to delete %s record %s: %v", record.Type, record.Name, err)
+		}
+		t.logger.Info("deleted DNS record", "type", record.Type, "record", record.Name, "value", record.Value)
+	}
+	return nil
+}
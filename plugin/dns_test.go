@@ -0,0 +1,252 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDNSAPI is an in-memory stand-in of the Hetzner DNS API.
+type fakeDNSAPI struct {
+	mu      sync.Mutex
+	zone    dnsZone
+	records map[string]*dnsRecord
+	nextID  int
+}
+
+func newFakeDNSAPI(zoneName string, records ...*dnsRecord) *fakeDNSAPI {
+	api := &fakeDNSAPI{
+		zone:    dnsZone{ID: "zone1", Name: zoneName},
+		records: make(map[string]*dnsRecord),
+	}
+	for _, record := range records {
+		api.add(record)
+	}
+	return api
+}
+
+func (f *fakeDNSAPI) add(record *dnsRecord) {
+	f.nextID++
+	record.ID = fmt.Sprintf("rec%d", f.nextID)
+	record.ZoneID = f.zone.ID
+	f.records[record.ID] = record
+}
+
+func (f *fakeDNSAPI) names(recordType string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []string
+	for _, record := range f.records {
+		if record.Type == recordType {
+			out = append(out, record.Name+"="+record.Value)
+		}
+	}
+	return out
+}
+
+func (f *fakeDNSAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Header.Get("Auth-API-Token") != "token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/zones":
+		zones := []dnsZone{}
+		if r.URL.Query().Get("name") == f.zone.Name {
+			zones = append(zones, f.zone)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"zones": zones})
+	case r.Method == http.MethodGet && r.URL.Path == "/records":
+		records := []*dnsRecord{}
+		for _, record := range f.records {
+			records = append(records, record)
+		}
+		sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+		page, perPage = max(page, 1), max(perPage, 1)
+		lastPage := max((len(records)+perPage-1)/perPage, 1)
+		start, end := min((page-1)*perPage, len(records)), min(page*perPage, len(records))
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"records": records[start:end],
+			"meta":    map[string]interface{}{"pagination": map[string]interface{}{"page": page, "per_page": perPage, "last_page": lastPage}},
+		})
+	case r.Method == http.MethodPost && r.URL.Path == "/records":
+		var record dnsRecord
+		if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		f.add(&record)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"record": record})
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/records/"):
+		id := strings.TrimPrefix(r.URL.Path, "/records/")
+		if _, ok := f.records[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.records, id)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func testDNSServer(name string, ipv4 string) *hcloud.Server {
+	return &hcloud.Server{
+		Name: name,
+		PublicNet: hcloud.ServerPublicNet{
+			IPv4: hcloud.ServerPublicNetIPv4{IP: net.ParseIP(ipv4)},
+		},
+	}
+}
+
+func TestTargetPlugin_reconcileDNSRecords(t *testing.T) {
+	targetConfig := &hcloudTargetConfig{
+		GroupID:           "test",
+		DNSZone:           "example.com",
+		DNSRecordTemplate: "{{ .Name }}.nomad",
+		DNSTTL:            60,
+	}
+
+	fake := newFakeDNSAPI("example.com",
+		// Stale record of a server which is gone.
+		&dnsRecord{Type: dnsRecordTypeA, Name: "test-old.nomad", Value: "10.0.0.9"},
+		&dnsRecord{Type: dnsRecordTypeTXT, Name: "test-old.nomad", Value: targetConfig.dnsOwnerValue()},
+		// Record which is not owned by the group and must be kept.
+		&dnsRecord{Type: dnsRecordTypeA, Name: "www", Value: "10.0.0.8"},
+		&dnsRecord{Type: dnsRecordTypeA, Name: "other.nomad", Value: "10.0.0.7"},
+		&dnsRecord{Type: dnsRecordTypeTXT, Name: "other.nomad", Value: "\"heritage=nomad-hcloud-autoscaler,group-id=other\""},
+	)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	tp := TargetPlugin{
+		logger: hclog.NewNullLogger(),
+		// A small page size spreads the records over several pages.
+		config: hcloudPluginConfig{DNSToken: "token", DNSEndpoint: srv.URL + "/", ItemsPerPage: 2},
+	}
+	tp.setupDNSClient()
+
+	servers := []*hcloud.Server{testDNSServer("test-new", "10.0.0.1")}
+	err := tp.reconcileDNSRecords(context.Background(), targetConfig, servers)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"test-new.nomad=10.0.0.1",
+		"www=10.0.0.8",
+		"other.nomad=10.0.0.7",
+	}, fake.names(dnsRecordTypeA))
+
+	err = tp.deleteDNSRecords(context.Background(), targetConfig, servers)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"www=10.0.0.8",
+		"other.nomad=10.0.0.7",
+	}, fake.names(dnsRecordTypeA))
+	assert.Len(t, fake.names(dnsRecordTypeTXT), 1)
+}
+
+func TestTargetPlugin_deleteDNSRecords_sharedName(t *testing.T) {
+	targetConfig := &hcloudTargetConfig{
+		GroupID:           "test",
+		DNSZone:           "example.com",
+		DNSRecordTemplate: "{{ .GroupID }}.nomad",
+		DNSTTL:            60,
+	}
+
+	fake := newFakeDNSAPI("example.com",
+		// Record of a server which is gone, under the shared name.
+		&dnsRecord{Type: dnsRecordTypeA, Name: "test.nomad", Value: "10.0.0.8"},
+	)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	tp := TargetPlugin{
+		logger: hclog.NewNullLogger(),
+		config: hcloudPluginConfig{DNSToken: "token", DNSEndpoint: srv.URL + "/"},
+	}
+	tp.setupDNSClient()
+
+	servers := []*hcloud.Server{testDNSServer("test-1", "10.0.0.1"), testDNSServer("test-2", "10.0.0.2")}
+	assert.NoError(t, tp.createDNSRecords(context.Background(), targetConfig, servers))
+	assert.ElementsMatch(t, []string{
+		"test.nomad=10.0.0.1",
+		"test.nomad=10.0.0.2",
+		"test.nomad=10.0.0.8",
+	}, fake.names(dnsRecordTypeA))
+	// The ownership record is shared by the servers.
+	assert.Len(t, fake.names(dnsRecordTypeTXT), 1)
+
+	// Only the records of the removed server are deleted.
+	assert.NoError(t, tp.deleteDNSRecords(context.Background(), targetConfig, servers[:1]))
+	assert.ElementsMatch(t, []string{
+		"test.nomad=10.0.0.2",
+		"test.nomad=10.0.0.8",
+	}, fake.names(dnsRecordTypeA))
+	assert.Len(t, fake.names(dnsRecordTypeTXT), 1)
+
+	// Records of servers which are gone are reconciled by their IP address.
+	assert.NoError(t, tp.reconcileDNSRecords(context.Background(), targetConfig, servers[1:]))
+	assert.ElementsMatch(t, []string{
+		"test.nomad=10.0.0.2",
+	}, fake.names(dnsRecordTypeA))
+	assert.Len(t, fake.names(dnsRecordTypeTXT), 1)
+
+	// Once no server is left, the name no longer belongs to the group.
+	assert.NoError(t, tp.reconcileDNSRecords(context.Background(), targetConfig, nil))
+	assert.Empty(t, fake.names(dnsRecordTypeA))
+	assert.Empty(t, fake.names(dnsRecordTypeTXT))
+}
+
+func Test_hcloudTargetConfig_dnsAddressRecords(t *testing.T) {
+	_, ipv6Net, _ := net.ParseCIDR("2001:db8::/64")
+	server := &hcloud.Server{
+		Name: "test-1",
+		PublicNet: hcloud.ServerPublicNet{
+			IPv4: hcloud.ServerPublicNetIPv4{IP: net.ParseIP("192.0.2.1")},
+			IPv6: hcloud.ServerPublicNetIPv6{IP: ipv6Net.IP, Network: ipv6Net},
+		},
+		PrivateNet: []hcloud.ServerPrivateNet{{IP: net.ParseIP("10.0.0.2")}},
+	}
+
+	testCases := []struct {
+		privateIP      bool
+		expectedOutput []string
+		name           string
+	}{
+		{
+			privateIP:      false,
+			expectedOutput: []string{"A=192.0.2.1", "AAAA=2001:db8::1"},
+			name:           "public addresses",
+		},
+		{
+			privateIP:      true,
+			expectedOutput: []string{"A=10.0.0.2"},
+			name:           "private address",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			targetConfig := hcloudTargetConfig{DNSPrivateIP: tc.privateIP}
+			var actualOutput []string
+			for _, record := range targetConfig.dnsAddressRecords(server) {
+				actualOutput = append(actualOutput, record.Type+"="+record.Value)
+			}
+			assert.Equal(t, tc.expectedOutput, actualOutput, tc.name)
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+const (
+	// managedByLabel marks resources created by the plugin. Only resources
+	// carrying it together with the group label are ever updated.
+	managedByLabel = "managed-by"
+
+	// managedByValue is the value of the managedByLabel.
+	managedByValue = "nomad-hcloud-autoscaler"
+
+	// firewallRuleSep separates the fields of a firewall rule.
+	firewallRuleSep = "|"
+)
+
+// hcloudEnsureConfig describes the resources which the target config refers
+// to and which should be created if they are missing. It is decoded from the
+// raw target config without looking up any resource, as those may not exist
+// yet.
+type hcloudEnsureConfig struct {
+	Enabled            bool     `mapstructure:"hcloud_ensure_resources"`
+	GroupID            string   `mapstructure:"hcloud_group_id" validate:"required"`
+	Firewalls          []string `mapstructure:"hcloud_firewalls"`
+	FirewallRules      []string `mapstructure:"hcloud_firewall_rules"`
+	Networks           []string `mapstructure:"hcloud_networks"`
+	NetworkIPRange     string   `mapstructure:"hcloud_network_ip_range" default:"10.0.0.0/16" validate:"cidrv4"`
+	NetworkSubnet      string   `mapstructure:"hcloud_network_subnet" validate:"omitempty,cidrv4"`
+	NetworkZone        string   `mapstructure:"hcloud_network_zone" default:"eu-central"`
+	PlacementGroup     string   `mapstructure:"hcloud_placement_group"`
+	PlacementGroupType string   `mapstructure:"hcloud_placement_group_type" default:"spread" validate:"oneof=spread"`
+}
+
+// ownedLabels returns the labels set on resources created by the plugin.
+func (ec *hcloudEnsureConfig) ownedLabels(labelName string) map[string]string {
+	return map[string]string{
+		managedByLabel: managedByValue,
+		labelName:      ec.GroupID,
+	}
+}
+
+// owns returns whether a resource with the passed labels was created by the
+// plugin for the group.
+func (ec *hcloudEnsureConfig) owns(labelName string, labels map[string]string) bool {
+	return labels[managedByLabel] == managedByValue && labels[labelName] == ec.GroupID
+}
+
+// parseFirewallRule parses a rule in a format
+// `direction|protocol|port|ip1 ip2 ... ipN`. The IPs are source IPs of
+// inbound rules and destination IPs of outbound rules.
+func parseFirewallRule(rule string) (hcloud.FirewallRule, error) {
+	fields := strings.Split(rule, firewallRuleSep)
+	if len(fields) != 4 {
+		return hcloud.FirewallRule{}, fmt.Errorf("firewall rule %q must have 4 fields separated by %q", rule, firewallRuleSep)
+	}
+
+	out := hcloud.FirewallRule{
+		Direction: hcloud.FirewallRuleDirection(strings.TrimSpace(fields[0])),
+		Protocol:  hcloud.FirewallRuleProtocol(strings.TrimSpace(fields[1])),
+	}
+	if out.Direction != hcloud.FirewallRuleDirectionIn && out.Direction != hcloud.FirewallRuleDirectionOut {
+		return hcloud.FirewallRule{}, fmt.Errorf("invalid direction %q in firewall rule %q", fields[0], rule)
+	}
+	if port := strings.TrimSpace(fields[2]); port != "" {
+		out.Port = hcloud.Ptr(port)
+	}
+
+	var ips []net.IPNet
+	for _, cidr := range strings.Fields(fields[3]) {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return hcloud.FirewallRule{}, fmt.Errorf("invalid IP range %q in firewall rule %q", cidr, rule)
+		}
+		ips = append(ips, *ipNet)
+	}
+	if len(ips) == 0 {
+		return hcloud.FirewallRule{}, fmt.Errorf("firewall rule %q has no IP ranges", rule)
+	}
+	if out.Direction == hcloud.FirewallRuleDirectionIn {
+		out.SourceIPs = ips
+	} else {
+		out.DestinationIPs = ips
+	}
+	return out, nil
+}
+
+// firewallRuleKey returns a comparable representation of a firewall rule.
+func firewallRuleKey(rule hcloud.FirewallRule) string {
+	ipNets := rule.SourceIPs
+	if rule.Direction == hcloud.FirewallRuleDirectionOut {
+		ipNets = rule.DestinationIPs
+	}
+	var ips []string
+	for _, ipNet := range ipNets {
+		ips = append(ips, ipNet.String())
+	}
+	sort.Strings(ips)
+	var port string
+	if rule.Port != nil {
+		port = *rule.Port
+	}
+	return strings.Join([]string{string(rule.Direction), string(rule.Protocol), port, strings.Join(ips, " ")}, firewallRuleSep)
+}
+
+// sameFirewallRules returns whether both rule sets are equal regardless of
+// their order.
+func sameFirewallRules(a, b []hcloud.FirewallRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	var keysA, keysB []string
+	for i := range a {
+		keysA = append(keysA, firewallRuleKey(a[i]))
+		keysB = append(keysB, firewallRuleKey(b[i]))
+	}
+	sort.Strings(keysA)
+	sort.Strings(keysB)
+	return strings.Join(keysA, ",") == strings.Join(keysB, ",")
+}
+
+// ensureResources creates the firewalls, networks and placement group the
+// target config refers to if they are missing, and updates them if they have
+// been created by the plugin. Resources are only ensured once per distinct
+// config.
+func (t *TargetPlugin) ensureResources(ctx context.Context, config map[string]string) error {
+	var ensureConfig hcloudEnsureConfig
+	if err := parse(nil, config, &ensureConfig); err != nil {
+		return fmt.Errorf("failed to parse HCloud resources config: %v", err)
+	}
+	if !ensureConfig.Enabled {
+		return nil
+	}
+
+	key := fmt.Sprintf("%+v", ensureConfig)
+	t.ensuredLock.Lock()
+	defer t.ensuredLock.Unlock()
+	if t.ensured == nil {
+		t.ensured = make(map[string]struct{})
+	}
+	if _, ok := t.ensured[key]; ok {
+		return nil
+	}
+
+	for _, name := range ensureConfig.Firewalls {
+		if err := t.ensureFirewall(ctx, &ensureConfig, name); err != nil {
+			return err
+		}
+	}
+	for _, name := range ensureConfig.Networks {
+		if err := t.ensureNetwork(ctx, &ensureConfig, name); err != nil {
+			return err
+		}
+	}
+	if ensureConfig.PlacementGroup != "" {
+		if err := t.ensurePlacementGroup(ctx, &ensureConfig, ensureConfig.PlacementGroup); err != nil {
+			return err
+		}
+	}
+
+	t.ensured[key] = struct{}{}
+	return nil
+}
+
+func (t *TargetPlugin) ensureFirewall(ctx context.Context, ensureConfig *hcloudEnsureConfig, name string) error {
+	var rules []hcloud.FirewallRule
+	for _, ruleStr := range ensureConfig.FirewallRules {
+		rule, err := parseFirewallRule(ruleStr)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+	}
+
+	firewall, _, err := t.client(ctx).Firewall.Get(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to get firewall %s: %v", name, err)
+	}
+
+	if firewall == nil {
+		result, _, err := t.client(ctx).Firewall.Create(ctx, hcloud.FirewallCreateOpts{
+			Name:   name,
+			Labels: ensureConfig.ownedLabels(t.config.GroupIDLabelSelector),
+			Rules:  rules,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create firewall %s: %v", name, err)
+		}
+		if err := t.waitForActions(ctx, actionIDs(result.Actions)); err != nil {
+			return fmt.Errorf("failed to wait for firewall %s to be created: %v", name, err)
+		}
+		t.logger.Info("created firewall", "firewall", name, "rules", len(rules))
+		return nil
+	}
+
+	if !ensureConfig.owns(t.config.GroupIDLabelSelector, firewall.Labels) {
+		t.logger.Debug("firewall is not managed by the plugin, leaving it untouched", "firewall", name)
+		return nil
+	}
+	if sameFirewallRules(firewall.Rules, rules) {
+		return nil
+	}
+	actions, _, err := t.client(ctx).Firewall.SetRules(ctx, firewall, hcloud.FirewallSetRulesOpts{Rules: rules})
+	if err != nil {
+		return fmt.Errorf("failed to update rules of firewall %s: %v", name, err)
+	}
+	if err := t.waitForActions(ctx, actionIDs(actions)); err != nil {
+		return fmt.Errorf("failed to wait for rules of firewall %s to be updated: %v", name, err)
+	}
+	t.logger.Info("updated firewall rules", "firewall", name, "rules", len(rules))
+	return nil
+}
+
+func (t *TargetPlugin) ensureNetwork(ctx context.Context, ensureConfig *hcloudEnsureConfig, name string) error {
+	_, ipRange, err := net.ParseCIDR(ensureConfig.NetworkIPRange)
+	if err != nil {
+		return fmt.Errorf("invalid network IP range %s: %v", ensureConfig.NetworkIPRange, err)
+	}
+	var subnets []hcloud.NetworkSubnet
+	if ensureConfig.NetworkSubnet != "" {
+		_, subnetRange, err := net.ParseCIDR(ensureConfig.NetworkSubnet)
+		if err != nil {
+			return fmt.Errorf("invalid network subnet %s: %v", ensureConfig.NetworkSubnet, err)
+		}
+		subnets = append(subnets, hcloud.NetworkSubnet{
+			Type:        hcloud.NetworkSubnetTypeCloud,
+			IPRange:     subnetRange,
+			NetworkZone: hcloud.NetworkZone(ensureConfig.NetworkZone),
+		})
+	}
+
+	network, _, err := t.client(ctx).Network.Get(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to get network %s: %v", name, err)
+	}
+
+	if network == nil {
+		_, _, err := t.client(ctx).Network.Create(ctx, hcloud.NetworkCreateOpts{
+			Name:    name,
+			IPRange: ipRange,
+			Subnets: subnets,
+			Labels:  ensureConfig.ownedLabels(t.config.GroupIDLabelSelector),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create network %s: %v", name, err)
+		}
+		t.logger.Info("created network", "network", name, "ip_range", ipRange.String())
+		return nil
+	}
+
+	if !ensureConfig.owns(t.config.GroupIDLabelSelector, network.Labels) {
+		t.logger.Debug("network is not managed by the plugin, leaving it untouched", "network", name)
+		return nil
+	}
+
+	var ids []int64
+	if network.IPRange == nil || network.IPRange.String() != ipRange.String() {
+		action, _, err := t.client(ctx).Network.ChangeIPRange(ctx, network, hcloud.NetworkChangeIPRangeOpts{IPRange: ipRange})
+		if err != nil {
+			return fmt.Errorf("failed to change IP range of network %s: %v", name, err)
+		}
+		ids = append(ids, action.ID)
+		t.logger.Info("changed network IP range", "network", name, "ip_range", ipRange.String())
+	}
+	for _, subnet := range subnets {
+		if hasSubnet(network, subnet) {
+			continue
+		}
+		action, _, err := t.client(ctx).Network.AddSubnet(ctx, network, hcloud.NetworkAddSubnetOpts{Subnet: subnet})
+		if err != nil {
+			return fmt.Errorf("failed to add subnet %s to network %s: %v", subnet.IPRange.String(), name, err)
+		}
+		ids = append(ids, action.ID)
+		t.logger.Info("added network subnet", "network", name, "subnet", subnet.IPRange.String())
+	}
+	if err := t.waitForActions(ctx, ids); err != nil {
+		return fmt.Errorf("failed to wait for network %s to be updated: %v", name, err)
+	}
+	return nil
+}
+
+func hasSubnet(network *hcloud.Network, subnet hcloud.NetworkSubnet) bool {
+	for _, existing := range network.Subnets {
+		if existing.IPRange != nil && existing.IPRange.String() == subnet.IPRange.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TargetPlugin) ensurePlacementGroup(ctx context.Context, ensureConfig *hcloudEnsureConfig, name string) error {
+	placementGroup, _, err := t.client(ctx).PlacementGroup.Get(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to get placement group %s: %v", name, err)
+	}
+	if placementGroup != nil {
+		return nil
+	}
+
+	result, _, err := t.client(ctx).PlacementGroup.Create(ctx, hcloud.PlacementGroupCreateOpts{
+		Name:   name,
+		Labels: ensureConfig.ownedLabels(t.config.GroupIDLabelSelector),
+		Type:   hcloud.PlacementGroupType(ensureConfig.PlacementGroupType),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create placement group %s: %v", name, err)
+	}
+	if result.Action != nil {
+		if err := t.waitForActions(ctx, []int64{result.Action.ID}); err != nil {
+			return fmt.Errorf("failed to wait for placement group %s to be created: %v", name, err)
+		}
+	}
+	t.logger.Info("created placement group", "placement_group", name)
+	return nil
+}
+
+// actionIDs returns the IDs of the passed actions.
+func actionIDs(actions []*hcloud.Action) []int64 {
+	var ids []int64
+	for _, action := range actions {
+		ids = append(ids, action.ID)
+	}
+	return ids
+}
@@ -0,0 +1,172 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseFirewallRule(t *testing.T) {
+	testCases := []struct {
+		input          string
+		expectedOutput string
+		expectedError  bool
+		name           string
+	}{
+		{
+			input:          "in|tcp|22|0.0.0.0/0 ::/0",
+			expectedOutput: "in|tcp|22|0.0.0.0/0 ::/0",
+			name:           "inbound rule",
+		},
+		{
+			input:          "out|icmp||10.0.0.0/8",
+			expectedOutput: "out|icmp||10.0.0.0/8",
+			name:           "outbound rule without port",
+		},
+		{
+			input:         "in|tcp|22",
+			expectedError: true,
+			name:          "missing field",
+		},
+		{
+			input:         "sideways|tcp|22|0.0.0.0/0",
+			expectedError: true,
+			name:          "invalid direction",
+		},
+		{
+			input:         "in|tcp|22|10.0.0.1",
+			expectedError: true,
+			name:          "invalid IP range",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rule, err := parseFirewallRule(tc.input)
+			if tc.expectedError {
+				assert.Error(t, err, tc.name)
+				return
+			}
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.expectedOutput, firewallRuleKey(rule), tc.name)
+		})
+	}
+}
+
+func TestTargetPlugin_ensureResources(t *testing.T) {
+	owned := map[string]string{managedByLabel: managedByValue, "group-id": "test"}
+
+	testCases := []struct {
+		inputFirewalls     []schema.Firewall
+		inputNetworks      []schema.Network
+		expectedCreated    []string
+		expectedRulesSet   bool
+		expectedSubnetsAdd int
+		name               string
+	}{
+		{
+			expectedCreated: []string{"firewall", "network", "placement_group"},
+			name:            "missing resources created",
+		},
+		{
+			inputFirewalls: []schema.Firewall{{ID: 1, Name: "fw", Labels: owned}},
+			inputNetworks: []schema.Network{{ID: 2, Name: "net", IPRange: "10.0.0.0/16", Labels: owned,
+				Subnets: []schema.NetworkSubnet{}}},
+			expectedCreated:    []string{"placement_group"},
+			expectedRulesSet:   true,
+			expectedSubnetsAdd: 1,
+			name:               "owned resources updated",
+		},
+		{
+			inputFirewalls:  []schema.Firewall{{ID: 1, Name: "fw"}},
+			inputNetworks:   []schema.Network{{ID: 2, Name: "net", IPRange: "192.168.0.0/16"}},
+			expectedCreated: []string{"placement_group"},
+			name:            "foreign resources untouched",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var created []string
+			var rulesSet bool
+			var subnetsAdded int
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /firewalls", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, schema.FirewallListResponse{Firewalls: tc.inputFirewalls})
+			})
+			mux.HandleFunc("POST /firewalls", func(w http.ResponseWriter, r *http.Request) {
+				var req schema.FirewallCreateRequest
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+				assert.Equal(t, owned, *req.Labels)
+				assert.Len(t, req.Rules, 1)
+				created = append(created, "firewall")
+				w.WriteHeader(http.StatusCreated)
+				writeJSON(w, schema.FirewallCreateResponse{Firewall: schema.Firewall{ID: 1, Name: req.Name}})
+			})
+			mux.HandleFunc("POST /firewalls/1/actions/set_rules", func(w http.ResponseWriter, r *http.Request) {
+				rulesSet = true
+				writeJSON(w, schema.FirewallActionSetRulesResponse{})
+			})
+			mux.HandleFunc("GET /networks", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, schema.NetworkListResponse{Networks: tc.inputNetworks})
+			})
+			mux.HandleFunc("POST /networks", func(w http.ResponseWriter, r *http.Request) {
+				var req schema.NetworkCreateRequest
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+				assert.Equal(t, "10.0.0.0/16", req.IPRange)
+				assert.Len(t, req.Subnets, 1)
+				created = append(created, "network")
+				w.WriteHeader(http.StatusCreated)
+				writeJSON(w, schema.NetworkCreateResponse{Network: schema.Network{ID: 2, Name: req.Name, IPRange: req.IPRange}})
+			})
+			mux.HandleFunc("POST /networks/2/actions/add_subnet", func(w http.ResponseWriter, r *http.Request) {
+				subnetsAdded++
+				w.WriteHeader(http.StatusCreated)
+				writeJSON(w, schema.NetworkActionAddSubnetResponse{Action: schema.Action{ID: 7, Status: "success", Progress: 100}})
+			})
+			mux.HandleFunc("GET /placement_groups", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, schema.PlacementGroupListResponse{})
+			})
+			mux.HandleFunc("POST /placement_groups", func(w http.ResponseWriter, r *http.Request) {
+				created = append(created, "placement_group")
+				w.WriteHeader(http.StatusCreated)
+				writeJSON(w, schema.PlacementGroupCreateResponse{PlacementGroup: schema.PlacementGroup{ID: 3, Name: "pg"}})
+			})
+			mux.HandleFunc("GET /actions", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, schema.ActionListResponse{Actions: []schema.Action{{ID: 7, Status: "success", Progress: 100}}})
+			})
+
+			tp := TargetPlugin{
+				logger: hclog.NewNullLogger(),
+				config: hcloudPluginConfig{GroupIDLabelSelector: "group-id"},
+				hcloud: newTestHCloudClient(t, mux),
+			}
+			config := map[string]string{
+				"hcloud_ensure_resources": "true",
+				"hcloud_group_id":         "test",
+				"hcloud_firewalls":        "fw",
+				"hcloud_firewall_rules":   "in|tcp|22|0.0.0.0/0 ::/0",
+				"hcloud_networks":         "net",
+				"hcloud_network_subnet":   "10.0.1.0/24",
+				"hcloud_placement_group":  "pg",
+			}
+
+			err := tp.ensureResources(context.Background(), config)
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.expectedCreated, created, tc.name)
+			assert.Equal(t, tc.expectedRulesSet, rulesSet, tc.name)
+			assert.Equal(t, tc.expectedSubnetsAdd, subnetsAdded, tc.name)
+
+			// Resources are only ensured once per config.
+			created = nil
+			assert.NoError(t, tp.ensureResources(context.Background(), config), tc.name)
+			assert.Empty(t, created, tc.name)
+		})
+	}
+}
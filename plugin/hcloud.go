@@ -3,10 +3,15 @@ package plugin
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strings"
 
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
 	"github.com/hashicorp/nomad/api"
 	"github.com/hetznercloud/hcloud-go/v2/hcloud"
 )
@@ -15,10 +20,10 @@ import (
 // required Hetzner Cloud client.
 func (t *TargetPlugin) setupHCloudClient() {
 	t.hcloud = hcloud.NewClient(hcloud.WithToken(t.config.Token))
-}
-
-func (t *TargetPlugin) client() *hcloud.Client {
-	return t.hcloud
+	t.projects = map[string]*hcloud.Client{"": t.hcloud}
+	for name, token := range t.config.ProjectTokens {
+		t.projects[name] = hcloud.NewClient(hcloud.WithToken(token))
+	}
 }
 
 func readUserDataFromFile(filePath string) (string, error) {
@@ -40,64 +45,311 @@ func readUserDataFromFile(filePath string) (string, error) {
 	return string(data), nil
 }
 
+// userData returns the user data of new servers, read from the user data file
+// if set and decoded if base64 encoded.
+func (tc *hcloudTargetConfig) userData() (string, error) {
+	userData := tc.UserData
+	if tc.UserDataFile != "" {
+		data, err := readUserDataFromFile(tc.UserDataFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read user data from file: %v", err)
+		}
+		userData = data
+	}
+
+	if tc.B64UserDataEncoded {
+		userDataBytes, err := base64.StdEncoding.DecodeString(userData)
+		if err != nil {
+			return "", fmt.Errorf("failed to perform b64 decode of user data: %v", err)
+		}
+		userData = string(userDataBytes)
+	}
+	return userData, nil
+}
+
+// renderUserData renders the user data template with details of the server
+// which is about to be created.
+func (tc *hcloudTargetConfig) renderUserData(userData string, opts *hcloud.ServerCreateOpts) (string, error) {
+	var volumeID int64
+	if volume := tc.serverVolume(opts); volume != nil {
+		volumeID = volume.ID
+	}
+	var privateIP string
+	if fixedNetworks, err := tc.fixedIPNetworks(); err == nil && len(fixedNetworks) > 0 {
+		privateIP = opts.Labels[privateIPLabel(fixedNetworks[0].network)]
+	}
+	return renderTemplate("user data", userData, map[string]interface{}{
+		"Name":       opts.Name,
+		"GroupID":    tc.GroupID,
+		"VolumeID":   volumeID,
+		"PrivateIP":  privateIP,
+		"PrivateIPs": tc.privateIPs(opts.Labels),
+	})
+}
+
+// serverClaims records the resources handed out to servers created during a
+// single scale out, so that none of them is handed out twice.
+type serverClaims struct {
+	volumes         map[int64]struct{}
+	primaryIPs      map[int64]struct{}
+	networkIPs      map[string]struct{}
+	placementGroups map[int64]map[int64]struct{}
+	names           map[string]struct{}
+}
+
+func newServerClaims() *serverClaims {
+	return &serverClaims{
+		volumes:         make(map[int64]struct{}),
+		primaryIPs:      make(map[int64]struct{}),
+		networkIPs:      make(map[string]struct{}),
+		placementGroups: make(map[int64]map[int64]struct{}),
+		names:           make(map[string]struct{}),
+	}
+}
+
+// createServer prepares the resources of a single server and creates it. The
+// terminal return indicates the error will not go away by retrying.
+func (t *TargetPlugin) createServer(ctx context.Context, targetConfig *hcloudTargetConfig, opts hcloud.ServerCreateOpts, claims *serverClaims) (result hcloud.ServerCreateResult, terminal bool, err error) {
+	defer func() {
+		if err != nil {
+			t.releaseServerVolume(ctx, targetConfig, &opts, claims.volumes)
+			t.releasePrimaryIPs(&opts, claims.primaryIPs)
+			t.releaseNetworkIPs(&opts, claims.networkIPs)
+		}
+	}()
+
+	if err := t.preparePrimaryIPs(ctx, targetConfig, &opts, claims.primaryIPs); err != nil {
+		return result, err == errPrimaryIPPoolExhausted, fmt.Errorf("failed to prepare Primary IPs: %v", err)
+	}
+	if err := t.preparePlacementGroup(ctx, targetConfig, &opts, claims.placementGroups); err != nil {
+		return result, false, fmt.Errorf("failed to prepare placement group: %v", err)
+	}
+	if err := t.prepareNetworkIPs(ctx, targetConfig, &opts, claims.networkIPs); err != nil {
+		return result, false, fmt.Errorf("failed to prepare network IPs: %v", err)
+	}
+	if err := t.prepareServerVolume(ctx, targetConfig, &opts, claims.volumes); err != nil {
+		return result, false, fmt.Errorf("failed to prepare volume: %v", err)
+	}
+	if targetConfig.UserDataTemplate {
+		rendered, err := targetConfig.renderUserData(opts.UserData, &opts)
+		if err != nil {
+			return result, true, err
+		}
+		opts.UserData = rendered
+	}
+
+	result, _, err = t.client(ctx).Server.Create(ctx, opts)
+	if err != nil {
+		return result, hcloud.IsError(err, hcloud.ErrorCodeResourceLimitExceeded), err
+	}
+	claimPlacementGroup(&opts, result.Server, claims.placementGroups)
+	return result, false, nil
+}
+
 // scaleOut adds HCloud servers up to desired count to match what the
-// Autoscaler has deemed required.
-func (t *TargetPlugin) scaleOut(ctx context.Context, servers []*hcloud.Server, count int64, config map[string]string, targetConfig *hcloudTargetConfig) error {
+// Autoscaler has deemed required. Servers from the warm pool are used first.
+// In canary mode a single server is created first and the remaining servers
+// are only created once it has joined the Nomad cluster. If a cap does not
+// allow all servers to be created, those fitting are created and a cap error
+// is returned. If a project quota does not allow all servers, those fitting
+// are created and the remaining servers spill over into other projects, or a
+// quota error is returned.
+func (t *TargetPlugin) scaleOut(ctx context.Context, servers []*hcloud.Server, count int64, config map[string]string, targetConfig *hcloudTargetConfig) (err error) {
+	var activated []*hcloud.Server
+	if targetConfig.WarmPoolSize > 0 {
+		defer t.replenishWarmPool(targetConfig)
+		activated = t.activateWarmServers(ctx, targetConfig, count-int64(len(servers)))
+		servers = append(servers, activated...)
+		if int64(len(servers)) >= count {
+			return t.waitForNomadJoin(ctx, targetConfig, activated)
+		}
+	}
+
+	// Caps, the maximum creates per hour and project quotas only limit the
+	// servers to create, activating warm pool servers creates none.
+	count, capped, err := t.capCreates(ctx, servers, count, targetConfig)
+	if err != nil {
+		return fmt.Errorf("failed to check caps: %v", err)
+	}
+	if capped != nil {
+		defer func() {
+			if err == nil {
+				err = capped
+			}
+		}()
+		if count <= int64(len(servers)) {
+			return t.waitForNomadJoin(ctx, targetConfig, activated)
+		}
+	}
+	count, limited := t.limitCreates(servers, count, targetConfig)
+	if limited != nil {
+		defer func() {
+			if err == nil {
+				err = limited
+			}
+		}()
+		if count <= int64(len(servers)) {
+			return t.waitForNomadJoin(ctx, targetConfig, activated)
+		}
+	}
+
+	if targetConfig.spilloverEnabled() {
+		requested := count
+		defer func() {
+			var exceeded *quotaError
+			if errors.As(err, &exceeded) {
+				err = t.spillOver(ctx, t.logger.With("action", "spillover", "hcloud_group_id", targetConfig.GroupID),
+					requested, config, targetConfig)
+			}
+		}()
+	}
+	count, exceeded, err := t.checkQuota(ctx, servers, count, targetConfig)
+	if err != nil {
+		return fmt.Errorf("failed to check project quotas: %v", err)
+	}
+	if exceeded != nil {
+		defer func() {
+			if err == nil {
+				err = exceeded
+			}
+		}()
+		if count <= int64(len(servers)) {
+			return t.waitForNomadJoin(ctx, targetConfig, activated)
+		}
+	}
+
+	if !targetConfig.Canary {
+		created, err := t.createServers(ctx, servers, count, targetConfig)
+		if err != nil && !scaleOutHeldBack(err) {
+			return err
+		}
+		if joinErr := t.waitForNomadJoin(ctx, targetConfig, append(activated, created...)); joinErr != nil {
+			return joinErr
+		}
+		return err
+	}
+
+	if err := t.checkCanaryHealth(targetConfig.GroupID, config); err != nil {
+		return err
+	}
+
+	canaries, err := t.createServers(ctx, servers, int64(len(servers))+1, targetConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create canary server: %w", err)
+	}
+	for _, canary := range canaries {
+		if err := t.validateCanary(ctx, targetConfig, canary, config); err != nil {
+			return err
+		}
+	}
+
+	if int64(len(servers))+1 >= count {
+		return t.waitForNomadJoin(ctx, targetConfig, activated)
+	}
+	servers, err = t.getServers(ctx, targetConfig)
+	if err != nil {
+		return fmt.Errorf("failed to get HCloud servers after canary: %v", err)
+	}
+	created, err := t.createServers(ctx, servers, count, targetConfig)
+	if err != nil && !scaleOutHeldBack(err) {
+		return err
+	}
+	if joinErr := t.waitForNomadJoin(ctx, targetConfig, append(activated, created...)); joinErr != nil {
+		return joinErr
+	}
+	return err
+}
+
+// createServers creates HCloud servers up to the desired count and returns
+// the created servers. The count is lowered to what the caps and the maximum
+// creates per hour allow, the limiting error is returned in that case once
+// the allowed servers are created.
+func (t *TargetPlugin) createServers(ctx context.Context, servers []*hcloud.Server, count int64, targetConfig *hcloudTargetConfig) ([]*hcloud.Server, error) {
+	var heldBack error
+	count, capped, err := t.capCreates(ctx, servers, count, targetConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check caps: %v", err)
+	}
+	if capped != nil {
+		heldBack = capped
+	}
+	count, limited := t.limitCreates(servers, count, targetConfig)
+	if limited != nil {
+		heldBack = limited
+	}
+	if count <= int64(len(servers)) {
+		return nil, heldBack
+	}
+
 	// Create a logger for this action to pre-populate useful information we
 	// would like on all log lines.
 	log := t.logger.With("action", "scale_out", "hcloud_group_id", targetConfig.GroupID,
 		"desired_count", count)
 
-	// try to read from userDataFile, if it is set
-	if targetConfig.UserDataFile != "" {
-		userData, err := readUserDataFromFile(targetConfig.UserDataFile)
-		if err != nil {
-			return fmt.Errorf("failed to read user data from file: %v", err)
-		}
-		targetConfig.UserData = userData
+	// A volume attaches to a single server, the create of a second server
+	// with the shared volumes would fail.
+	if len(targetConfig.Volumes) > 0 && count > 1 {
+		return nil, fmt.Errorf("hcloud_volumes can only be attached to a single server, but %d servers are desired", count)
 	}
 
-	userData := targetConfig.UserData
+	userData, err := targetConfig.userData()
+	if err != nil {
+		return nil, err
+	}
 
-	if targetConfig.B64UserDataEncoded {
-		userDataBytes, err := base64.StdEncoding.DecodeString(userData)
-		userData = string(userDataBytes)
+	var price float64
+	if targetConfig.AutoServerType {
+		typeConfig := *targetConfig
+		typeConfig.ServerType, price, err = t.cheapestServerType(ctx, targetConfig)
 		if err != nil {
-			return fmt.Errorf("failed to perform b64 decode of user data: %v", err)
-		}
-	}
-
-	opts := hcloud.ServerCreateOpts{
-		UserData:       userData,
-		Image:          targetConfig.Image,
-		Datacenter:     targetConfig.Datacenter,
-		Location:       targetConfig.Location,
-		ServerType:     targetConfig.ServerType,
-		PlacementGroup: targetConfig.PlacementGroup,
-		Firewalls:      targetConfig.Firewalls,
-		SSHKeys:        targetConfig.SSHKeys,
-		Labels:         targetConfig.Labels,
-		Networks:       targetConfig.Networks,
-		PublicNet: &hcloud.ServerCreatePublicNet{
-			EnableIPv4: targetConfig.PublicNetEnableIPv4,
-			EnableIPv6: targetConfig.PublicNetEnableIPv6,
-		},
+			return nil, fmt.Errorf("failed to select server type: %v", err)
+		}
+		targetConfig = &typeConfig
+		log.Info("selected cheapest server type", "server_type", targetConfig.ServerType.Name, "hourly_price", formatPrice(price))
 	}
 
-	opts.Labels[t.config.GroupIDLabelSelector] = targetConfig.GroupID
+	opts := targetConfig.serverCreateOpts(t.config.GroupIDLabelSelector)
+	opts.UserData = userData
+	opts.Labels[configHashLabel] = targetConfig.createConfigHash(userData)
+	if project := projectFrom(ctx); project != targetConfig.Project {
+		opts.Labels[projectLabel] = project
+	}
+	if targetConfig.AutoServerType {
+		opts.Labels[serverTypeLabel] = targetConfig.ServerType.Name
+		opts.Labels[hourlyPriceLabel] = formatPrice(price)
+	}
+
+	created := make(map[int64]struct{})
+	claims := newServerClaims()
+
+	// Servers which are stopped or in the warm pool are not passed in, but
+	// their names are taken nonetheless.
+	taken, err := t.takenNames(ctx, targetConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server names of the group: %v", err)
+	}
+	for name := range taken {
+		claims.names[name] = struct{}{}
+	}
 
 	f := func(ctx context.Context) (bool, error) {
 		var results []hcloud.ServerCreateResult
 		countDiff := count - int64(len(servers))
 		var counter int64
 		for counter < countDiff {
-			opts.Name = targetConfig.randomName(t.config.RandomSuffixLen)
-			result, _, err := t.hcloud.Server.Create(ctx, opts)
+			result, terminal, err := t.createNamedServer(ctx, targetConfig, opts, servers, claims)
+			if terminal {
+				if hcloud.IsError(err, hcloud.ErrorCodeResourceLimitExceeded) {
+					return true, apiQuotaError(err, countDiff, counter)
+				}
+				return true, fmt.Errorf("failed to create %d servers: %v", countDiff-counter, err)
+			}
 			if err != nil {
-				log.Error("failed to create an HCloud server", err)
+				log.Error("failed to create an HCloud server", "error", err)
 				break
 			}
 			results = append(results, result)
+			created[result.Server.ID] = struct{}{}
 			counter++
 		}
 		var actionIDs []int64
@@ -110,6 +362,14 @@ func (t *TargetPlugin) scaleOut(ctx context.Context, servers []*hcloud.Server, c
 		if err != nil {
 			log.Error("failed to wait till all HCloud create actions are ready", err)
 		}
+		for _, result := range results {
+			if err := t.setupServer(ctx, targetConfig, result.Server); err != nil {
+				log.Error("failed to set up server, deleting server", "server", result.Server.Name, "error", err)
+				if _, _, err := t.client(ctx).Server.DeleteWithResult(ctx, result.Server); err != nil {
+					log.Error("failed to delete a HCloud server", "server", result.Server.Name, "error", err)
+				}
+			}
+		}
 		servers, err = t.getServers(ctx, targetConfig)
 		if err != nil {
 			return false, fmt.Errorf("failed to get a new servers count during instance scale out: %v", err)
@@ -121,7 +381,25 @@ func (t *TargetPlugin) scaleOut(ctx context.Context, servers []*hcloud.Server, c
 		return false, fmt.Errorf("waiting for %v servers to create", count-serverCount)
 	}
 
-	return retry(ctx, t.config.RetryInterval, t.config.RetryLimit, f)
+	err = retry(ctx, t.config.RetryInterval, t.config.RetryLimit, f)
+
+	// Server IPs are only known once the create actions have finished,
+	// therefore DNS records are created for the servers as listed afterwards.
+	var newServers []*hcloud.Server
+	for _, server := range servers {
+		if _, ok := created[server.ID]; ok {
+			newServers = append(newServers, server)
+		}
+	}
+	t.recordCreates(targetConfig.GroupID, len(newServers))
+	if dnsErr := t.createDNSRecords(ctx, targetConfig, newServers); dnsErr != nil {
+		log.Error("failed to create DNS records", "error", dnsErr)
+	}
+
+	if err == nil && heldBack != nil {
+		return newServers, heldBack
+	}
+	return newServers, err
 }
 
 func (t *TargetPlugin) scaleIn(ctx context.Context, servers []*hcloud.Server, count int64, config map[string]string, targetConfig *hcloudTargetConfig) (err error) {
@@ -134,50 +412,350 @@ func (t *TargetPlugin) scaleIn(ctx context.Context, servers []*hcloud.Server, co
 			remoteIDs = append(remoteIDs, server.Name)
 		}
 	}
-	nodes, err := t.clusterUtils.RunPreScaleInTasksWithRemoteCheck(ctx, config, remoteIDs, int(count))
+	nodes, unhealthy, err := t.preScaleInTasks(ctx, log, config, targetConfig, remoteIDs, count)
 	if err != nil {
 		return fmt.Errorf("failed to perform pre-scale Nomad scale in tasks: %v", err)
 	}
 
+	// Drained servers are returned to the warm pool as long as it has room,
+	// instead of being deleted.
+	var poolRoom int
+	if targetConfig.WarmPoolScaleIn {
+		pool, err := t.getWarmServers(ctx, targetConfig)
+		if err != nil {
+			log.Error("failed to get warm pool servers", "error", err)
+		} else {
+			poolRoom = targetConfig.WarmPoolSize - len(pool)
+		}
+	}
+
+	var (
+		selected []*hcloud.Server
+		pooled   []*hcloud.Server
+		failures []string
+	)
 	for _, node := range nodes {
-		var serverInput hcloud.Server
+		var serverInput *hcloud.Server
 		for _, server := range servers {
 			if server.Name == node.RemoteResourceID {
-				serverInput.ID = server.ID
+				copied := *server
+				serverInput = &copied
 				break
 			}
 		}
-		_, _, err := t.hcloud.Server.DeleteWithResult(ctx, &serverInput)
-		if err != nil {
-			log.Error("failed to delete a HCloud server",
-				"server_id", node.RemoteResourceID, "node_id", node.NomadNodeID,
-				"error", err)
+		if serverInput == nil {
+			failures = append(failures, fmt.Sprintf("%s: server not found", node.RemoteResourceID))
+			continue
 		}
+		if len(pooled) < poolRoom {
+			pooled = append(pooled, serverInput)
+			continue
+		}
+		selected = append(selected, serverInput)
 	}
 
-	if err := t.clusterUtils.RunPostScaleInTasks(ctx, config, nodes); err != nil {
-		return fmt.Errorf("failed to perform post-scale Nomad scale in tasks: %v", err)
+	returned, poolFailures := t.returnToWarmPool(ctx, log, targetConfig, pooled)
+	for name, err := range poolFailures {
+		failures = append(failures, fmt.Sprintf("%s: %v", name, err))
 	}
 
-	return
+	// Servers of a group spilling over are removed with the client and the
+	// resources of the project they are in.
+	var deleted []*hcloud.Server
+	byProject := projectServers(selected, targetConfig.Project)
+	projects := make([]string, 0, len(byProject))
+	for project := range byProject {
+		projects = append(projects, project)
+	}
+	sort.Strings(projects)
+	for _, project := range projects {
+		projectCtx, projectConfig := ctx, targetConfig
+		if project != targetConfig.Project {
+			projectCtx, projectConfig, err = t.projectConfig(ctx, project, config)
+			if err != nil {
+				for _, server := range byProject[project] {
+					failures = append(failures, fmt.Sprintf("%s: %v", server.Name, err))
+				}
+				continue
+			}
+		}
+		removed, removeFailures := t.removeServers(projectCtx, log, config, projectConfig, byProject[project], nodes, unhealthy)
+		deleted = append(deleted, removed...)
+		failures = append(failures, removeFailures...)
+	}
+
+	if err := t.deleteDNSRecords(ctx, targetConfig, append(deleted, returned...)); err != nil {
+		log.Error("failed to delete DNS records", "error", err)
+	}
+
+	// Only the nodes of deleted servers are purged and the nodes of servers
+	// in the warm pool stay ineligible, the remaining nodes are made eligible
+	// again.
+	deletedNames := make(map[string]struct{}, len(deleted))
+	for _, server := range deleted {
+		deletedNames[server.Name] = struct{}{}
+	}
+	returnedNames := make(map[string]struct{}, len(returned))
+	for _, server := range returned {
+		returnedNames[server.Name] = struct{}{}
+	}
+	var deletedNodes, remainingNodes []scaleutils.NodeResourceID
+	for _, node := range nodes {
+		if _, ok := deletedNames[node.RemoteResourceID]; ok {
+			deletedNodes = append(deletedNodes, node)
+		} else if _, ok := returnedNames[node.RemoteResourceID]; !ok {
+			remainingNodes = append(remainingNodes, node)
+		}
+	}
+	if len(remainingNodes) > 0 {
+		if err := t.clusterUtils.RunPostScaleInTasksOnFailure(remainingNodes); err != nil {
+			log.Error("failed to perform post-scale Nomad scale in tasks on failed nodes", "error", err)
+		}
+	}
+	if len(deletedNodes) > 0 {
+		if err := t.clusterUtils.RunPostScaleInTasks(ctx, config, deletedNodes); err != nil {
+			return fmt.Errorf("failed to perform post-scale Nomad scale in tasks: %v", err)
+		}
+	}
+
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		return fmt.Errorf("failed to remove %d of %d servers: %s", len(failures), len(nodes), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// removeServers shuts the passed drained servers down, releases their Primary
+// IPs and volumes, snapshots and deletes them. Volumes are only detached once
+// the server is off, so that its filesystems are cleanly unmounted. The
+// deleted servers are returned together with the failures of the servers left
+// in place.
+func (t *TargetPlugin) removeServers(ctx context.Context, log hclog.Logger, config map[string]string, targetConfig *hcloudTargetConfig, servers []*hcloud.Server, nodes []scaleutils.NodeResourceID, unhealthy map[string]bool) ([]*hcloud.Server, []string) {
+	t.shutdownServers(ctx, log, targetConfig, servers)
+
+	// Servers whose resources could not be released are kept for
+	// investigation, like those whose snapshot failed.
+	var (
+		prepared []*hcloud.Server
+		failures []string
+	)
+	for _, server := range servers {
+		if err := t.retainPrimaryIPs(ctx, targetConfig, server); err != nil {
+			log.Error("failed to retain Primary IPs of a HCloud server", "server_id", server.Name, "error", err)
+			failures = append(failures, fmt.Sprintf("%s: %v", server.Name, err))
+			continue
+		}
+		if err := t.detachServerVolumes(ctx, targetConfig, []*hcloud.Server{server}); err != nil {
+			log.Error("failed to detach volumes from a HCloud server", "server_id", server.Name, "error", err)
+			failures = append(failures, fmt.Sprintf("%s: %v", server.Name, err))
+			continue
+		}
+		prepared = append(prepared, server)
+	}
+
+	// Servers whose snapshot failed are kept for investigation.
+	snapshotFailures := t.snapshotServers(ctx, log, targetConfig, prepared, nodes, unhealthy)
+	var snapshotted []*hcloud.Server
+	for _, server := range prepared {
+		if err, ok := snapshotFailures[server.Name]; ok {
+			failures = append(failures, fmt.Sprintf("%s: %v", server.Name, err))
+			continue
+		}
+		snapshotted = append(snapshotted, server)
+	}
+
+	deleted, deleteFailures := t.deleteServers(ctx, log, snapshotted)
+	t.recordDeletes(targetConfig, config, deleted)
+	for name, err := range deleteFailures {
+		failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+	}
+
+	// Volumes and placement groups are only released once the server is
+	// gone, which deleteServers waits for.
+	if len(deleted) > 0 {
+		t.cleanupDeletedServers(ctx, log, targetConfig, deleted)
+	}
+	return deleted, failures
+}
+
+// deleteServers deletes the passed servers and waits for the delete actions
+// to finish. Servers which fail to be deleted are retried according to the
+// retry policy. The deleted servers are returned together with the last error
+// of every server which could not be deleted.
+func (t *TargetPlugin) deleteServers(ctx context.Context, log hclog.Logger, servers []*hcloud.Server) ([]*hcloud.Server, map[string]error) {
+	var deleted []*hcloud.Server
+	failures := make(map[string]error)
+	remaining := servers
+
+	f := func(ctx context.Context) (bool, error) {
+		var (
+			pending   []*hcloud.Server
+			actionIDs []int64
+		)
+		actions := make(map[int64]*hcloud.Server)
+		for _, server := range remaining {
+			result, _, err := t.client(ctx).Server.DeleteWithResult(ctx, server)
+			if hcloud.IsError(err, hcloud.ErrorCodeNotFound) {
+				deleted = append(deleted, server)
+				continue
+			}
+			if err != nil {
+				log.Warn("failed to delete a HCloud server", "server_id", server.Name, "error", err)
+				failures[server.Name] = err
+				pending = append(pending, server)
+				continue
+			}
+			if result.Action == nil {
+				deleted = append(deleted, server)
+				continue
+			}
+			actions[result.Action.ID] = server
+			actionIDs = append(actionIDs, result.Action.ID)
+		}
+
+		if len(actionIDs) > 0 {
+			successful, failed, err := t.ensureActionsComplete(ctx, actionIDs)
+			if err != nil {
+				log.Warn("failed to wait till all HCloud delete actions are ready", "error", err)
+				for _, id := range actionIDs {
+					failures[actions[id].Name] = err
+					pending = append(pending, actions[id])
+				}
+			} else {
+				for _, id := range successful {
+					deleted = append(deleted, actions[id])
+				}
+				for _, id := range failed {
+					failures[actions[id].Name] = fmt.Errorf("delete action %d failed", id)
+					pending = append(pending, actions[id])
+				}
+			}
+		}
+
+		remaining = pending
+		if len(remaining) == 0 {
+			return true, nil
+		}
+		return false, fmt.Errorf("%d servers left to delete", len(remaining))
+	}
+	if err := retry(ctx, t.config.RetryInterval, t.config.RetryLimit, f); err != nil {
+		log.Error("failed to delete all HCloud servers", "error", err)
+	}
+
+	out := make(map[string]error, len(remaining))
+	for _, server := range remaining {
+		out[server.Name] = failures[server.Name]
+	}
+	return deleted, out
+}
+
+// cleanupDeletedServers releases the resources which were held by the passed
+// servers once they have been deleted.
+func (t *TargetPlugin) cleanupDeletedServers(ctx context.Context, log hclog.Logger, targetConfig *hcloudTargetConfig, deleted []*hcloud.Server) {
+	if targetConfig.volumesEnabled() {
+		switch targetConfig.VolumeRetention {
+		case volumeRetentionDelete:
+			if err := t.collectVolumes(ctx, targetConfig); err != nil {
+				log.Error("failed to delete HCloud volumes", "error", err)
+			}
+		case volumeRetentionRetain, volumeRetentionPool:
+			log.Info("retaining volumes of deleted servers", "count", len(deleted), "retention", targetConfig.VolumeRetention)
+		}
+	}
+	if err := t.deleteEmptyPlacementGroups(ctx, targetConfig); err != nil {
+		log.Error("failed to delete empty placement groups", "error", err)
+	}
+}
+
+// setupServer runs the steps following the creation of a server: fixed IP
+// networks are attached and backups are enabled. Servers created stopped are
+// started afterwards.
+func (t *TargetPlugin) setupServer(ctx context.Context, targetConfig *hcloudTargetConfig, server *hcloud.Server) error {
+	if err := t.attachNetworks(ctx, targetConfig, server); err != nil {
+		return err
+	}
+
+	if targetConfig.Backups {
+		action, _, err := t.client(ctx).Server.EnableBackup(ctx, server, "")
+		if err != nil {
+			return fmt.Errorf("failed to enable backups of server %s: %v", server.Name, err)
+		}
+		if err := t.waitForActions(ctx, []int64{action.ID}); err != nil {
+			return fmt.Errorf("failed to wait for backups of server %s to be enabled: %v", server.Name, err)
+		}
+	}
+
+	if !targetConfig.createdStopped() {
+		return nil
+	}
+	action, _, err := t.client(ctx).Server.Poweron(ctx, server)
+	if err != nil {
+		return fmt.Errorf("failed to power on server %s: %v", server.Name, err)
+	}
+	if err := t.waitForActions(ctx, []int64{action.ID}); err != nil {
+		return fmt.Errorf("failed to wait for server %s to power on: %v", server.Name, err)
+	}
+	return nil
 }
 
 func (t *TargetPlugin) getServers(ctx context.Context, targetConfig *hcloudTargetConfig) ([]*hcloud.Server, error) {
+	selector := targetConfig.getSelector(t.config.GroupIDLabelSelector)
+	if targetConfig.WarmPoolSize > 0 && !targetConfig.warmPool {
+		selector += fmt.Sprintf(",%s!=%s", warmPoolLabel, warmPoolValue)
+	}
 	opts := hcloud.ServerListOpts{
 		ListOpts: hcloud.ListOpts{
-			LabelSelector: targetConfig.getSelector(t.config.GroupIDLabelSelector),
+			LabelSelector: selector,
 			PerPage:       t.config.ItemsPerPage,
 		},
 		Status: []hcloud.ServerStatus{hcloud.ServerStatusRunning},
 	}
-	servers, err := t.hcloud.Server.AllWithOpts(ctx, opts)
-	if err != nil {
-		t.logger.Error("error retrieving server", err)
-		return nil, err
+	return t.listServers(ctx, targetConfig, opts)
+}
+
+// listServers lists the servers matching the passed options in every project
+// of the group.
+func (t *TargetPlugin) listServers(ctx context.Context, targetConfig *hcloudTargetConfig, opts hcloud.ServerListOpts) ([]*hcloud.Server, error) {
+	if !targetConfig.spilloverEnabled() {
+		servers, err := t.client(ctx).Server.AllWithOpts(ctx, opts)
+		if err != nil {
+			t.logger.Error("error retrieving server", err)
+			return nil, err
+		}
+		return servers, nil
+	}
+
+	// A group spilling over spans several projects, whose servers are listed
+	// with the client of each project.
+	var servers []*hcloud.Server
+	for _, project := range targetConfig.projectNames() {
+		projectCtx := withProject(ctx, project)
+		projectServers, err := t.client(projectCtx).Server.AllWithOpts(projectCtx, opts)
+		if err != nil {
+			t.logger.Error("error retrieving server", "project", project, "error", err)
+			return nil, err
+		}
+		servers = append(servers, projectServers...)
 	}
 	return servers, nil
 }
 
+// waitForActions waits for the passed actions to complete and returns an
+// error if any of them failed.
+func (t *TargetPlugin) waitForActions(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, failed, err := t.ensureActionsComplete(ctx, ids)
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d actions failed", len(failed), len(ids))
+	}
+	return nil
+}
+
 func (t *TargetPlugin) ensureActionsComplete(ctx context.Context, ids []int64) (successfulActions []int64, failedActions []int64, err error) {
 
 	opts := hcloud.ActionListOpts{
@@ -185,7 +763,7 @@ func (t *TargetPlugin) ensureActionsComplete(ctx context.Context, ids []int64) (
 	}
 
 	f := func(ctx context.Context) (bool, error) {
-		currentActions, _, err := t.hcloud.Action.List(ctx, opts)
+		currentActions, _, err := t.client(ctx).Action.List(ctx, opts)
 		if err != nil {
 			return false, err
 		}
@@ -211,6 +789,9 @@ func (t *TargetPlugin) ensureActionsComplete(ctx context.Context, ids []int64) (
 		if len(ids) == 0 {
 			return true, nil
 		}
+		// Only the unfinished actions are polled again, so that finished
+		// actions are not reported twice.
+		opts.ID = ids
 		return false, fmt.Errorf("waiting for %v actions to finish", len(ids))
 	}
 
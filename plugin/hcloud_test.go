@@ -0,0 +1,192 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_hcloudTargetConfig_renderUserData(t *testing.T) {
+	testCases := []struct {
+		inputUserData  string
+		inputOpts      hcloud.ServerCreateOpts
+		expectedOutput string
+		expectedError  bool
+		name           string
+	}{
+		{
+			inputUserData: "#!/bin/bash\nmount /dev/disk/by-id/scsi-0HC_Volume_{{ .VolumeID }} /data # {{ .Name }}",
+			inputOpts: hcloud.ServerCreateOpts{
+				Name:    "test-1",
+				Volumes: []*hcloud.Volume{{ID: 7}, {ID: 42}},
+			},
+			expectedOutput: "#!/bin/bash\nmount /dev/disk/by-id/scsi-0HC_Volume_42 /data # test-1",
+			name:           "volume ID rendered",
+		},
+		{
+			inputUserData: "volume: {{ .VolumeID }}",
+			inputOpts: hcloud.ServerCreateOpts{
+				Name:    "test-1",
+				Volumes: []*hcloud.Volume{{ID: 7}},
+			},
+			expectedOutput: "volume: 0",
+			name:           "shared volume is not the server volume",
+		},
+		{
+			inputUserData: "address: {{ .PrivateIP }} {{ index .PrivateIPs \"mynet\" }}",
+			inputOpts: hcloud.ServerCreateOpts{
+				Name:   "test-1",
+				Labels: map[string]string{"private-ip-7": "10.0.1.2"},
+			},
+			expectedOutput: "address: 10.0.1.2 10.0.1.2",
+			name:           "private IP rendered",
+		},
+		{
+			inputUserData: "{{ .Unknown }}",
+			inputOpts:     hcloud.ServerCreateOpts{Name: "test-1"},
+			expectedError: true,
+			name:          "unknown variable",
+		},
+	}
+
+	targetConfig := hcloudTargetConfig{
+		GroupID:         "test",
+		Volumes:         []*hcloud.Volume{{ID: 7}},
+		VolumeSize:      10,
+		Networks:        []*hcloud.Network{testNetwork()},
+		NetworkIPRanges: map[string]string{"mynet": "10.0.1.0/28"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			actualOutput, err := targetConfig.renderUserData(tc.inputUserData, &tc.inputOpts)
+			assert.Equal(t, tc.expectedError, err != nil, tc.name)
+			assert.Equal(t, tc.expectedOutput, actualOutput, tc.name)
+		})
+	}
+}
+
+func TestTargetPlugin_deleteServers(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		attempts = make(map[string]int)
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("DELETE /servers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		lock.Lock()
+		attempts[id]++
+		attempt := attempts[id]
+		lock.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case id == "2" && attempt == 1:
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			writeJSON(w, schema.ErrorResponse{Error: schema.Error{Code: "invalid_input", Message: "try again"}})
+		case id == "4":
+			w.WriteHeader(http.StatusNotFound)
+			writeJSON(w, schema.ErrorResponse{Error: schema.Error{Code: "not_found", Message: "server not found"}})
+		default:
+			actionID, _ := strconv.ParseInt(id, 10, 64)
+			writeJSON(w, schema.ServerDeleteResponse{Action: schema.Action{ID: actionID, Status: "running"}})
+		}
+	})
+	mux.HandleFunc("GET /actions", func(w http.ResponseWriter, r *http.Request) {
+		var actions []schema.Action
+		for _, id := range r.URL.Query()["id"] {
+			actionID, _ := strconv.ParseInt(id, 10, 64)
+			status := "success"
+			if id == "3" {
+				status = "error"
+			}
+			actions = append(actions, schema.Action{ID: actionID, Status: status, Progress: 100})
+		}
+		writeJSON(w, schema.ActionListResponse{Actions: actions})
+	})
+
+	tp := TargetPlugin{
+		logger: hclog.NewNullLogger(),
+		config: hcloudPluginConfig{RetryLimit: 3},
+		hcloud: newTestHCloudClient(t, mux),
+	}
+	servers := []*hcloud.Server{
+		{ID: 1, Name: "nomad-1"},
+		{ID: 2, Name: "nomad-2"},
+		{ID: 3, Name: "nomad-3"},
+		{ID: 4, Name: "nomad-4"},
+	}
+
+	deleted, failures := tp.deleteServers(context.Background(), tp.logger, servers)
+
+	var deletedNames []string
+	for _, server := range deleted {
+		deletedNames = append(deletedNames, server.Name)
+	}
+	assert.ElementsMatch(t, []string{"nomad-1", "nomad-2", "nomad-4"}, deletedNames)
+	assert.Len(t, failures, 1)
+	assert.EqualError(t, failures["nomad-3"], "delete action 3 failed")
+	assert.Equal(t, 2, attempts["2"], "failed delete is retried")
+	assert.Equal(t, 3, attempts["3"], "failed delete action is retried up to the retry limit")
+}
+
+func TestTargetPlugin_deleteServers_pendingAction(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		deletes = make(map[string]int)
+		polls   = make(map[string]int)
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("DELETE /servers/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		lock.Lock()
+		deletes[id]++
+		lock.Unlock()
+		actionID, _ := strconv.ParseInt(id, 10, 64)
+		writeJSON(w, schema.ServerDeleteResponse{Action: schema.Action{ID: actionID, Status: "running"}})
+	})
+	mux.HandleFunc("GET /actions", func(w http.ResponseWriter, r *http.Request) {
+		var actions []schema.Action
+		for _, id := range r.URL.Query()["id"] {
+			lock.Lock()
+			polls[id]++
+			poll := polls[id]
+			lock.Unlock()
+			actionID, _ := strconv.ParseInt(id, 10, 64)
+			action := schema.Action{ID: actionID, Status: "success", Progress: 100}
+			if id == "2" && poll == 1 {
+				// The action of the second server needs two polls to finish.
+				action = schema.Action{ID: actionID, Status: "running", Progress: 50}
+			}
+			actions = append(actions, action)
+		}
+		writeJSON(w, schema.ActionListResponse{Actions: actions})
+	})
+
+	tp := TargetPlugin{
+		logger: hclog.NewNullLogger(),
+		config: hcloudPluginConfig{RetryLimit: 3},
+		hcloud: newTestHCloudClient(t, mux),
+	}
+	servers := []*hcloud.Server{{ID: 1, Name: "nomad-1"}, {ID: 2, Name: "nomad-2"}}
+
+	deleted, failures := tp.deleteServers(context.Background(), tp.logger, servers)
+
+	var deletedNames []string
+	for _, server := range deleted {
+		deletedNames = append(deletedNames, server.Name)
+	}
+	assert.Equal(t, []string{"nomad-1", "nomad-2"}, deletedNames)
+	assert.Empty(t, failures)
+	assert.Equal(t, map[string]int{"1": 1, "2": 1}, deletes, "servers are deleted once")
+	assert.Equal(t, map[string]int{"1": 1, "2": 2}, polls, "finished actions are not polled again")
+}
@@ -0,0 +1,179 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// nomadPollInterval is the interval the Nomad API is polled in for the node of
+// a new server to become ready.
+const nomadPollInterval = 10 * time.Second
+
+// waitForNomadJoin waits for the Nomad nodes of the passed servers to become
+// ready and eligible. The time each server took to join is logged and
+// recorded in the metrics.
+func (t *TargetPlugin) waitForNomadJoin(ctx context.Context, targetConfig *hcloudTargetConfig, servers []*hcloud.Server) error {
+	if !targetConfig.WaitForNomadJoin {
+		return nil
+	}
+	return t.awaitNomadJoin(ctx, targetConfig, servers)
+}
+
+// awaitNomadJoin waits for the Nomad nodes of the passed servers to become
+// ready and eligible regardless of whether waiting is enabled for scale outs.
+func (t *TargetPlugin) awaitNomadJoin(ctx context.Context, targetConfig *hcloudTargetConfig, servers []*hcloud.Server) error {
+	if len(servers) == 0 {
+		return nil
+	}
+
+	log := t.logger.With("action", "nomad_join", "hcloud_group_id", targetConfig.GroupID)
+	log.Info("waiting for servers to join the Nomad cluster", "servers", len(servers), "timeout", targetConfig.NomadJoinTimeout)
+
+	var failed []string
+	_, failures := t.waitForNomadNodes(ctx, servers, targetConfig.NomadJoinTimeout, func(server *hcloud.Server) {
+		t.observeNomadJoin(log, targetConfig, server)
+	})
+	for name, err := range failures {
+		nomadJoinTimeouts.WithLabelValues(targetConfig.GroupID).Inc()
+		log.Warn("server did not join the Nomad cluster", "server", name, "error", err)
+		failed = append(failed, name)
+	}
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("%d of %d servers did not join the Nomad cluster within %s: %s",
+			len(failed), len(servers), targetConfig.NomadJoinTimeout, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// observeNomadJoin logs and records the time the server took from its creation
+// until its Nomad node became ready. Servers from the warm pool are measured
+// from their activation instead.
+func (t *TargetPlugin) observeNomadJoin(log hclog.Logger, targetConfig *hcloudTargetConfig, server *hcloud.Server) {
+	joinTime := time.Since(joinStart(server))
+	nomadJoinDuration.WithLabelValues(targetConfig.GroupID).Observe(joinTime.Seconds())
+	log.Info("server joined the Nomad cluster", "server", server.Name, "join_time", joinTime.Round(time.Second))
+}
+
+// joinStart returns the time the server started to join the Nomad cluster,
+// which is its activation for servers from the warm pool.
+func joinStart(server *hcloud.Server) time.Time {
+	if value, ok := server.Labels[activatedLabel]; ok {
+		if activated, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.Unix(activated, 0)
+		}
+	}
+	return server.Created
+}
+
+// waitForNomadNode waits until the Nomad node of the server is ready and
+// eligible for scheduling and returns the node.
+func (t *TargetPlugin) waitForNomadNode(ctx context.Context, server *hcloud.Server, timeout time.Duration) (*api.NodeListStub, error) {
+	nodes, failures := t.waitForNomadNodes(ctx, []*hcloud.Server{server}, timeout, nil)
+	if err, ok := failures[server.Name]; ok {
+		return nil, err
+	}
+	return nodes[server.Name], nil
+}
+
+// waitForNomadNodes waits until the Nomad nodes of the servers are ready and
+// eligible for scheduling. The node list is fetched once per poll for all
+// servers, joined is called for every server as soon as its node is ready.
+// The nodes are returned keyed by server name, together with the errors of
+// the servers which did not join within the timeout.
+func (t *TargetPlugin) waitForNomadNodes(ctx context.Context, servers []*hcloud.Server, timeout time.Duration, joined func(*hcloud.Server)) (map[string]*api.NodeListStub, map[string]error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// The server of a node never changes, so every node is only looked up
+	// once.
+	names := make(map[string]string)
+	ready := make(map[string]*api.NodeListStub, len(servers))
+	last := make(map[string]*api.NodeListStub, len(servers))
+	ticker := time.NewTicker(nomadPollInterval)
+	defer ticker.Stop()
+
+	for {
+		nodes, err := t.nomadNodes(ctx, names)
+		if err != nil {
+			t.logger.Warn("failed to look up Nomad nodes", "error", err)
+		}
+		for _, server := range servers {
+			node, ok := nodes[server.Name]
+			if _, done := ready[server.Name]; done || !ok {
+				continue
+			}
+			last[server.Name] = node
+			if node.Status == api.NodeStatusReady && node.SchedulingEligibility == api.NodeSchedulingEligible {
+				ready[server.Name] = node
+				if joined != nil {
+					joined(server)
+				}
+			}
+		}
+		if len(ready) == len(servers) {
+			return ready, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			failures := make(map[string]error)
+			for _, server := range servers {
+				if _, ok := ready[server.Name]; ok {
+					continue
+				}
+				if node, ok := last[server.Name]; ok {
+					failures[server.Name] = fmt.Errorf("node %s is %s and %s after %s", node.ID, node.Status, node.SchedulingEligibility, timeout)
+				} else {
+					failures[server.Name] = fmt.Errorf("node did not register within %s", timeout)
+				}
+			}
+			return ready, failures
+		case <-ticker.C:
+		}
+	}
+}
+
+// nomadNodes returns the registered Nomad nodes keyed by the name of their
+// server. Nodes are matched by their name when the node attribute ID is the
+// hostname, which the node name defaults to, otherwise every node not in
+// names yet is looked up. Names caches the server name of the nodes by
+// node ID.
+func (t *TargetPlugin) nomadNodes(ctx context.Context, names map[string]string) (map[string]*api.NodeListStub, error) {
+	stubs, _, err := t.nomad.Nodes().List((&api.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Nomad nodes: %v", err)
+	}
+	nodes := make(map[string]*api.NodeListStub, len(stubs))
+	for _, stub := range stubs {
+		name, ok := names[stub.ID]
+		if !ok {
+			if t.config.NodeAttrID == "unique.hostname" {
+				name = stub.Name
+			} else {
+				node, _, err := t.nomad.Nodes().Info(stub.ID, (&api.QueryOptions{}).WithContext(ctx))
+				if err != nil {
+					return nodes, fmt.Errorf("failed to get Nomad node %s: %v", stub.ID, err)
+				}
+				// Nodes without the attribute belong to no server.
+				name, _ = t.hcloudNodeIDMap(node)
+			}
+			names[stub.ID] = name
+		}
+		// A reused server name may still have the down node of a former
+		// server registered, ready nodes take precedence.
+		if prev, ok := nodes[name]; name != "" && (!ok || prev.Status != api.NodeStatusReady) {
+			nodes[name] = stub
+		}
+	}
+	return nodes, nil
+}
@@ -0,0 +1,242 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestNomadClient returns a Nomad client talking to a local stand-in of
+// the Nomad API serving the passed nodes.
+func newTestNomadClient(t *testing.T, nodes []*api.Node) *api.Client {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/nodes", func(w http.ResponseWriter, r *http.Request) {
+		var stubs []*api.NodeListStub
+		for _, node := range nodes {
+			stubs = append(stubs, &api.NodeListStub{ID: node.ID, Name: node.Attributes["unique.hostname"],
+				Status: node.Status, SchedulingEligibility: node.SchedulingEligibility})
+		}
+		writeJSON(w, stubs)
+	})
+	mux.HandleFunc("GET /v1/node/{id}", func(w http.ResponseWriter, r *http.Request) {
+		for _, node := range nodes {
+			if node.ID == r.PathValue("id") {
+				writeJSON(w, node)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	client, err := api.NewClient(&api.Config{Address: srv.URL})
+	assert.NoError(t, err)
+	return client
+}
+
+func TestTargetPlugin_waitForNomadJoin(t *testing.T) {
+	nodes := []*api.Node{
+		{ID: "node-1", Status: api.NodeStatusReady, SchedulingEligibility: api.NodeSchedulingEligible,
+			Attributes: map[string]string{"unique.hostname": "nomad-1"}},
+		{ID: "node-2", Status: api.NodeStatusInit, SchedulingEligibility: api.NodeSchedulingEligible,
+			Attributes: map[string]string{"unique.hostname": "nomad-2"}},
+	}
+
+	testCases := []struct {
+		inputServers  []string
+		expectedError string
+		name          string
+	}{
+		{
+			inputServers: []string{"nomad-1"},
+			name:         "all servers joined",
+		},
+		{
+			inputServers:  []string{"nomad-1", "nomad-2", "nomad-3"},
+			expectedError: "2 of 3 servers did not join the Nomad cluster within 50ms: nomad-2, nomad-3",
+			name:          "servers not joined",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tp := TargetPlugin{
+				logger: hclog.NewNullLogger(),
+				config: hcloudPluginConfig{NodeAttrID: "unique.hostname"},
+				nomad:  newTestNomadClient(t, nodes),
+			}
+			targetConfig := &hcloudTargetConfig{GroupID: "test", WaitForNomadJoin: true, NomadJoinTimeout: 50 * time.Millisecond}
+			var servers []*hcloud.Server
+			for _, name := range tc.inputServers {
+				servers = append(servers, &hcloud.Server{Name: name, Created: time.Now()})
+			}
+
+			err := tp.waitForNomadJoin(context.Background(), targetConfig, servers)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError, tc.name)
+			} else {
+				assert.NoError(t, err, tc.name)
+			}
+		})
+	}
+}
+
+func TestTargetPlugin_waitForNomadNode(t *testing.T) {
+	testCases := []struct {
+		inputNode     *api.Node
+		expectedError string
+		name          string
+	}{
+		{
+			inputNode: &api.Node{ID: "node-1", Status: api.NodeStatusReady, SchedulingEligibility: api.NodeSchedulingEligible,
+				Attributes: map[string]string{"unique.hostname": "canary"}},
+			name: "ready node",
+		},
+		{
+			inputNode: &api.Node{ID: "node-1", Status: api.NodeStatusReady, SchedulingEligibility: api.NodeSchedulingIneligible,
+				Attributes: map[string]string{"unique.hostname": "canary"}},
+			expectedError: "node node-1 is ready and ineligible after 50ms",
+			name:          "ineligible node",
+		},
+		{
+			inputNode: &api.Node{ID: "node-2", Status: api.NodeStatusReady, SchedulingEligibility: api.NodeSchedulingEligible,
+				Attributes: map[string]string{"unique.hostname": "other"}},
+			expectedError: "node did not register within 50ms",
+			name:          "other node",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /v1/nodes", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, []*api.NodeListStub{{ID: tc.inputNode.ID, Name: tc.inputNode.Attributes["unique.hostname"],
+					Status: tc.inputNode.Status, SchedulingEligibility: tc.inputNode.SchedulingEligibility}})
+			})
+			mux.HandleFunc("GET /v1/node/{id}", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, tc.inputNode)
+			})
+			srv := httptest.NewServer(mux)
+			t.Cleanup(srv.Close)
+
+			nomadClient, err := api.NewClient(&api.Config{Address: srv.URL})
+			assert.NoError(t, err)
+
+			tp := TargetPlugin{
+				logger: hclog.NewNullLogger(),
+				config: hcloudPluginConfig{NodeAttrID: "unique.hostname"},
+				nomad:  nomadClient,
+			}
+			_, err = tp.waitForNomadNode(context.Background(), &hcloud.Server{Name: "canary"}, 50*time.Millisecond)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError, tc.name)
+			} else {
+				assert.NoError(t, err, tc.name)
+			}
+		})
+	}
+}
+
+func TestTargetPlugin_nomadNodes(t *testing.T) {
+	testCases := []struct {
+		inputAttrID   string
+		expectedNodes map[string]string
+		expectedInfo  int
+		name          string
+	}{
+		{
+			inputAttrID:   "unique.hostname",
+			expectedNodes: map[string]string{"nomad-1": "node-3", "nomad-2": "node-2"},
+			expectedInfo:  0,
+			name:          "matched by node name",
+		},
+		{
+			inputAttrID:   "unique.platform.hcloud.name",
+			expectedNodes: map[string]string{"nomad-1": "node-1"},
+			expectedInfo:  3,
+			name:          "matched by attribute",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var info atomic.Int64
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /v1/nodes", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, []*api.NodeListStub{
+					{ID: "node-1", Name: "nomad-1", Status: api.NodeStatusDown},
+					{ID: "node-2", Name: "nomad-2", Status: api.NodeStatusReady},
+					{ID: "node-3", Name: "nomad-1", Status: api.NodeStatusReady},
+				})
+			})
+			mux.HandleFunc("GET /v1/node/{id}", func(w http.ResponseWriter, r *http.Request) {
+				info.Add(1)
+				attributes := map[string]string{}
+				if r.PathValue("id") == "node-1" {
+					attributes["unique.platform.hcloud.name"] = "nomad-1"
+				}
+				writeJSON(w, &api.Node{ID: r.PathValue("id"), Attributes: attributes})
+			})
+			srv := httptest.NewServer(mux)
+			t.Cleanup(srv.Close)
+			nomadClient, err := api.NewClient(&api.Config{Address: srv.URL})
+			assert.NoError(t, err)
+
+			tp := TargetPlugin{
+				logger: hclog.NewNullLogger(),
+				config: hcloudPluginConfig{NodeAttrID: tc.inputAttrID},
+				nomad:  nomadClient,
+			}
+			names := make(map[string]string)
+			for i := 0; i < 2; i++ {
+				nodes, err := tp.nomadNodes(context.Background(), names)
+				assert.NoError(t, err, tc.name)
+				ids := make(map[string]string)
+				for name, node := range nodes {
+					ids[name] = node.ID
+				}
+				assert.Equal(t, tc.expectedNodes, ids, tc.name)
+			}
+			// Every node is only looked up once.
+			assert.Equal(t, int64(tc.expectedInfo), info.Load(), tc.name)
+		})
+	}
+}
+
+func Test_joinStart(t *testing.T) {
+	created := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	activated := time.Date(2024, 6, 10, 8, 30, 0, 0, time.UTC)
+
+	testCases := []struct {
+		inputLabels    map[string]string
+		expectedOutput time.Time
+		name           string
+	}{
+		{
+			expectedOutput: created,
+			name:           "created server",
+		},
+		{
+			inputLabels:    map[string]string{activatedLabel: strconv.FormatInt(activated.Unix(), 10)},
+			expectedOutput: activated,
+			name:           "activated warm pool server",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := &hcloud.Server{Name: "nomad-1", Created: created, Labels: tc.inputLabels}
+			assert.True(t, tc.expectedOutput.Equal(joinStart(server)), tc.name)
+		})
+	}
+}
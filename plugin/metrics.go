@@ -0,0 +1,58 @@
+package plugin
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsNamespace prefixes the names of all metrics of the plugin.
+const metricsNamespace = "nomad_hcloud_autoscaler"
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	nomadJoinDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "nomad_join_duration_seconds",
+		Help:      "Time from the creation of a server until its Nomad node is ready and eligible.",
+		Buckets:   prometheus.ExponentialBuckets(15, 2, 8),
+	}, []string{"group_id"})
+
+	nomadJoinTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "nomad_join_timeouts_total",
+		Help:      "Number of servers whose Nomad node did not become ready and eligible in time.",
+	}, []string{"group_id"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(nomadJoinDuration, nomadJoinTimeouts)
+}
+
+// setupMetrics serves the plugin metrics in the Prometheus format on the
+// configured address. Metrics are only served once per plugin process.
+func (t *TargetPlugin) setupMetrics() error {
+	if t.config.MetricsAddress == "" || t.metricsListener != nil {
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", t.config.MetricsAddress)
+	if err != nil {
+		return err
+	}
+	t.metricsListener = listener
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	go func() {
+		if err := http.Serve(listener, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			t.logger.Error("failed to serve metrics", "address", t.config.MetricsAddress, "error", err)
+		}
+	}()
+	t.logger.Info("serving metrics", "address", listener.Addr().String())
+	return nil
+}
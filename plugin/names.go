@@ -0,0 +1,182 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+const (
+	// nameCollisionRetries is the number of times a server is created with a
+	// fresh name after its name has been taken.
+	nameCollisionRetries = 3
+
+	// randomSuffixMarker stands in for the random suffix when matching
+	// existing server names against the name template.
+	randomSuffixMarker = "RANDOMSUFFIX"
+)
+
+// hostnameLabelRegexp matches a single label of a hostname as per RFC 1123.
+var hostnameLabelRegexp = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// validateHostname returns an error if the name is not a valid hostname as
+// per RFC 1123, which Hetzner Cloud requires server names to be.
+func validateHostname(name string) error {
+	if len(name) > 253 {
+		return fmt.Errorf("server name %s is longer than 253 characters", name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !hostnameLabelRegexp.MatchString(label) {
+			return fmt.Errorf("server name %q is not a valid hostname", name)
+		}
+	}
+	return nil
+}
+
+// randomSuffix returns a random hex string of the passed length.
+func randomSuffix(suffixLen int) string {
+	return strings.Replace(uuid.New().String(), "-", "", -1)[:suffixLen]
+}
+
+// renderName renders the name template for the server with the passed index
+// and random suffix.
+func (tc *hcloudTargetConfig) renderName(index int, suffix string) (string, error) {
+	data := map[string]interface{}{
+		"GroupID":      tc.GroupID,
+		"Location":     "",
+		"ServerType":   "",
+		"RandomSuffix": suffix,
+		"Index":        index,
+	}
+	if location := tc.targetLocation(); location != nil {
+		data["Location"] = location.Name
+	}
+	if tc.ServerType != nil {
+		data["ServerType"] = tc.ServerType.Name
+	}
+	return renderTemplate("name", tc.NameTemplate, data)
+}
+
+// namePattern returns a regular expression matching the names rendered for
+// the passed index regardless of their random suffix.
+func (tc *hcloudTargetConfig) namePattern(index int) (string, error) {
+	name, err := tc.renderName(index, randomSuffixMarker)
+	if err != nil {
+		return "", err
+	}
+	return "^" + strings.Replace(regexp.QuoteMeta(name), randomSuffixMarker, "[0-9a-f]+", -1) + "$", nil
+}
+
+// freeIndex returns the lowest index starting from 1 which is not used by any
+// of the passed names. Zero is returned when the template does not use the
+// index.
+func (tc *hcloudTargetConfig) freeIndex(names map[string]struct{}) (int, error) {
+	first, err := tc.namePattern(1)
+	if err != nil {
+		return 0, err
+	}
+	second, err := tc.namePattern(2)
+	if err != nil {
+		return 0, err
+	}
+	if first == second {
+		return 0, nil
+	}
+
+	for index := 1; ; index++ {
+		pattern, err := tc.namePattern(index)
+		if err != nil {
+			return 0, err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return 0, fmt.Errorf("failed to match server names: %v", err)
+		}
+		used := false
+		for name := range names {
+			if re.MatchString(name) {
+				used = true
+				break
+			}
+		}
+		if !used {
+			return index, nil
+		}
+	}
+}
+
+// serverName returns a valid name for a new server which is not used by any
+// of the passed names.
+func (tc *hcloudTargetConfig) serverName(suffixLen int, names map[string]struct{}) (string, error) {
+	index, err := tc.freeIndex(names)
+	if err != nil {
+		return "", err
+	}
+	name, err := tc.renderName(index, randomSuffix(suffixLen))
+	if err != nil {
+		return "", err
+	}
+	if err := validateHostname(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// takenNames returns the names of all servers carrying the group label,
+// whatever their status and whether they are in the warm pool.
+func (t *TargetPlugin) takenNames(ctx context.Context, targetConfig *hcloudTargetConfig) (map[string]struct{}, error) {
+	opts := hcloud.ServerListOpts{
+		ListOpts: hcloud.ListOpts{
+			LabelSelector: fmt.Sprintf("%s=%s", t.config.GroupIDLabelSelector, targetConfig.GroupID),
+			PerPage:       t.config.ItemsPerPage,
+		},
+	}
+	servers, err := t.listServers(ctx, targetConfig, opts)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]struct{}, len(servers))
+	for _, server := range servers {
+		names[server.Name] = struct{}{}
+	}
+	return names, nil
+}
+
+// createNamedServer names and creates a single server. Names already taken by
+// the passed servers or claimed during the current scale out are skipped, a
+// server whose name turns out to be taken nevertheless is created again with
+// a fresh name. Names found to be taken are claimed, so that they are skipped
+// by later attempts as well.
+func (t *TargetPlugin) createNamedServer(ctx context.Context, targetConfig *hcloudTargetConfig, opts hcloud.ServerCreateOpts, servers []*hcloud.Server, claims *serverClaims) (hcloud.ServerCreateResult, bool, error) {
+	names := make(map[string]struct{}, len(servers)+len(claims.names))
+	for _, server := range servers {
+		names[server.Name] = struct{}{}
+	}
+	for name := range claims.names {
+		names[name] = struct{}{}
+	}
+
+	for attempt := 0; ; attempt++ {
+		name, err := targetConfig.serverName(t.config.RandomSuffixLen, names)
+		if err != nil {
+			return hcloud.ServerCreateResult{}, true, fmt.Errorf("failed to generate server name: %v", err)
+		}
+		opts.Name = name
+
+		result, terminal, err := t.createServer(ctx, targetConfig, opts, claims)
+		if hcloud.IsError(err, hcloud.ErrorCodeUniquenessError) && attempt < nameCollisionRetries {
+			t.logger.Warn("server name is taken, retrying with a fresh name", "server", name)
+			names[name] = struct{}{}
+			claims.names[name] = struct{}{}
+			continue
+		}
+		if err == nil {
+			claims.names[name] = struct{}{}
+		}
+		return result, terminal, err
+	}
+}
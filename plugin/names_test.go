@@ -0,0 +1,146 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_validateHostname(t *testing.T) {
+	testCases := []struct {
+		input         string
+		expectedError bool
+		name          string
+	}{
+		{input: "nomad-fsn1-007", name: "valid name"},
+		{input: "nomad.example.com", name: "valid FQDN"},
+		{input: "nomad_1", expectedError: true, name: "underscore"},
+		{input: "-nomad", expectedError: true, name: "leading hyphen"},
+		{input: "nomad-", expectedError: true, name: "trailing hyphen"},
+		{input: "nomad..example", expectedError: true, name: "empty label"},
+		{input: "a234567890123456789012345678901234567890123456789012345678901234", expectedError: true, name: "label too long"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateHostname(tc.input)
+			if tc.expectedError {
+				assert.Error(t, err, tc.name)
+			} else {
+				assert.NoError(t, err, tc.name)
+			}
+		})
+	}
+}
+
+func Test_hcloudTargetConfig_serverName(t *testing.T) {
+	testCases := []struct {
+		inputTemplate  string
+		inputNames     []string
+		expectedOutput string
+		name           string
+	}{
+		{
+			inputTemplate:  "{{ .GroupID }}-{{ .RandomSuffix }}",
+			expectedOutput: `^nomad-[0-9a-f]{10}$`,
+			name:           "default template",
+		},
+		{
+			inputTemplate:  `nomad-{{ .Location }}-{{ printf "%03d" .Index }}`,
+			inputNames:     []string{"nomad-fsn1-001", "nomad-fsn1-003", "other-002"},
+			expectedOutput: `^nomad-fsn1-002$`,
+			name:           "lowest free index",
+		},
+		{
+			inputTemplate:  `{{ .ServerType }}-{{ .Index }}-{{ .RandomSuffix }}`,
+			inputNames:     []string{"cx22-1-0a1b2c3d4e"},
+			expectedOutput: `^cx22-2-[0-9a-f]{10}$`,
+			name:           "index with random suffix",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			targetConfig := hcloudTargetConfig{
+				GroupID:      "nomad",
+				Location:     &hcloud.Location{Name: "fsn1"},
+				ServerType:   &hcloud.ServerType{Name: "cx22"},
+				NameTemplate: tc.inputTemplate,
+			}
+			names := make(map[string]struct{})
+			for _, name := range tc.inputNames {
+				names[name] = struct{}{}
+			}
+
+			actualOutput, err := targetConfig.serverName(10, names)
+			assert.NoError(t, err, tc.name)
+			assert.Regexp(t, regexp.MustCompile(tc.expectedOutput), actualOutput, tc.name)
+		})
+	}
+}
+
+func TestTargetPlugin_createNamedServer(t *testing.T) {
+	var requested []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /servers", func(w http.ResponseWriter, r *http.Request) {
+		// Stopped and warm pool servers are listed along the running ones.
+		assert.Equal(t, "group-id=nomad", r.URL.Query().Get("label_selector"))
+		assert.Empty(t, r.URL.Query()["status"])
+		writeJSON(w, schema.ServerListResponse{Servers: []schema.Server{
+			{ID: 1, Name: "nomad-1", Status: "off"},
+			{ID: 2, Name: "nomad-2", Status: "off", Labels: map[string]string{warmPoolLabel: warmPoolValue}},
+		}})
+	})
+	mux.HandleFunc("POST /servers", func(w http.ResponseWriter, r *http.Request) {
+		var req schema.ServerCreateRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		requested = append(requested, req.Name)
+		w.Header().Set("Content-Type", "application/json")
+		if req.Name == "nomad-3" {
+			// Taken by a server outside of the group.
+			w.WriteHeader(http.StatusConflict)
+			writeJSON(w, schema.ErrorResponse{Error: schema.Error{Code: "uniqueness_error", Message: "server name is already used"}})
+			return
+		}
+		writeJSON(w, schema.ServerCreateResponse{
+			Server: schema.Server{ID: 10, Name: req.Name},
+			Action: schema.Action{ID: 10, Status: "success", Progress: 100},
+		})
+	})
+
+	tp := TargetPlugin{
+		config: hcloudPluginConfig{GroupIDLabelSelector: "group-id", RandomSuffixLen: 10},
+		logger: hclog.NewNullLogger(),
+		hcloud: newTestHCloudClient(t, mux),
+	}
+	targetConfig := &hcloudTargetConfig{GroupID: "nomad", NameTemplate: "{{ .GroupID }}-{{ .Index }}"}
+
+	opts := hcloud.ServerCreateOpts{
+		ServerType: &hcloud.ServerType{Name: "cx22"},
+		Image:      &hcloud.Image{Name: "ubuntu-24.04"},
+	}
+	claims := newServerClaims()
+	taken, err := tp.takenNames(context.Background(), targetConfig)
+	assert.NoError(t, err)
+	for name := range taken {
+		claims.names[name] = struct{}{}
+	}
+
+	result, _, err := tp.createNamedServer(context.Background(), targetConfig, opts, nil, claims)
+	assert.NoError(t, err)
+	assert.Equal(t, "nomad-4", result.Server.Name)
+	assert.Equal(t, []string{"nomad-3", "nomad-4"}, requested)
+
+	// The collided name is remembered for later servers of the scale out.
+	result, _, err = tp.createNamedServer(context.Background(), targetConfig, opts, nil, claims)
+	assert.NoError(t, err)
+	assert.Equal(t, "nomad-5", result.Server.Name)
+	assert.Equal(t, []string{"nomad-3", "nomad-4", "nomad-5"}, requested)
+}
@@ -0,0 +1,250 @@
+package plugin
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+const (
+	// privateIPLabelPrefix prefixes the server label keys which record the
+	// private IP allocated to the server in a network.
+	privateIPLabelPrefix = "private-ip-"
+
+	// aliasIPLabelPrefix prefixes the server label keys which record the
+	// alias IPs allocated to the server in a network.
+	aliasIPLabelPrefix = "private-alias-ip-"
+)
+
+// fixedIPNetwork is a network servers are attached to with an IP allocated
+// from a configured range.
+type fixedIPNetwork struct {
+	network *hcloud.Network
+	ipRange *net.IPNet
+	gateway net.IP
+}
+
+func privateIPLabel(network *hcloud.Network) string {
+	return fmt.Sprintf("%s%d", privateIPLabelPrefix, network.ID)
+}
+
+func aliasIPLabel(network *hcloud.Network, index int) string {
+	return fmt.Sprintf("%s%d-%d", aliasIPLabelPrefix, network.ID, index)
+}
+
+// fixedIPNetworks returns the configured networks which have an IP range set.
+func (tc *hcloudTargetConfig) fixedIPNetworks() ([]*fixedIPNetwork, error) {
+	var out []*fixedIPNetwork
+	for key, value := range tc.NetworkIPRanges {
+		var network *hcloud.Network
+		for _, n := range tc.Networks {
+			if n.Name == key || strconv.FormatInt(n.ID, 10) == key {
+				network = n
+				break
+			}
+		}
+		if network == nil {
+			return nil, fmt.Errorf("IP range is set for network %s which is not in hcloud_networks", key)
+		}
+
+		_, ipRange, err := net.ParseCIDR(value)
+		if err != nil || ipRange.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 range %s for network %s", value, key)
+		}
+
+		fixed := &fixedIPNetwork{network: network, ipRange: ipRange}
+		for _, subnet := range network.Subnets {
+			if subnet.IPRange != nil && subnet.IPRange.Contains(ipRange.IP) {
+				fixed.gateway = subnet.Gateway
+				break
+			}
+		}
+		if network.IPRange != nil && fixed.gateway == nil {
+			return nil, fmt.Errorf("IP range %s is not within a subnet of network %s", value, network.Name)
+		}
+		out = append(out, fixed)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].network.ID < out[j].network.ID })
+	return out, nil
+}
+
+// prepareNetworkIPs allocates an IP and the alias IPs from the range of each
+// fixed IP network for a server which is about to be created. Allocations are
+// recorded in the server labels. The fixed IP networks are attached once the
+// server has been created, therefore the server is not started on creation.
+func (t *TargetPlugin) prepareNetworkIPs(ctx context.Context, targetConfig *hcloudTargetConfig, opts *hcloud.ServerCreateOpts, claimed map[string]struct{}) error {
+	if len(targetConfig.NetworkIPRanges) == 0 {
+		return nil
+	}
+
+	fixedNetworks, err := targetConfig.fixedIPNetworks()
+	if err != nil {
+		return err
+	}
+
+	labels := make(map[string]string, len(opts.Labels))
+	for key, value := range opts.Labels {
+		labels[key] = value
+	}
+
+	for _, fixed := range fixedNetworks {
+		used, err := t.usedNetworkIPs(ctx, fixed.network)
+		if err != nil {
+			return err
+		}
+		for ip := range claimed {
+			used[ip] = struct{}{}
+		}
+
+		ips, err := fixed.allocate(used, 1+targetConfig.NetworkAliasIPs)
+		if err != nil {
+			return err
+		}
+		labels[privateIPLabel(fixed.network)] = ips[0].String()
+		for i, alias := range ips[1:] {
+			labels[aliasIPLabel(fixed.network, i)] = alias.String()
+		}
+		for _, ip := range ips {
+			claimed[ip.String()] = struct{}{}
+		}
+
+		var networks []*hcloud.Network
+		for _, network := range opts.Networks {
+			if network.ID != fixed.network.ID {
+				networks = append(networks, network)
+			}
+		}
+		opts.Networks = networks
+	}
+
+	opts.Labels = labels
+	opts.StartAfterCreate = hcloud.Ptr(false)
+	return nil
+}
+
+// releaseNetworkIPs gives up the IPs allocated for a server whose creation
+// failed.
+func (t *TargetPlugin) releaseNetworkIPs(opts *hcloud.ServerCreateOpts, claimed map[string]struct{}) {
+	for key, value := range opts.Labels {
+		if strings.HasPrefix(key, privateIPLabelPrefix) || strings.HasPrefix(key, aliasIPLabelPrefix) {
+			delete(claimed, value)
+		}
+	}
+}
+
+// attachNetworks attaches a created server to the fixed IP networks using the
+// IPs recorded in its labels.
+func (t *TargetPlugin) attachNetworks(ctx context.Context, targetConfig *hcloudTargetConfig, server *hcloud.Server) error {
+	if len(targetConfig.NetworkIPRanges) == 0 {
+		return nil
+	}
+
+	fixedNetworks, err := targetConfig.fixedIPNetworks()
+	if err != nil {
+		return err
+	}
+
+	var actionIDs []int64
+	for _, fixed := range fixedNetworks {
+		opts := hcloud.ServerAttachToNetworkOpts{
+			Network:  fixed.network,
+			IP:       net.ParseIP(server.Labels[privateIPLabel(fixed.network)]),
+			AliasIPs: []net.IP{},
+		}
+		for i := 0; i < targetConfig.NetworkAliasIPs; i++ {
+			if alias := net.ParseIP(server.Labels[aliasIPLabel(fixed.network, i)]); alias != nil {
+				opts.AliasIPs = append(opts.AliasIPs, alias)
+			}
+		}
+		action, _, err := t.client(ctx).Server.AttachToNetwork(ctx, server, opts)
+		if err != nil {
+			return fmt.Errorf("failed to attach server %s to network %s: %v", server.Name, fixed.network.Name, err)
+		}
+		actionIDs = append(actionIDs, action.ID)
+		t.logger.Info("attaching server to network", "server", server.Name,
+			"network", fixed.network.Name, "ip", opts.IP.String(), "alias_ips", len(opts.AliasIPs))
+	}
+	if err := t.waitForActions(ctx, actionIDs); err != nil {
+		return fmt.Errorf("failed to wait for server %s to be attached to networks: %v", server.Name, err)
+	}
+	return nil
+}
+
+// usedNetworkIPs returns the IPs of the network which are either recorded in
+// the labels of a server or in use by a server. All servers of the project
+// are listed, as servers not managed by the plugin hold IPs of the network
+// as well.
+func (t *TargetPlugin) usedNetworkIPs(ctx context.Context, network *hcloud.Network) (map[string]struct{}, error) {
+	opts := hcloud.ServerListOpts{
+		ListOpts: hcloud.ListOpts{
+			PerPage: t.config.ItemsPerPage,
+		},
+	}
+	servers, err := t.client(ctx).Server.AllWithOpts(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list servers with IPs in network %s: %v", network.Name, err)
+	}
+
+	used := make(map[string]struct{})
+	aliasPrefix := fmt.Sprintf("%s%d-", aliasIPLabelPrefix, network.ID)
+	for _, server := range servers {
+		for key, value := range server.Labels {
+			if key == privateIPLabel(network) || strings.HasPrefix(key, aliasPrefix) {
+				used[value] = struct{}{}
+			}
+		}
+		for _, privateNet := range server.PrivateNet {
+			if privateNet.Network == nil || privateNet.Network.ID != network.ID {
+				continue
+			}
+			used[privateNet.IP.String()] = struct{}{}
+			for _, alias := range privateNet.Aliases {
+				used[alias.String()] = struct{}{}
+			}
+		}
+	}
+	return used, nil
+}
+
+// allocate returns count free IPs of the range. The network and broadcast
+// addresses of the range and the subnet gateway are never allocated.
+func (f *fixedIPNetwork) allocate(used map[string]struct{}, count int) ([]net.IP, error) {
+	base := binary.BigEndian.Uint32(f.ipRange.IP.To4())
+	ones, bits := f.ipRange.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+
+	var ips []net.IP
+	for offset := uint32(1); offset+1 < size && len(ips) < count; offset++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, base+offset)
+		if f.gateway != nil && ip.Equal(f.gateway) {
+			continue
+		}
+		if _, ok := used[ip.String()]; ok {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) < count {
+		return nil, fmt.Errorf("no %d free IPs left in range %s of network %s", count, f.ipRange.String(), f.network.Name)
+	}
+	return ips, nil
+}
+
+// privateIPs returns the fixed private IPs recorded in the passed labels keyed
+// by network name.
+func (tc *hcloudTargetConfig) privateIPs(labels map[string]string) map[string]string {
+	out := make(map[string]string)
+	for _, network := range tc.Networks {
+		if ip, ok := labels[privateIPLabel(network)]; ok {
+			out[network.Name] = ip
+		}
+	}
+	return out
+}
@@ -0,0 +1,146 @@
+package plugin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func testNetwork() *hcloud.Network {
+	_, networkRange, _ := net.ParseCIDR("10.0.0.0/16")
+	_, subnetRange, _ := net.ParseCIDR("10.0.1.0/24")
+	return &hcloud.Network{
+		ID:      7,
+		Name:    "mynet",
+		IPRange: networkRange,
+		Subnets: []hcloud.NetworkSubnet{
+			{Type: hcloud.NetworkSubnetTypeCloud, IPRange: subnetRange, Gateway: net.ParseIP("10.0.1.1")},
+		},
+	}
+}
+
+func Test_hcloudTargetConfig_fixedIPNetworks(t *testing.T) {
+	testCases := []struct {
+		inputRanges   map[string]string
+		expectedRange string
+		expectedError bool
+		name          string
+	}{
+		{
+			inputRanges:   map[string]string{"mynet": "10.0.1.0/28"},
+			expectedRange: "10.0.1.0/28",
+			name:          "range by network name",
+		},
+		{
+			inputRanges:   map[string]string{"7": "10.0.1.16/28"},
+			expectedRange: "10.0.1.16/28",
+			name:          "range by network ID",
+		},
+		{
+			inputRanges:   map[string]string{"other": "10.0.1.0/28"},
+			expectedError: true,
+			name:          "network not configured",
+		},
+		{
+			inputRanges:   map[string]string{"mynet": "10.0.2.0/28"},
+			expectedError: true,
+			name:          "range outside of subnets",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			targetConfig := hcloudTargetConfig{
+				Networks:        []*hcloud.Network{testNetwork()},
+				NetworkIPRanges: tc.inputRanges,
+			}
+			actualOutput, err := targetConfig.fixedIPNetworks()
+			assert.Equal(t, tc.expectedError, err != nil, tc.name)
+			if !tc.expectedError {
+				assert.Equal(t, tc.expectedRange, actualOutput[0].ipRange.String(), tc.name)
+				assert.Equal(t, "10.0.1.1", actualOutput[0].gateway.String(), tc.name)
+			}
+		})
+	}
+}
+
+func Test_fixedIPNetwork_allocate(t *testing.T) {
+	_, ipRange, _ := net.ParseCIDR("10.0.1.0/29")
+	fixed := &fixedIPNetwork{
+		network: testNetwork(),
+		ipRange: ipRange,
+		gateway: net.ParseIP("10.0.1.1"),
+	}
+
+	testCases := []struct {
+		inputUsed      []string
+		inputCount     int
+		expectedOutput []string
+		expectedError  bool
+		name           string
+	}{
+		{
+			inputCount:     1,
+			expectedOutput: []string{"10.0.1.2"},
+			name:           "gateway skipped",
+		},
+		{
+			inputUsed:      []string{"10.0.1.2", "10.0.1.4"},
+			inputCount:     3,
+			expectedOutput: []string{"10.0.1.3", "10.0.1.5", "10.0.1.6"},
+			name:           "used IPs skipped",
+		},
+		{
+			inputUsed:     []string{"10.0.1.2", "10.0.1.3"},
+			inputCount:    4,
+			expectedError: true,
+			name:          "range exhausted",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			used := make(map[string]struct{})
+			for _, ip := range tc.inputUsed {
+				used[ip] = struct{}{}
+			}
+			actualOutput, err := fixed.allocate(used, tc.inputCount)
+			assert.Equal(t, tc.expectedError, err != nil, tc.name)
+			var actualIPs []string
+			for _, ip := range actualOutput {
+				actualIPs = append(actualIPs, ip.String())
+			}
+			assert.Equal(t, tc.expectedOutput, actualIPs, tc.name)
+		})
+	}
+}
+
+func TestTargetPlugin_usedNetworkIPs(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /servers", func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.URL.Query().Get("label_selector"))
+		writeJSON(w, schema.ServerListResponse{Servers: []schema.Server{
+			// Managed server whose IP is only recorded so far.
+			{ID: 1, Labels: map[string]string{"private-ip-7": "10.0.1.2", "private-alias-ip-7-0": "10.0.1.3"}},
+			// Server not managed by the plugin attached to the network.
+			{ID: 2, PrivateNet: []schema.ServerPrivateNet{{Network: 7, IP: "10.0.1.4", AliasIPs: []string{"10.0.1.5"}}}},
+			// Server attached to another network.
+			{ID: 3, PrivateNet: []schema.ServerPrivateNet{{Network: 8, IP: "10.0.1.6"}}},
+		}})
+	})
+	tp := TargetPlugin{hcloud: newTestHCloudClient(t, mux)}
+
+	used, err := tp.usedNetworkIPs(context.Background(), testNetwork())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]struct{}{
+		"10.0.1.2": {},
+		"10.0.1.3": {},
+		"10.0.1.4": {},
+		"10.0.1.5": {},
+	}, used)
+}
@@ -0,0 +1,166 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// placementGroupMaxServers is the maximum number of servers Hetzner Cloud
+// allows in a spread placement group.
+const placementGroupMaxServers = 10
+
+// placementGroupShardingEnabled returns whether the plugin manages placement
+// groups of the group itself.
+func (tc *hcloudTargetConfig) placementGroupShardingEnabled() bool {
+	return tc.PlacementGroupPrefix != ""
+}
+
+// placementGroupSize returns the number of servers in the placement group,
+// including servers created during the current scale out which the API may
+// not list yet.
+func placementGroupSize(placementGroup *hcloud.PlacementGroup, claimed map[int64]map[int64]struct{}) int {
+	servers := make(map[int64]struct{})
+	for _, id := range placementGroup.Servers {
+		servers[id] = struct{}{}
+	}
+	for id := range claimed[placementGroup.ID] {
+		servers[id] = struct{}{}
+	}
+	return len(servers)
+}
+
+// preparePlacementGroup assigns a placement group of the group which has room
+// left to a server which is about to be created. A new spread placement group
+// is created when all existing ones are full.
+func (t *TargetPlugin) preparePlacementGroup(ctx context.Context, targetConfig *hcloudTargetConfig, opts *hcloud.ServerCreateOpts, claimed map[int64]map[int64]struct{}) error {
+	if !targetConfig.placementGroupShardingEnabled() {
+		return nil
+	}
+
+	placementGroups, err := t.getPlacementGroups(ctx, targetConfig)
+	if err != nil {
+		return err
+	}
+	for _, placementGroup := range placementGroups {
+		if placementGroupSize(placementGroup, claimed) < placementGroupMaxServers {
+			opts.PlacementGroup = placementGroup
+			return nil
+		}
+	}
+
+	result, _, err := t.client(ctx).PlacementGroup.Create(ctx, hcloud.PlacementGroupCreateOpts{
+		Name:   targetConfig.nextPlacementGroupName(placementGroups),
+		Labels: targetConfig.serverLabels(t.config.GroupIDLabelSelector),
+		Type:   hcloud.PlacementGroupTypeSpread,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create placement group: %v", err)
+	}
+	if result.Action != nil {
+		if err := t.waitForActions(ctx, []int64{result.Action.ID}); err != nil {
+			return fmt.Errorf("failed to wait for placement group %s to be created: %v", result.PlacementGroup.Name, err)
+		}
+	}
+	t.logger.Info("created placement group", "placement_group", result.PlacementGroup.Name)
+	opts.PlacementGroup = result.PlacementGroup
+	return nil
+}
+
+// claimPlacementGroup records a server created in a placement group during
+// the current scale out.
+func claimPlacementGroup(opts *hcloud.ServerCreateOpts, server *hcloud.Server, claimed map[int64]map[int64]struct{}) {
+	if opts.PlacementGroup == nil {
+		return
+	}
+	if claimed[opts.PlacementGroup.ID] == nil {
+		claimed[opts.PlacementGroup.ID] = make(map[int64]struct{})
+	}
+	claimed[opts.PlacementGroup.ID][server.ID] = struct{}{}
+}
+
+// nextPlacementGroupName returns the name with the lowest free index for a new
+// placement group.
+func (tc *hcloudTargetConfig) nextPlacementGroupName(placementGroups []*hcloud.PlacementGroup) string {
+	used := make(map[int]struct{})
+	for _, placementGroup := range placementGroups {
+		suffix := strings.TrimPrefix(placementGroup.Name, tc.PlacementGroupPrefix+"-")
+		if index, err := strconv.Atoi(suffix); err == nil {
+			used[index] = struct{}{}
+		}
+	}
+	index := 1
+	for {
+		if _, ok := used[index]; !ok {
+			break
+		}
+		index++
+	}
+	return fmt.Sprintf("%s-%d", tc.PlacementGroupPrefix, index)
+}
+
+// deleteEmptyPlacementGroups deletes the placement groups of the group which
+// have no servers left.
+func (t *TargetPlugin) deleteEmptyPlacementGroups(ctx context.Context, targetConfig *hcloudTargetConfig) error {
+	if !targetConfig.placementGroupShardingEnabled() {
+		return nil
+	}
+
+	placementGroups, err := t.getPlacementGroups(ctx, targetConfig)
+	if err != nil {
+		return err
+	}
+	for _, placementGroup := range placementGroups {
+		if len(placementGroup.Servers) > 0 {
+			continue
+		}
+		if _, err := t.client(ctx).PlacementGroup.Delete(ctx, placementGroup); err != nil {
+			return fmt.Errorf("failed to delete placement group %s: %v", placementGroup.Name, err)
+		}
+		t.logger.Info("deleted empty placement group", "placement_group", placementGroup.Name)
+	}
+	return nil
+}
+
+// placementGroupsStatus returns the placement groups of the group and how
+// many servers each of them holds, in a format suitable for status meta.
+func (t *TargetPlugin) placementGroupsStatus(ctx context.Context, targetConfig *hcloudTargetConfig) (string, error) {
+	placementGroups, err := t.getPlacementGroups(ctx, targetConfig)
+	if err != nil {
+		return "", err
+	}
+	var out []string
+	for _, placementGroup := range placementGroups {
+		out = append(out, fmt.Sprintf("%s=%d/%d", placementGroup.Name, len(placementGroup.Servers), placementGroupMaxServers))
+	}
+	return strings.Join(out, ","), nil
+}
+
+// getPlacementGroups returns the placement groups managed for the group
+// ordered by name.
+func (t *TargetPlugin) getPlacementGroups(ctx context.Context, targetConfig *hcloudTargetConfig) ([]*hcloud.PlacementGroup, error) {
+	opts := hcloud.PlacementGroupListOpts{
+		ListOpts: hcloud.ListOpts{
+			LabelSelector: targetConfig.getSelector(t.config.GroupIDLabelSelector),
+			PerPage:       t.config.ItemsPerPage,
+		},
+		Type: hcloud.PlacementGroupTypeSpread,
+	}
+	placementGroups, err := t.client(ctx).PlacementGroup.AllWithOpts(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list placement groups: %v", err)
+	}
+
+	var out []*hcloud.PlacementGroup
+	for _, placementGroup := range placementGroups {
+		if strings.HasPrefix(placementGroup.Name, targetConfig.PlacementGroupPrefix+"-") {
+			out = append(out, placementGroup)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
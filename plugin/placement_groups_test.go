@@ -0,0 +1,80 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetPlugin_preparePlacementGroup(t *testing.T) {
+	full := []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+
+	testCases := []struct {
+		inputGroups    []schema.PlacementGroup
+		inputClaimed   map[int64]map[int64]struct{}
+		expectedOutput string
+		name           string
+	}{
+		{
+			inputGroups: []schema.PlacementGroup{
+				{ID: 1, Name: "nomad-1", Servers: full, Type: "spread"},
+				{ID: 2, Name: "nomad-2", Servers: []int64{11}, Type: "spread"},
+			},
+			expectedOutput: "nomad-2",
+			name:           "group with room used",
+		},
+		{
+			inputGroups: []schema.PlacementGroup{
+				{ID: 1, Name: "nomad-1", Servers: full, Type: "spread"},
+				{ID: 3, Name: "nomad-3", Servers: []int64{11}, Type: "spread"},
+				{ID: 9, Name: "other-1", Type: "spread"},
+			},
+			inputClaimed: map[int64]map[int64]struct{}{
+				3: {12: {}, 13: {}, 14: {}, 15: {}, 16: {}, 17: {}, 18: {}, 19: {}, 20: {}},
+			},
+			expectedOutput: "nomad-2",
+			name:           "new group created when all are full",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /placement_groups", func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "group-id=test", r.URL.Query().Get("label_selector"))
+				writeJSON(w, schema.PlacementGroupListResponse{PlacementGroups: tc.inputGroups})
+			})
+			mux.HandleFunc("POST /placement_groups", func(w http.ResponseWriter, r *http.Request) {
+				var req schema.PlacementGroupCreateRequest
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+				assert.Equal(t, "spread", req.Type)
+				w.WriteHeader(http.StatusCreated)
+				writeJSON(w, schema.PlacementGroupCreateResponse{
+					PlacementGroup: schema.PlacementGroup{ID: 100, Name: req.Name, Type: req.Type},
+				})
+			})
+
+			tp := TargetPlugin{
+				logger: hclog.NewNullLogger(),
+				config: hcloudPluginConfig{GroupIDLabelSelector: "group-id"},
+				hcloud: newTestHCloudClient(t, mux),
+			}
+			targetConfig := &hcloudTargetConfig{GroupID: "test", PlacementGroupPrefix: "nomad"}
+			claimed := tc.inputClaimed
+			if claimed == nil {
+				claimed = make(map[int64]map[int64]struct{})
+			}
+
+			opts := hcloud.ServerCreateOpts{Name: "test-1"}
+			err := tp.preparePlacementGroup(context.Background(), targetConfig, &opts, claimed)
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.expectedOutput, opts.PlacementGroup.Name, tc.name)
+		})
+	}
+}
@@ -3,8 +3,12 @@ package plugin
 import (
 	"context"
 	"fmt"
+	"net"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-playground/locales/en"
 	ut "github.com/go-playground/universal-translator"
@@ -17,12 +21,17 @@ import (
 	"github.com/hashicorp/nomad-autoscaler/sdk"
 	"github.com/hashicorp/nomad-autoscaler/sdk/helper/nomad"
 	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+	"github.com/hashicorp/nomad/api"
 	"github.com/hetznercloud/hcloud-go/v2/hcloud"
 )
 
 const (
 	// pluginName is the unique name of the this plugin amongst Target plugins.
 	pluginName = "hcloud-server"
+
+	// metaKeyPlacementGroups is the status meta key listing the placement
+	// groups managed for the group and how full each of them is.
+	metaKeyPlacementGroups = "hcloud_placement_groups"
 )
 
 var (
@@ -49,6 +58,54 @@ type TargetPlugin struct {
 	logger hclog.Logger
 	hcloud *hcloud.Client
 
+	// dns is the optional Hetzner DNS client used to manage server records.
+	dns *dnsClient
+
+	// ensured holds the resource configs which have already been ensured, so
+	// that resources are only created or updated once per distinct config.
+	ensured     map[string]struct{}
+	ensuredLock sync.Mutex
+
+	// nomad is the Nomad API client used to check on new servers.
+	nomad *api.Client
+
+	// canaryFailures holds the failed canaries keyed by group ID.
+	canaryFailures map[string]canaryFailure
+	canaryLock     sync.Mutex
+
+	// warmPoolFilling holds the groups whose warm pool is being replenished.
+	warmPoolFilling map[string]struct{}
+	warmPoolLock    sync.Mutex
+
+	// refreshes tracks the rolling refreshes keyed by group ID.
+	refreshes   map[string]*refreshState
+	refreshLock sync.Mutex
+
+	// scaling holds the locks serialising the scaling actions and server
+	// replacements of a group, keyed by group ID.
+	scaling     map[string]*sync.Mutex
+	scalingLock sync.Mutex
+
+	// serverTypes caches the server types and their prices.
+	serverTypes     serverTypeCache
+	serverTypesLock sync.Mutex
+
+	// projects holds the HCloud clients keyed by project name, the empty name
+	// being the project of hcloud_token.
+	projects map[string]*hcloud.Client
+
+	// breakers holds the circuit breakers keyed by group ID.
+	breakers    map[string]*breakerState
+	breakerLock sync.Mutex
+
+	// desired holds the last desired count of step limited groups keyed by
+	// group ID.
+	desired     map[string]int64
+	desiredLock sync.Mutex
+
+	// metricsListener serves the plugin metrics if enabled.
+	metricsListener net.Listener
+
 	// clusterUtils provides general cluster scaling utilities for querying the
 	// state of nodes pools and performing scaling tasks.
 	clusterUtils *scaleutils.ClusterScaleUtils
@@ -58,7 +115,8 @@ type TargetPlugin struct {
 // interface.
 func NewHCloudServerPlugin(log hclog.Logger) *TargetPlugin {
 	return &TargetPlugin{
-		logger: log,
+		logger:  log,
+		ensured: make(map[string]struct{}),
 	}
 }
 
@@ -81,7 +139,7 @@ func (t *TargetPlugin) SetConfig(config map[string]string) error {
 		return ut.Add("required", "{0} value is not set in a {1} config", true)
 	}, func(ut ut.Translator, fe validator.FieldError) string {
 		var configTypeName string
-		if strings.HasPrefix(fe.Namespace(), "hcloudTargetConfig") {
+		if strings.HasPrefix(fe.Namespace(), "hcloudTargetConfig") || strings.HasPrefix(fe.Namespace(), "hcloudEnsureConfig") {
 			configTypeName = "target"
 		} else if strings.HasPrefix(fe.Namespace(), "hcloudPluginConfig") {
 			configTypeName = "plugin"
@@ -98,14 +156,26 @@ func (t *TargetPlugin) SetConfig(config map[string]string) error {
 	if err := parse(nil, config, &t.config); err != nil {
 		return fmt.Errorf("failed to parse HCloud plugin config: %v", err)
 	}
+	if err := t.config.validateQuotas(); err != nil {
+		return fmt.Errorf("failed to parse HCloud plugin config: %v", err)
+	}
 
 	t.setupHCloudClient()
+	t.setupDNSClient()
+	if err := t.setupMetrics(); err != nil {
+		return fmt.Errorf("failed to serve metrics: %v", err)
+	}
 
 	clusterUtils, err := scaleutils.NewClusterScaleUtils(nomad.ConfigFromNamespacedMap(config), t.logger)
 	if err != nil {
 		return err
 	}
 
+	t.nomad, err = api.NewClient(nomad.ConfigFromNamespacedMap(config))
+	if err != nil {
+		return fmt.Errorf("failed to create Nomad client: %v", err)
+	}
+
 	// Store and set the remote ID callback function.
 	t.clusterUtils = clusterUtils
 	t.clusterUtils.ClusterNodeIDLookupFunc = t.hcloudNodeIDMap
@@ -126,32 +196,92 @@ func (t *TargetPlugin) Scale(action sdk.ScalingAction, config map[string]string)
 		return nil
 	}
 
-	ctx := context.Background()
+	ctx, err := t.projectContext(context.Background(), config["hcloud_project"])
+	if err != nil {
+		return err
+	}
+
+	// Create missing resources before the target config is parsed, as parsing
+	// fails for resources which do not exist.
+	if err := t.ensureResources(ctx, config); err != nil {
+		return fmt.Errorf("failed to ensure HCloud resources: %v", err)
+	}
 
 	// Get Hetzner Cloud servers. This serves to both validate the config value is
 	// correct and ensure the HCloud client is configured correctly. The response
 	// can also be used when performing the scaling, meaning we only need to
 	// call it once.
 	var targetConfig hcloudTargetConfig
-	if err := parse(t.client(), config, &targetConfig); err != nil {
+	if err := parse(t.client(ctx), config, &targetConfig); err != nil {
 		return fmt.Errorf("failed to parse HCloud target config: %v", err)
 	}
+	for name := range targetConfig.SpilloverProjects {
+		if _, err := t.projectContext(ctx, name); err != nil {
+			return err
+		}
+	}
+
+	if reason, ok := t.breakerOpen(&targetConfig, config); ok {
+		return fmt.Errorf("circuit breaker open: %s", reason)
+	}
+
+	// Replacements of servers in the background would otherwise pick the
+	// same servers as a scale in, or be scaled in themselves.
+	lock := t.groupLock(targetConfig.GroupID)
+	lock.Lock()
+	defer lock.Unlock()
 
 	servers, err := t.getServers(ctx, &targetConfig)
 	if err != nil {
 		return fmt.Errorf("failed to get HCloud servers: %v", err)
 	}
 
+	// Servers exceeding the maximum age are replaced in the background.
+	t.scheduleRotation(config, &targetConfig, servers)
+
+	// Remove records and volumes of servers which have gone away outside of
+	// the autoscaler, a failure here should not block the scaling action.
+	if err := t.reconcileDNSRecords(ctx, &targetConfig, servers); err != nil {
+		t.logger.Error("failed to reconcile DNS records", "hcloud_group_id", targetConfig.GroupID, "error", err)
+	}
+	if err := t.collectVolumes(ctx, &targetConfig); err != nil {
+		t.logger.Error("failed to collect dangling volumes", "hcloud_group_id", targetConfig.GroupID, "error", err)
+	}
+
+	// Large differences are worked off over several scaling actions when the
+	// step size is limited.
+	current, err := targetConfig.currentCount(servers)
+	if err != nil {
+		return err
+	}
+	count := t.stepCount(&targetConfig, current, action.Count)
+
+	switch targetConfig.ScalingMode {
+	case scalingModeVertical:
+		if err := t.scaleVertical(ctx, servers, count, config, &targetConfig); err != nil {
+			return fmt.Errorf("failed to perform scaling action: %v", err)
+		}
+		return nil
+	case scalingModeWeighted:
+		if err := t.scaleWeighted(ctx, servers, count, config, &targetConfig); err != nil {
+			return fmt.Errorf("failed to perform scaling action: %v", err)
+		}
+		return nil
+	}
+
 	// The Hetzner Cloud servers require different details depending on which
 	// direction we want to scale. Therefore calculate the direction and the
 	// relevant number so we can correctly perform the HCloud work.
-	num, direction := t.calculateDirection(int64(len(servers)), action.Count)
+	num, direction := t.calculateDirection(int64(len(servers)), count)
 
 	switch direction {
 	case "in":
 		err = t.scaleIn(ctx, servers, num, config, &targetConfig)
 	case "out":
 		err = t.scaleOut(ctx, servers, num, config, &targetConfig)
+		if !scaleOutHeldBack(err) {
+			t.recordScaleOut(&targetConfig, config, err != nil)
+		}
 	default:
 		t.logger.Info("scaling not required", "hcloud_name_prefix", targetConfig.GroupID,
 			"current_count", len(servers), "strategy_count", action.Count)
@@ -177,19 +307,29 @@ func (t *TargetPlugin) Status(config map[string]string) (*sdk.TargetStatus, erro
 		return &sdk.TargetStatus{Ready: ready}, nil
 	}
 
+	ctx, err := t.projectContext(context.Background(), config["hcloud_project"])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.ensureResources(ctx, config); err != nil {
+		return nil, fmt.Errorf("failed to ensure HCloud resources: %v", err)
+	}
+
 	var targetConfig hcloudTargetConfig
-	if err := parse(t.client(), config, &targetConfig); err != nil {
+	if err := parse(t.client(ctx), config, &targetConfig); err != nil {
 		return nil, fmt.Errorf("failed to parse HCloud target config: %v", err)
 	}
 
-	ctx := context.Background()
-
 	servers, err := t.getServers(ctx, &targetConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get a list of hetzner servers: %v", err)
 	}
 
-	serverCount := int64(len(servers))
+	serverCount, err := targetConfig.currentCount(servers)
+	if err != nil {
+		return nil, err
+	}
 
 	// Set our initial status. The asg.Status field is only set when the ASG is
 	// being deleted
@@ -199,6 +339,95 @@ func (t *TargetPlugin) Status(config map[string]string) (*sdk.TargetStatus, erro
 		Meta:  make(map[string]string),
 	}
 
+	if targetConfig.Canary {
+		resp.Meta[metaKeyCanaryHealth] = "healthy"
+		if failure, ok := t.canaryFailed(targetConfig.GroupID, config); ok {
+			resp.Meta[metaKeyCanaryHealth] = "unhealthy"
+			resp.Meta[metaKeyCanaryReason] = failure.reason
+		}
+	}
+
+	if targetConfig.WarmPoolSize > 0 {
+		pool, err := t.getWarmServers(ctx, &targetConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get warm pool servers: %v", err)
+		}
+		resp.Meta[metaKeyWarmPool] = strconv.Itoa(len(pool))
+		if len(pool) < targetConfig.WarmPoolSize {
+			t.replenishWarmPool(&targetConfig)
+		}
+	}
+
+	if reason, ok := t.refreshPaused(targetConfig.GroupID, config); ok {
+		resp.Meta[metaKeyRefreshPaused] = reason
+	}
+	if targetConfig.RefreshInterval > 0 {
+		userData, err := targetConfig.userData()
+		if err != nil {
+			return nil, err
+		}
+		drifted := driftedServers(servers, targetConfig.createConfigHash(userData))
+		resp.Meta[metaKeyRefreshDrifted] = strconv.Itoa(len(drifted))
+		if len(drifted) > 0 {
+			t.scheduleRefresh(config, &targetConfig)
+		}
+	}
+	if targetConfig.MaxServerAge > 0 && len(servers) > 0 {
+		resp.Meta[metaKeyNextRotation] = nextRotation(servers, targetConfig.MaxServerAge).UTC().Format(time.RFC3339)
+		t.scheduleRotation(config, &targetConfig, servers)
+	}
+
+	if targetConfig.stepsEnabled() {
+		if delta, ok := t.remainingDelta(targetConfig.GroupID, serverCount); ok {
+			resp.Meta[metaKeyRemainingDelta] = strconv.FormatInt(delta, 10)
+		}
+	}
+
+	if targetConfig.breakerEnabled() {
+		resp.Meta[metaKeyBreaker] = "closed"
+		if reason, ok := t.breakerOpen(&targetConfig, config); ok {
+			resp.Meta[metaKeyBreaker] = "open"
+			resp.Meta[metaKeyBreakerReason] = reason
+		}
+	}
+
+	if t.capsEnabled(&targetConfig) {
+		cost, err := t.hourlyCost(ctx, servers)
+		if err != nil {
+			return nil, err
+		}
+		resp.Meta[metaKeyHourlyCost] = formatPrice(cost)
+		capacity, limit, err := t.scaleOutCapacity(ctx, servers, &targetConfig)
+		if err != nil {
+			return nil, err
+		}
+		resp.Meta[metaKeyCapReached] = capNone
+		if capacity == 0 {
+			resp.Meta[metaKeyCapReached] = limit
+		}
+	}
+
+	if quota := t.quota(ctx); quota.servers > 0 || quota.cores > 0 {
+		headroom, err := t.projectHeadroom(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if quota.servers > 0 {
+			resp.Meta[metaKeyQuotaServers] = strconv.FormatInt(headroom.servers, 10)
+		}
+		if quota.cores > 0 {
+			resp.Meta[metaKeyQuotaCores] = strconv.FormatInt(headroom.cores, 10)
+		}
+	}
+
+	if targetConfig.placementGroupShardingEnabled() {
+		placementGroups, err := t.placementGroupsStatus(ctx, &targetConfig)
+		if err != nil {
+			return nil, err
+		}
+		resp.Meta[metaKeyPlacementGroups] = placementGroups
+	}
+
 	return &resp, nil
 }
 
@@ -1,11 +1,32 @@
 package plugin
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
 	"github.com/stretchr/testify/assert"
 )
 
+// newTestHCloudClient returns an HCloud client talking to a local stand-in of
+// the HCloud API served by the passed handler.
+func newTestHCloudClient(t *testing.T, handler http.Handler) *hcloud.Client {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return hcloud.NewClient(
+		hcloud.WithToken("token"),
+		hcloud.WithEndpoint(srv.URL),
+	)
+}
+
+// writeJSON writes the passed value as JSON response body.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
 func TestTargetPlugin_calculateDirection(t *testing.T) {
 	testCases := []struct {
 		inputAsgDesired      int64
@@ -0,0 +1,183 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+const (
+	// primaryIPPoolPolicyFail fails the scale out when the pool has no free
+	// Primary IP left.
+	primaryIPPoolPolicyFail = "fail"
+
+	// primaryIPPoolPolicyFallback creates the server with fresh Primary IPs
+	// when the pool has no free Primary IP left.
+	primaryIPPoolPolicyFallback = "fallback"
+)
+
+// errPrimaryIPPoolExhausted is returned when the pool has no free Primary IP
+// left and the pool policy does not allow falling back to fresh IPs.
+var errPrimaryIPPoolExhausted = errors.New("no free Primary IP left in the pool")
+
+// primaryIPPoolEnabled returns whether servers get Primary IPs from a pool.
+func (tc *hcloudTargetConfig) primaryIPPoolEnabled() bool {
+	return tc.PrimaryIPPool != ""
+}
+
+// preparePrimaryIPs assigns free Primary IPs of the pool to a server which is
+// about to be created. A Primary IP is taken for each enabled public IP
+// family, both IPs have to reside in the same datacenter which the server is
+// then created in.
+func (t *TargetPlugin) preparePrimaryIPs(ctx context.Context, targetConfig *hcloudTargetConfig, opts *hcloud.ServerCreateOpts, claimed map[int64]struct{}) error {
+	if !targetConfig.primaryIPPoolEnabled() {
+		return nil
+	}
+
+	primaryIPs, err := t.getPrimaryIPs(ctx, targetConfig)
+	if err != nil {
+		return err
+	}
+
+	var ipv4, ipv6 *hcloud.PrimaryIP
+	for _, datacenter := range primaryIPDatacenters(primaryIPs) {
+		ipv4 = freePrimaryIP(primaryIPs, hcloud.PrimaryIPTypeIPv4, datacenter, claimed)
+		ipv6 = freePrimaryIP(primaryIPs, hcloud.PrimaryIPTypeIPv6, datacenter, claimed)
+		if (!opts.PublicNet.EnableIPv4 || ipv4 != nil) && (!opts.PublicNet.EnableIPv6 || ipv6 != nil) {
+			break
+		}
+		ipv4, ipv6 = nil, nil
+	}
+
+	if (opts.PublicNet.EnableIPv4 && ipv4 == nil) || (opts.PublicNet.EnableIPv6 && ipv6 == nil) {
+		if targetConfig.PrimaryIPPoolPolicy != primaryIPPoolPolicyFail {
+			t.logger.Warn("Primary IP pool exhausted, creating server with fresh IPs",
+				"server", opts.Name, "pool", targetConfig.PrimaryIPPool)
+			return nil
+		}
+		return errPrimaryIPPoolExhausted
+	}
+
+	if !opts.PublicNet.EnableIPv4 {
+		ipv4 = nil
+	}
+	if !opts.PublicNet.EnableIPv6 {
+		ipv6 = nil
+	}
+
+	publicNet := *opts.PublicNet
+	publicNet.IPv4, publicNet.IPv6 = ipv4, ipv6
+	for _, primaryIP := range []*hcloud.PrimaryIP{ipv4, ipv6} {
+		if primaryIP == nil {
+			continue
+		}
+		claimed[primaryIP.ID] = struct{}{}
+		opts.Datacenter = primaryIP.Datacenter
+		opts.Location = nil
+		t.logger.Info("assigning Primary IP from pool", "server", opts.Name,
+			"primary_ip", primaryIP.IP.String(), "datacenter", primaryIP.Datacenter.Name)
+	}
+	opts.PublicNet = &publicNet
+	return nil
+}
+
+// releasePrimaryIPs returns the Primary IPs prepared for a server whose
+// creation failed to the pool.
+func (t *TargetPlugin) releasePrimaryIPs(opts *hcloud.ServerCreateOpts, claimed map[int64]struct{}) {
+	if opts.PublicNet == nil {
+		return
+	}
+	for _, primaryIP := range []*hcloud.PrimaryIP{opts.PublicNet.IPv4, opts.PublicNet.IPv6} {
+		if primaryIP != nil {
+			delete(claimed, primaryIP.ID)
+		}
+	}
+}
+
+// retainPrimaryIPs disables auto deletion of the pool Primary IPs assigned to
+// a server which is about to be deleted, so they are kept for reuse.
+func (t *TargetPlugin) retainPrimaryIPs(ctx context.Context, targetConfig *hcloudTargetConfig, server *hcloud.Server) error {
+	if !targetConfig.primaryIPPoolEnabled() {
+		return nil
+	}
+
+	primaryIPs, err := t.getPrimaryIPs(ctx, targetConfig)
+	if err != nil {
+		return err
+	}
+	for _, primaryIP := range primaryIPs {
+		if primaryIP.AssigneeID != server.ID || !primaryIP.AutoDelete {
+			continue
+		}
+		_, _, err := t.client(ctx).PrimaryIP.Update(ctx, primaryIP, hcloud.PrimaryIPUpdateOpts{
+			AutoDelete: hcloud.Ptr(false),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to disable auto delete of Primary IP %s: %v", primaryIP.IP.String(), err)
+		}
+		t.logger.Info("retaining Primary IP", "server", server.Name, "primary_ip", primaryIP.IP.String())
+	}
+	return nil
+}
+
+func (t *TargetPlugin) getPrimaryIPs(ctx context.Context, targetConfig *hcloudTargetConfig) ([]*hcloud.PrimaryIP, error) {
+	opts := hcloud.PrimaryIPListOpts{
+		ListOpts: hcloud.ListOpts{
+			LabelSelector: targetConfig.PrimaryIPPool,
+			PerPage:       t.config.ItemsPerPage,
+		},
+	}
+	primaryIPs, err := t.client(ctx).PrimaryIP.AllWithOpts(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list HCloud Primary IPs: %v", err)
+	}
+
+	// Primary IPs are bound to a datacenter, therefore only those usable for
+	// servers of the group are considered.
+	var usable []*hcloud.PrimaryIP
+	for _, primaryIP := range primaryIPs {
+		if primaryIP.Datacenter == nil {
+			continue
+		}
+		if targetConfig.Datacenter != nil && primaryIP.Datacenter.Name != targetConfig.Datacenter.Name {
+			continue
+		}
+		if targetConfig.Location != nil && !sameLocation(primaryIP.Datacenter.Location, targetConfig.Location) {
+			continue
+		}
+		usable = append(usable, primaryIP)
+	}
+	return usable, nil
+}
+
+// primaryIPDatacenters returns the distinct datacenters of the passed Primary
+// IPs in order of appearance.
+func primaryIPDatacenters(primaryIPs []*hcloud.PrimaryIP) []*hcloud.Datacenter {
+	var datacenters []*hcloud.Datacenter
+	seen := make(map[string]struct{})
+	for _, primaryIP := range primaryIPs {
+		if _, ok := seen[primaryIP.Datacenter.Name]; ok {
+			continue
+		}
+		seen[primaryIP.Datacenter.Name] = struct{}{}
+		datacenters = append(datacenters, primaryIP.Datacenter)
+	}
+	return datacenters
+}
+
+// freePrimaryIP returns an unassigned and unclaimed Primary IP of the passed
+// type in the passed datacenter.
+func freePrimaryIP(primaryIPs []*hcloud.PrimaryIP, ipType hcloud.PrimaryIPType, datacenter *hcloud.Datacenter, claimed map[int64]struct{}) *hcloud.PrimaryIP {
+	for _, primaryIP := range primaryIPs {
+		if primaryIP.Type != ipType || primaryIP.AssigneeID != 0 || primaryIP.Datacenter.Name != datacenter.Name {
+			continue
+		}
+		if _, ok := claimed[primaryIP.ID]; ok {
+			continue
+		}
+		return primaryIP
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetPlugin_preparePrimaryIPs(t *testing.T) {
+	fsn1 := schema.Location{ID: 1, Name: "fsn1"}
+	dc14 := schema.Datacenter{ID: 4, Name: "fsn1-dc14", Location: fsn1}
+	dc15 := schema.Datacenter{ID: 5, Name: "fsn1-dc15", Location: fsn1}
+	nbg1dc3 := schema.Datacenter{ID: 2, Name: "nbg1-dc3", Location: schema.Location{ID: 2, Name: "nbg1"}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /primary_ips", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "pool=egress", r.URL.Query().Get("label_selector"))
+		writeJSON(w, schema.PrimaryIPListResult{PrimaryIPs: []schema.PrimaryIP{
+			{ID: 1, IP: "192.0.2.1", Type: "ipv4", Datacenter: dc14, AssigneeID: hcloud.Ptr(int64(10))},
+			{ID: 2, IP: "192.0.2.2", Type: "ipv4", Datacenter: nbg1dc3},
+			{ID: 3, IP: "192.0.2.3", Type: "ipv4", Datacenter: dc14},
+			{ID: 4, IP: "2001:db8::/64", Type: "ipv6", Datacenter: dc15},
+			{ID: 5, IP: "192.0.2.5", Type: "ipv4", Datacenter: dc15},
+		}})
+	})
+
+	testCases := []struct {
+		enableIPv6         bool
+		policy             string
+		claimed            []int64
+		expectedIPv4       int64
+		expectedIPv6       int64
+		expectedDatacenter string
+		expectedError      error
+		name               string
+	}{
+		{
+			policy:             primaryIPPoolPolicyFail,
+			expectedIPv4:       3,
+			expectedDatacenter: "fsn1-dc14",
+			name:               "first free IPv4 assigned",
+		},
+		{
+			enableIPv6:         true,
+			policy:             primaryIPPoolPolicyFail,
+			expectedIPv4:       5,
+			expectedIPv6:       4,
+			expectedDatacenter: "fsn1-dc15",
+			name:               "IPv4 and IPv6 from the same datacenter",
+		},
+		{
+			policy:        primaryIPPoolPolicyFail,
+			claimed:       []int64{3, 5},
+			expectedError: errPrimaryIPPoolExhausted,
+			name:          "pool exhausted",
+		},
+		{
+			policy:  primaryIPPoolPolicyFallback,
+			claimed: []int64{3, 5},
+			name:    "pool exhausted with fallback",
+		},
+	}
+
+	tp := TargetPlugin{
+		logger: hclog.NewNullLogger(),
+		hcloud: newTestHCloudClient(t, mux),
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			targetConfig := &hcloudTargetConfig{
+				Location:            &hcloud.Location{ID: 1, Name: "fsn1"},
+				PrimaryIPPool:       "pool=egress",
+				PrimaryIPPoolPolicy: tc.policy,
+			}
+			opts := hcloud.ServerCreateOpts{
+				Name:     "test-1",
+				Location: targetConfig.Location,
+				PublicNet: &hcloud.ServerCreatePublicNet{
+					EnableIPv4: true,
+					EnableIPv6: tc.enableIPv6,
+				},
+			}
+			claimed := make(map[int64]struct{})
+			for _, id := range tc.claimed {
+				claimed[id] = struct{}{}
+			}
+
+			err := tp.preparePrimaryIPs(context.Background(), targetConfig, &opts, claimed)
+			assert.Equal(t, tc.expectedError, err, tc.name)
+
+			var actualIPv4, actualIPv6 int64
+			if opts.PublicNet.IPv4 != nil {
+				actualIPv4 = opts.PublicNet.IPv4.ID
+			}
+			if opts.PublicNet.IPv6 != nil {
+				actualIPv6 = opts.PublicNet.IPv6.ID
+			}
+			assert.Equal(t, tc.expectedIPv4, actualIPv4, tc.name)
+			assert.Equal(t, tc.expectedIPv6, actualIPv6, tc.name)
+			if tc.expectedDatacenter != "" {
+				assert.Nil(t, opts.Location, tc.name)
+				assert.Equal(t, tc.expectedDatacenter, opts.Datacenter.Name, tc.name)
+			}
+		})
+	}
+}
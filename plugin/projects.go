@@ -0,0 +1,223 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// projectLabel is the label recording the project of servers created in a
+// spillover project. Servers without it belong to the project of the group.
+const projectLabel = "project"
+
+// projectKey is the context key holding the name of the project HCloud calls
+// are made in.
+type projectKey struct{}
+
+// withProject returns a context making HCloud calls in the named project.
+func withProject(ctx context.Context, project string) context.Context {
+	return context.WithValue(ctx, projectKey{}, project)
+}
+
+// projectFrom returns the name of the project HCloud calls are made in, the
+// empty name is the project of hcloud_token.
+func projectFrom(ctx context.Context) string {
+	project, _ := ctx.Value(projectKey{}).(string)
+	return project
+}
+
+// client returns the HCloud client of the project of the context.
+func (t *TargetPlugin) client(ctx context.Context) *hcloud.Client {
+	if client, ok := t.projects[projectFrom(ctx)]; ok {
+		return client
+	}
+	return t.hcloud
+}
+
+// projectContext returns a context making HCloud calls in the named project,
+// which has to be configured with a token.
+func (t *TargetPlugin) projectContext(ctx context.Context, project string) (context.Context, error) {
+	if _, ok := t.projects[project]; !ok && project != "" {
+		return nil, fmt.Errorf("project %s has no token in hcloud_project_tokens", project)
+	}
+	return withProject(ctx, project), nil
+}
+
+// spilloverEnabled returns whether the group spills over into other projects.
+func (tc *hcloudTargetConfig) spilloverEnabled() bool {
+	return len(tc.SpilloverProjects) > 0
+}
+
+// projectNames returns the project of the group followed by its spillover
+// projects.
+func (tc *hcloudTargetConfig) projectNames() []string {
+	names := []string{tc.Project}
+	for name := range tc.SpilloverProjects {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// projectConfig ensures the resources of the group in the named project and
+// parses the config against it, so that resources referenced by name resolve
+// to those of the project.
+func (t *TargetPlugin) projectConfig(ctx context.Context, project string, config map[string]string) (context.Context, *hcloudTargetConfig, error) {
+	ctx, err := t.projectContext(ctx, project)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := t.ensureResources(ctx, config); err != nil {
+		return nil, nil, fmt.Errorf("failed to ensure HCloud resources in project %s: %v", project, err)
+	}
+	var targetConfig hcloudTargetConfig
+	if err := parse(t.client(ctx), config, &targetConfig); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse HCloud target config in project %s: %v", project, err)
+	}
+	return ctx, &targetConfig, nil
+}
+
+// projectServers groups the passed servers by the project they are in.
+func projectServers(servers []*hcloud.Server, project string) map[string][]*hcloud.Server {
+	grouped := make(map[string][]*hcloud.Server)
+	for _, server := range servers {
+		name, ok := server.Labels[projectLabel]
+		if !ok {
+			name = project
+		}
+		grouped[name] = append(grouped[name], server)
+	}
+	return grouped
+}
+
+// projectShare is the number of servers to create in a spillover project.
+type projectShare struct {
+	project string
+	count   int64
+}
+
+// spilloverShares splits the passed count across the spillover projects
+// proportionally to their weights, the largest remainders getting the
+// servers left over. The shares are ordered by descending weight.
+func spilloverShares(weights map[string]int64, count int64) []projectShare {
+	var total int64
+	for _, weight := range weights {
+		total += weight
+	}
+	if total == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(weights))
+	for name := range weights {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if weights[names[i]] != weights[names[j]] {
+			return weights[names[i]] > weights[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	shares := make([]projectShare, len(names))
+	remainders := make([]int64, len(names))
+	left := count
+	for i, name := range names {
+		shares[i] = projectShare{project: name, count: count * weights[name] / total}
+		remainders[i] = count * weights[name] % total
+		left -= shares[i].count
+	}
+	order := make([]int, len(names))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return remainders[order[i]] > remainders[order[j]] })
+	for _, i := range order[:left] {
+		shares[i].count++
+	}
+	return shares
+}
+
+// spilloverWeights returns the parsed spillover weights keyed by project name.
+func (tc *hcloudTargetConfig) spilloverWeights() (map[string]int64, error) {
+	weights := make(map[string]int64, len(tc.SpilloverProjects))
+	for name, value := range tc.SpilloverProjects {
+		weight, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("spillover weight %q of project %s is not a positive integer", value, name)
+		}
+		weights[name] = weight
+	}
+	return weights, nil
+}
+
+// spillOver creates the servers missing to reach the passed count in the
+// spillover projects. Servers which do not fit into a project because of its
+// quota move on to the next project.
+func (t *TargetPlugin) spillOver(ctx context.Context, log hclog.Logger, count int64, config map[string]string, targetConfig *hcloudTargetConfig) error {
+	weights, err := targetConfig.spilloverWeights()
+	if err != nil {
+		return err
+	}
+	servers, err := t.getServers(ctx, targetConfig)
+	if err != nil {
+		return fmt.Errorf("failed to get HCloud servers before spillover: %v", err)
+	}
+	missing := count - int64(len(servers))
+	if missing <= 0 {
+		return nil
+	}
+
+	var (
+		spilled  []*hcloud.Server
+		carry    int64
+		exceeded *quotaError
+	)
+	for _, share := range spilloverShares(weights, missing) {
+		want := share.count + carry
+		if want == 0 {
+			continue
+		}
+		projectCtx, projectConfig, err := t.projectConfig(ctx, share.project, config)
+		if err != nil {
+			return err
+		}
+		log.Info("spilling servers over into project", "project", share.project, "count", want)
+
+		target, quotaErr, err := t.checkQuota(projectCtx, servers, int64(len(servers))+want, projectConfig)
+		if err != nil {
+			return fmt.Errorf("failed to check quotas of project %s: %v", share.project, err)
+		}
+		var created []*hcloud.Server
+		if target > int64(len(servers)) {
+			created, err = t.createServers(projectCtx, servers, target, projectConfig)
+			if err != nil && !errors.As(err, &quotaErr) {
+				return err
+			}
+		}
+		servers = append(servers, created...)
+		spilled = append(spilled, created...)
+		carry = want - int64(len(created))
+		if carry > 0 {
+			exceeded = quotaErr
+			log.Warn("project quota reached, moving on to the next project", "project", share.project, "remaining", carry)
+		}
+	}
+
+	if err := t.waitForNomadJoin(ctx, targetConfig, spilled); err != nil {
+		return err
+	}
+	if carry > 0 {
+		resource, message := quotaServers, ""
+		if exceeded != nil {
+			resource, message = exceeded.resource, exceeded.message
+		}
+		return &quotaError{resource: resource, message: message, requested: missing, created: missing - carry}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_spilloverShares(t *testing.T) {
+	testCases := []struct {
+		inputWeights   map[string]int64
+		inputCount     int64
+		expectedShares []projectShare
+		name           string
+	}{
+		{
+			inputWeights:   map[string]int64{"b": 1},
+			inputCount:     5,
+			expectedShares: []projectShare{{project: "b", count: 5}},
+			name:           "single project",
+		},
+		{
+			inputWeights:   map[string]int64{"b": 1, "c": 3},
+			inputCount:     8,
+			expectedShares: []projectShare{{project: "c", count: 6}, {project: "b", count: 2}},
+			name:           "split by weight",
+		},
+		{
+			inputWeights:   map[string]int64{"b": 1, "c": 1, "d": 1},
+			inputCount:     2,
+			expectedShares: []projectShare{{project: "b", count: 1}, {project: "c", count: 1}, {project: "d", count: 0}},
+			name:           "remainders",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedShares, spilloverShares(tc.inputWeights, tc.inputCount), tc.name)
+		})
+	}
+}
+
+func Test_projectServers(t *testing.T) {
+	servers := []*hcloud.Server{
+		{Name: "nomad-1"},
+		{Name: "nomad-2", Labels: map[string]string{projectLabel: "b"}},
+		{Name: "nomad-3", Labels: map[string]string{}},
+	}
+	grouped := projectServers(servers, "a")
+	assert.Equal(t, "nomad-1, nomad-3", serverNames(grouped["a"]))
+	assert.Equal(t, "nomad-2", serverNames(grouped["b"]))
+}
+
+func TestTargetPlugin_projectContext(t *testing.T) {
+	tp := TargetPlugin{config: hcloudPluginConfig{Token: "a", ProjectTokens: map[string]string{"b": "b"}}}
+	tp.setupHCloudClient()
+
+	ctx, err := tp.projectContext(context.Background(), "b")
+	assert.NoError(t, err)
+	assert.Same(t, tp.projects["b"], tp.client(ctx))
+	assert.Same(t, tp.hcloud, tp.client(context.Background()))
+
+	_, err = tp.projectContext(context.Background(), "c")
+	assert.EqualError(t, err, "project c has no token in hcloud_project_tokens")
+}
+
+func TestTargetPlugin_getServers_spillover(t *testing.T) {
+	project := func(names ...string) *hcloud.Client {
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /servers", func(w http.ResponseWriter, r *http.Request) {
+			var servers []schema.Server
+			for _, name := range names {
+				servers = append(servers, schema.Server{Name: name})
+			}
+			writeJSON(w, schema.ServerListResponse{Servers: servers})
+		})
+		return newTestHCloudClient(t, mux)
+	}
+	tp := TargetPlugin{projects: map[string]*hcloud.Client{
+		"a": project("nomad-1"),
+		"b": project("nomad-2", "nomad-3"),
+		"c": project("nomad-4"),
+	}}
+
+	targetConfig := &hcloudTargetConfig{GroupID: "test", Project: "a", SpilloverProjects: map[string]string{"b": "1"}}
+	servers, err := tp.getServers(context.Background(), targetConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, "nomad-1, nomad-2, nomad-3", serverNames(servers))
+}
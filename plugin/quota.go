@@ -0,0 +1,234 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+const (
+	// metaKeyQuotaServers and metaKeyQuotaCores are the status meta keys
+	// holding the remaining headroom of the project quotas.
+	metaKeyQuotaServers = "hcloud_quota_servers_headroom"
+	metaKeyQuotaCores   = "hcloud_quota_cores_headroom"
+
+	// The project quotas limiting scale outs.
+	quotaServers = "servers"
+	quotaCores   = "cores"
+)
+
+// quotaError is returned when a scale out would exceed a project quota. Limits
+// reported by the API which are neither the server nor the core limit only
+// carry the message of the API.
+type quotaError struct {
+	resource  string
+	message   string
+	limit     int64
+	requested int64
+	created   int64
+}
+
+func (e *quotaError) Error() string {
+	switch {
+	case e.limit > 0:
+		return fmt.Sprintf("project quota of %d %s exceeded, %d of %d requested servers were created",
+			e.limit, e.resource, e.created, e.requested)
+	case e.resource != "":
+		return fmt.Sprintf("project %s limit exceeded, %d of %d requested servers were created",
+			e.resource, e.created, e.requested)
+	}
+	return fmt.Sprintf("project limit exceeded (%s), %d of %d requested servers were created",
+		e.message, e.created, e.requested)
+}
+
+// apiQuotaError returns the quota error of a resource limit exceeded error of
+// the API. The API only names the exceeded limit in its message, which is
+// mapped to the server or core limit where possible.
+func apiQuotaError(err error, requested, created int64) *quotaError {
+	quotaErr := &quotaError{message: err.Error(), requested: requested, created: created}
+	var apiErr hcloud.Error
+	if errors.As(err, &apiErr) {
+		quotaErr.message = apiErr.Message
+	}
+	switch message := strings.ToLower(quotaErr.message); {
+	case strings.Contains(message, "core"):
+		quotaErr.resource = quotaCores
+	case strings.Contains(message, "server"):
+		quotaErr.resource = quotaServers
+	}
+	return quotaErr
+}
+
+// quotaHeadroom is the remaining headroom of the project quotas, unset quotas
+// have unlimited headroom.
+type quotaHeadroom struct {
+	servers int64
+	cores   int64
+}
+
+// projectQuota is the server and core limit of a project, unset limits are
+// zero.
+type projectQuota struct {
+	servers int64
+	cores   int64
+}
+
+// projectQuota returns the limits of the named project. The project of
+// hcloud_token is limited by hcloud_quota_servers and hcloud_quota_cores,
+// further projects by their entries in hcloud_project_quota_servers and
+// hcloud_project_quota_cores.
+func (c *hcloudPluginConfig) projectQuota(project string) (projectQuota, error) {
+	if project == "" {
+		return projectQuota{servers: int64(c.QuotaServers), cores: int64(c.QuotaCores)}, nil
+	}
+	var quota projectQuota
+	for _, limit := range []struct {
+		values map[string]string
+		name   string
+		value  *int64
+	}{
+		{values: c.ProjectQuotaServers, name: "hcloud_project_quota_servers", value: &quota.servers},
+		{values: c.ProjectQuotaCores, name: "hcloud_project_quota_cores", value: &quota.cores},
+	} {
+		value, ok := limit.values[project]
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return quota, fmt.Errorf("%s of project %s is not a non-negative integer: %q", limit.name, project, value)
+		}
+		*limit.value = n
+	}
+	return quota, nil
+}
+
+// validateQuotas returns an error if a project quota names a project without
+// a token or is not a non-negative integer.
+func (c *hcloudPluginConfig) validateQuotas() error {
+	for _, values := range []map[string]string{c.ProjectQuotaServers, c.ProjectQuotaCores} {
+		for project := range values {
+			if _, ok := c.ProjectTokens[project]; !ok {
+				return fmt.Errorf("project %s has a quota but no token in hcloud_project_tokens", project)
+			}
+			if _, err := c.projectQuota(project); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// quota returns the limits of the project of the context. The limits are
+// validated along with the plugin config.
+func (t *TargetPlugin) quota(ctx context.Context) projectQuota {
+	quota, _ := t.config.projectQuota(projectFrom(ctx))
+	return quota
+}
+
+// quotaEnabled returns whether any quota of the project of the context is
+// configured.
+func (t *TargetPlugin) quotaEnabled(ctx context.Context) bool {
+	quota := t.quota(ctx)
+	return quota.servers > 0 || quota.cores > 0
+}
+
+// serverTypeCores returns the number of cores of the server type, looking it
+// up if the server type does not carry it.
+func (t *TargetPlugin) serverTypeCores(ctx context.Context, serverType *hcloud.ServerType) (int64, error) {
+	if serverType.Cores > 0 {
+		return int64(serverType.Cores), nil
+	}
+	types, err := t.availableServerTypes(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, available := range types {
+		if available.Name == serverType.Name {
+			return int64(available.Cores), nil
+		}
+	}
+	return 0, fmt.Errorf("server type %s was not found", serverType.Name)
+}
+
+// projectHeadroom returns the remaining headroom of the quotas of the project
+// of the context. All servers of the project count against the quotas, not
+// only those managed by the plugin.
+func (t *TargetPlugin) projectHeadroom(ctx context.Context) (quotaHeadroom, error) {
+	headroom := quotaHeadroom{servers: math.MaxInt64, cores: math.MaxInt64}
+	quota := t.quota(ctx)
+	if quota.servers <= 0 && quota.cores <= 0 {
+		return headroom, nil
+	}
+
+	servers, err := t.client(ctx).Server.All(ctx)
+	if err != nil {
+		return headroom, fmt.Errorf("failed to get servers of the project: %v", err)
+	}
+	if quota.servers > 0 {
+		headroom.servers = max(quota.servers-int64(len(servers)), 0)
+	}
+	if quota.cores > 0 {
+		var cores int64
+		for _, server := range servers {
+			n, err := t.serverTypeCores(ctx, server.ServerType)
+			if err != nil {
+				return headroom, fmt.Errorf("failed to get cores of server %s: %v", server.Name, err)
+			}
+			cores += n
+		}
+		headroom.cores = max(quota.cores-cores, 0)
+	}
+	return headroom, nil
+}
+
+// checkQuota lowers the desired count of a scale out so that no quota of the
+// project of the context is exceeded. The returned quota error is set if the
+// count was lowered.
+func (t *TargetPlugin) checkQuota(ctx context.Context, servers []*hcloud.Server, count int64, targetConfig *hcloudTargetConfig) (int64, *quotaError, error) {
+	if !t.quotaEnabled(ctx) {
+		return count, nil, nil
+	}
+	headroom, err := t.projectHeadroom(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	quota := t.quota(ctx)
+	fits, resource, limit := headroom.servers, quotaServers, quota.servers
+	if quota.cores > 0 {
+		serverType := targetConfig.ServerType
+		if targetConfig.AutoServerType {
+			serverType, _, err = t.cheapestServerType(ctx, targetConfig)
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+		cores, err := t.serverTypeCores(ctx, serverType)
+		if err != nil {
+			return 0, nil, err
+		}
+		if cores > 0 && headroom.cores/cores < fits {
+			fits, resource, limit = headroom.cores/cores, quotaCores, quota.cores
+		}
+	}
+
+	requested := count - int64(len(servers))
+	if requested <= fits {
+		return count, nil, nil
+	}
+	t.logger.Warn("scale out limited by project quota, creating fewer servers than requested",
+		"hcloud_group_id", targetConfig.GroupID, "quota", resource,
+		"requested", requested, "allowed", fits)
+	return int64(len(servers)) + fits, &quotaError{
+		resource:  resource,
+		limit:     limit,
+		requested: requested,
+		created:   fits,
+	}, nil
+}
@@ -0,0 +1,174 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetPlugin_checkQuota(t *testing.T) {
+	cx22 := &hcloud.ServerType{Name: "cx22", Cores: 2}
+	groupServers := []*hcloud.Server{{Name: "nomad-1", ServerType: cx22}}
+
+	testCases := []struct {
+		inputProject      string
+		inputQuotaServers int
+		inputQuotaCores   int
+		inputProjectQuota map[string]string
+		inputCount        int64
+		expectedCount     int64
+		expectedError     string
+		name              string
+	}{
+		{
+			inputCount:    10,
+			expectedCount: 10,
+			name:          "no quotas",
+		},
+		{
+			inputQuotaServers: 10,
+			inputCount:        5,
+			expectedCount:     5,
+			name:              "within server quota",
+		},
+		{
+			inputQuotaServers: 5,
+			inputCount:        5,
+			expectedCount:     3,
+			expectedError:     "project quota of 5 servers exceeded, 2 of 4 requested servers were created",
+			name:              "server quota exceeded",
+		},
+		{
+			inputQuotaServers: 10,
+			inputQuotaCores:   8,
+			inputCount:        5,
+			expectedCount:     2,
+			expectedError:     "project quota of 8 cores exceeded, 1 of 4 requested servers were created",
+			name:              "core quota exceeded",
+		},
+		{
+			inputProject:      "spillover",
+			inputProjectQuota: map[string]string{"spillover": "5"},
+			inputCount:        5,
+			expectedCount:     3,
+			expectedError:     "project quota of 5 servers exceeded, 2 of 4 requested servers were created",
+			name:              "quota of other project exceeded",
+		},
+		{
+			inputProject:      "spillover",
+			inputQuotaServers: 5,
+			inputCount:        5,
+			expectedCount:     5,
+			name:              "quota of hcloud_token project not applied to other project",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /servers", func(w http.ResponseWriter, r *http.Request) {
+				// Three servers of the project, of which only one is managed.
+				server := schema.Server{ServerType: schema.ServerType{Name: "cx22", Cores: 2}}
+				writeJSON(w, schema.ServerListResponse{Servers: []schema.Server{server, server, server}})
+			})
+
+			tp := TargetPlugin{
+				config: hcloudPluginConfig{
+					QuotaServers:        tc.inputQuotaServers,
+					QuotaCores:          tc.inputQuotaCores,
+					ProjectQuotaServers: tc.inputProjectQuota,
+				},
+				logger: hclog.NewNullLogger(),
+				hcloud: newTestHCloudClient(t, mux),
+			}
+			targetConfig := &hcloudTargetConfig{GroupID: "test", ServerType: cx22}
+
+			ctx := withProject(context.Background(), tc.inputProject)
+			count, exceeded, err := tp.checkQuota(ctx, groupServers, tc.inputCount, targetConfig)
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.expectedCount, count, tc.name)
+			if tc.expectedError == "" {
+				assert.Nil(t, exceeded, tc.name)
+			} else {
+				assert.EqualError(t, exceeded, tc.expectedError, tc.name)
+			}
+		})
+	}
+}
+
+func Test_hcloudPluginConfig_validateQuotas(t *testing.T) {
+	testCases := []struct {
+		inputServers  map[string]string
+		inputCores    map[string]string
+		expectedError string
+		name          string
+	}{
+		{
+			inputServers: map[string]string{"spillover": "10"},
+			inputCores:   map[string]string{"spillover": "40"},
+			name:         "valid quotas",
+		},
+		{
+			inputServers:  map[string]string{"unknown": "10"},
+			expectedError: "project unknown has a quota but no token in hcloud_project_tokens",
+			name:          "project without token",
+		},
+		{
+			inputCores:    map[string]string{"spillover": "many"},
+			expectedError: `hcloud_project_quota_cores of project spillover is not a non-negative integer: "many"`,
+			name:          "invalid limit",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := hcloudPluginConfig{
+				ProjectTokens:       map[string]string{"spillover": "token"},
+				ProjectQuotaServers: tc.inputServers,
+				ProjectQuotaCores:   tc.inputCores,
+			}
+			err := config.validateQuotas()
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError, tc.name)
+				return
+			}
+			assert.NoError(t, err, tc.name)
+		})
+	}
+}
+
+func Test_apiQuotaError(t *testing.T) {
+	testCases := []struct {
+		inputMessage   string
+		expectedOutput string
+		name           string
+	}{
+		{
+			inputMessage:   "server limit exceeded",
+			expectedOutput: "project servers limit exceeded, 1 of 3 requested servers were created",
+			name:           "server limit",
+		},
+		{
+			inputMessage:   "core limit exceeded",
+			expectedOutput: "project cores limit exceeded, 1 of 3 requested servers were created",
+			name:           "core limit",
+		},
+		{
+			inputMessage:   "primary_ip limit exceeded",
+			expectedOutput: "project limit exceeded (primary_ip limit exceeded), 1 of 3 requested servers were created",
+			name:           "other limit",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := hcloud.Error{Code: hcloud.ErrorCodeResourceLimitExceeded, Message: tc.inputMessage}
+			assert.EqualError(t, apiQuotaError(err, 3, 1), tc.expectedOutput, tc.name)
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+const (
+	// configHashLabel is the server label holding the hash of the config the
+	// server was created with.
+	configHashLabel = "config-hash"
+
+	// metaKeyRefreshDrifted is the status meta key holding the number of
+	// servers which were created with a different config.
+	metaKeyRefreshDrifted = "hcloud_refresh_drifted"
+
+	// metaKeyRefreshPaused is the status meta key holding the reason the
+	// rolling refreshes and rotations of the group are paused.
+	metaKeyRefreshPaused = "hcloud_refresh_paused"
+)
+
+// refreshState tracks the server replacements of a group, which are rolling
+// refreshes and rotations. A failed replacement pauses further replacements
+// until the config changes.
+type refreshState struct {
+	lastRun    time.Time
+	running    bool
+	configHash string
+	failure    string
+}
+
+// createConfigHash returns a hash of the parts of the config which make up
+// a server, so that servers created with a different config can be told apart.
+// Label values are limited to 63 characters, so the hash is shortened.
+func (tc *hcloudTargetConfig) createConfigHash(userData string) string {
+	hash := sha256.New()
+	if tc.Image != nil {
+		fmt.Fprintf(hash, "image=%d/%s\n", tc.Image.ID, tc.Image.Name)
+	}
+	// In vertical and weighted mode the server type is chosen by scaling and
+	// with automatic server types by price, so only the requirements count.
+	if tc.AutoServerType {
+		fmt.Fprintf(hash, "requirements=%d/%g/%d/%s/%s\n", tc.MinCores, tc.MinMemory, tc.MinDisk, tc.Architecture, tc.CPUType)
+	} else if tc.ServerType != nil && tc.ScalingMode == scalingModeHorizontal {
+		fmt.Fprintf(hash, "server_type=%s\n", tc.ServerType.Name)
+	}
+	if tc.Datacenter != nil {
+		fmt.Fprintf(hash, "datacenter=%s\n", tc.Datacenter.Name)
+	}
+	if tc.Location != nil {
+		fmt.Fprintf(hash, "location=%s\n", tc.Location.Name)
+	}
+	fmt.Fprintf(hash, "user_data=%s\n", userData)
+	return hex.EncodeToString(hash.Sum(nil))[:32]
+}
+
+// driftedServers returns the servers which were not created with the config
+// of the passed hash.
+func driftedServers(servers []*hcloud.Server, hash string) []*hcloud.Server {
+	var drifted []*hcloud.Server
+	for _, server := range servers {
+		if server.Labels[configHashLabel] != hash {
+			drifted = append(drifted, server)
+		}
+	}
+	return drifted
+}
+
+// refreshPaused returns the reason the rolling refresh of the group is paused
+// if it failed with the passed config.
+func (t *TargetPlugin) refreshPaused(groupID string, config map[string]string) (string, bool) {
+	t.refreshLock.Lock()
+	defer t.refreshLock.Unlock()
+
+	state, ok := t.refreshes[groupID]
+	if !ok || state.failure == "" || state.configHash != configHash(config) {
+		return "", false
+	}
+	return state.failure, true
+}
+
+// scheduleRefresh starts a rolling refresh of the group in the background
+// once the refresh interval has passed since the last replacement.
+func (t *TargetPlugin) scheduleRefresh(config map[string]string, targetConfig *hcloudTargetConfig) {
+	if targetConfig.RefreshInterval <= 0 {
+		return
+	}
+	due := func(lastRun time.Time) bool {
+		return time.Since(lastRun) >= targetConfig.RefreshInterval
+	}
+	t.startReplacement(config, targetConfig, due, func(ctx context.Context) error {
+		return t.refreshServers(ctx, config, targetConfig)
+	})
+}
+
+// startReplacement runs the passed replacement of servers of the group in the
+// background if it is due. Only a single replacement runs per group at a time
+// and replacements are paused after a failure until the config changes.
+func (t *TargetPlugin) startReplacement(config map[string]string, targetConfig *hcloudTargetConfig, due func(lastRun time.Time) bool, replace func(ctx context.Context) error) {
+	t.refreshLock.Lock()
+	if t.refreshes == nil {
+		t.refreshes = make(map[string]*refreshState)
+	}
+	state, ok := t.refreshes[targetConfig.GroupID]
+	if !ok {
+		state = &refreshState{}
+		t.refreshes[targetConfig.GroupID] = state
+	}
+	hash := configHash(config)
+	if state.running || !due(state.lastRun) || (state.failure != "" && state.configHash == hash) {
+		t.refreshLock.Unlock()
+		return
+	}
+	state.running = true
+	state.lastRun = time.Now()
+	state.failure = ""
+	t.refreshLock.Unlock()
+
+	go func() {
+		err := replace(withProject(context.Background(), targetConfig.Project))
+
+		t.refreshLock.Lock()
+		defer t.refreshLock.Unlock()
+		state.running = false
+		if err != nil {
+			t.logger.Error("replacing servers failed, pausing replacements until the config changes",
+				"hcloud_group_id", targetConfig.GroupID, "error", err)
+			state.failure = err.Error()
+			state.configHash = hash
+		}
+	}()
+}
+
+// refreshServers replaces the servers of the group which were created with a
+// different config, at most hcloud_refresh_max_unavailable at a time.
+// Drifted servers of the warm pool are deleted to be replenished.
+func (t *TargetPlugin) refreshServers(ctx context.Context, config map[string]string, targetConfig *hcloudTargetConfig) error {
+	log := t.logger.With("action", "refresh", "hcloud_group_id", targetConfig.GroupID)
+
+	userData, err := targetConfig.userData()
+	if err != nil {
+		return err
+	}
+	hash := targetConfig.createConfigHash(userData)
+
+	if targetConfig.WarmPoolSize > 0 {
+		t.refreshWarmPool(ctx, log, targetConfig, hash)
+	}
+
+	selectDrifted := func(servers []*hcloud.Server) []*hcloud.Server {
+		return driftedServers(servers, hash)
+	}
+	return t.replaceServers(ctx, log, config, targetConfig, selectDrifted, targetConfig.MaxUnavailable)
+}
+
+// groupLock returns the lock serialising the scaling actions and server
+// replacements of the group.
+func (t *TargetPlugin) groupLock(groupID string) *sync.Mutex {
+	t.scalingLock.Lock()
+	defer t.scalingLock.Unlock()
+
+	if t.scaling == nil {
+		t.scaling = make(map[string]*sync.Mutex)
+	}
+	lock, ok := t.scaling[groupID]
+	if !ok {
+		lock = &sync.Mutex{}
+		t.scaling[groupID] = lock
+	}
+	return lock
+}
+
+// replaceServers replaces the selected servers of the group, batchSize at a
+// time. For every batch new servers are created and awaited in the Nomad
+// cluster before the old servers are drained and deleted. The replacement
+// stops at the first failed batch. Scaling actions of the group wait for the
+// whole replacement, so that they do not work on the same servers.
+func (t *TargetPlugin) replaceServers(ctx context.Context, log hclog.Logger, config map[string]string, targetConfig *hcloudTargetConfig, selectServers func([]*hcloud.Server) []*hcloud.Server, batchSize int) error {
+	lock := t.groupLock(targetConfig.GroupID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Replaced servers are deleted rather than returned to the warm pool.
+	scaleInConfig := *targetConfig
+	scaleInConfig.WarmPoolScaleIn = false
+
+	for {
+		servers, err := t.getServers(ctx, targetConfig)
+		if err != nil {
+			return fmt.Errorf("failed to get HCloud servers: %v", err)
+		}
+		selected := selectServers(servers)
+		if len(selected) == 0 {
+			return nil
+		}
+		batch := selected[:min(batchSize, len(selected))]
+		log.Info("replacing servers", "batch", len(batch), "remaining", len(selected))
+
+		created, err := t.createServers(ctx, servers, int64(len(servers)+len(batch)), targetConfig)
+		if err == nil {
+			err = t.awaitNomadJoin(ctx, targetConfig, created)
+		}
+		if err != nil {
+			t.discardServers(ctx, log, config, targetConfig, created)
+			return fmt.Errorf("failed to replace servers %s: %v", serverNames(batch), err)
+		}
+
+		if err := t.scaleIn(ctx, batch, int64(len(batch)), config, &scaleInConfig); err != nil {
+			return fmt.Errorf("failed to remove replaced servers %s: %v", serverNames(batch), err)
+		}
+	}
+}
+
+// refreshWarmPool deletes the drifted servers of the warm pool, they are
+// replaced when the pool is replenished.
+func (t *TargetPlugin) refreshWarmPool(ctx context.Context, log hclog.Logger, targetConfig *hcloudTargetConfig, hash string) {
+	pool, err := t.getWarmServers(ctx, targetConfig)
+	if err != nil {
+		log.Error("failed to get warm pool servers", "error", err)
+		return
+	}
+	var drifted []*hcloud.Server
+	for _, server := range driftedServers(pool, hash) {
+		if server.Status == hcloud.ServerStatusOff {
+			drifted = append(drifted, server)
+		}
+	}
+	if len(drifted) == 0 {
+		return
+	}
+	log.Info("deleting drifted warm pool servers", "count", len(drifted))
+	deleted, _ := t.deleteServers(ctx, log, drifted)
+	if len(deleted) > 0 {
+		t.cleanupDeletedServers(ctx, log, targetConfig.warmPoolConfig(), deleted)
+	}
+}
+
+// discardServers deletes new servers which did not come up correctly,
+// together with their resources and DNS records.
+func (t *TargetPlugin) discardServers(ctx context.Context, log hclog.Logger, config map[string]string, targetConfig *hcloudTargetConfig, servers []*hcloud.Server) {
+	if len(servers) == 0 {
+		return
+	}
+	deleted, failures := t.deleteServers(ctx, log, servers)
+	for name, err := range failures {
+		log.Error("failed to delete a HCloud server", "server", name, "error", err)
+	}
+	t.recordDeletes(targetConfig, config, deleted)
+	if len(deleted) > 0 {
+		t.cleanupDeletedServers(ctx, log, targetConfig, deleted)
+	}
+	if err := t.deleteDNSRecords(ctx, targetConfig, deleted); err != nil {
+		log.Error("failed to delete DNS records", "error", err)
+	}
+}
+
+// serverNames returns the comma separated names of the passed servers.
+func serverNames(servers []*hcloud.Server) string {
+	names := make([]string, 0, len(servers))
+	for _, server := range servers {
+		names = append(names, server.Name)
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,121 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_hcloudTargetConfig_createConfigHash(t *testing.T) {
+	base := hcloudTargetConfig{
+		Image:       &hcloud.Image{ID: 1, Name: "ubuntu-22.04"},
+		ServerType:  &hcloud.ServerType{Name: "cx22"},
+		Location:    &hcloud.Location{Name: "fsn1"},
+		ScalingMode: scalingModeHorizontal,
+	}
+	hash := base.createConfigHash("#cloud-config")
+	assert.Len(t, hash, 32)
+	assert.Equal(t, hash, base.createConfigHash("#cloud-config"))
+
+	testCases := []struct {
+		inputConfig   func(tc *hcloudTargetConfig)
+		inputUserData string
+		name          string
+	}{
+		{
+			inputConfig:   func(tc *hcloudTargetConfig) { tc.Image = &hcloud.Image{ID: 2, Name: "snapshot"} },
+			inputUserData: "#cloud-config",
+			name:          "image changed",
+		},
+		{
+			inputConfig:   func(tc *hcloudTargetConfig) { tc.ServerType = &hcloud.ServerType{Name: "cx32"} },
+			inputUserData: "#cloud-config",
+			name:          "server type changed",
+		},
+		{
+			inputConfig:   func(tc *hcloudTargetConfig) {},
+			inputUserData: "#cloud-config\nruncmd: []",
+			name:          "user data changed",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			changed := base
+			tc.inputConfig(&changed)
+			assert.NotEqual(t, hash, changed.createConfigHash(tc.inputUserData), tc.name)
+		})
+	}
+}
+
+func Test_driftedServers(t *testing.T) {
+	servers := []*hcloud.Server{
+		{Name: "nomad-1", Labels: map[string]string{configHashLabel: "new"}},
+		{Name: "nomad-2", Labels: map[string]string{configHashLabel: "old"}},
+		{Name: "nomad-3", Labels: map[string]string{}},
+	}
+	assert.Equal(t, "nomad-2, nomad-3", serverNames(driftedServers(servers, "new")))
+	assert.Empty(t, driftedServers(servers[:1], "new"))
+}
+
+func TestTargetPlugin_refreshPaused(t *testing.T) {
+	config := map[string]string{"hcloud_group_id": "test", "hcloud_image": "old"}
+	tp := TargetPlugin{
+		refreshes: map[string]*refreshState{
+			"test": {configHash: configHash(config), failure: "failed to replace servers nomad-1"},
+		},
+	}
+
+	reason, ok := tp.refreshPaused("test", config)
+	assert.True(t, ok)
+	assert.Equal(t, "failed to replace servers nomad-1", reason)
+
+	_, ok = tp.refreshPaused("test", map[string]string{"hcloud_group_id": "test", "hcloud_image": "new"})
+	assert.False(t, ok, "config changed")
+
+	_, ok = tp.refreshPaused("other", config)
+	assert.False(t, ok, "unknown group")
+}
+
+func TestTargetPlugin_replaceServers_groupLock(t *testing.T) {
+	var listed atomic.Bool
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /servers", func(w http.ResponseWriter, r *http.Request) {
+		listed.Store(true)
+		writeJSON(w, schema.ServerListResponse{})
+	})
+	tp := TargetPlugin{
+		logger: hclog.NewNullLogger(),
+		config: hcloudPluginConfig{GroupIDLabelSelector: "group-id"},
+		hcloud: newTestHCloudClient(t, mux),
+	}
+	targetConfig := &hcloudTargetConfig{GroupID: "test"}
+	assert.Same(t, tp.groupLock("test"), tp.groupLock("test"))
+	assert.NotSame(t, tp.groupLock("test"), tp.groupLock("other"))
+
+	// A running scaling action holds the lock of the group.
+	lock := tp.groupLock("test")
+	lock.Lock()
+	done := make(chan error)
+	go func() {
+		done <- tp.replaceServers(context.Background(), tp.logger, nil, targetConfig, func([]*hcloud.Server) []*hcloud.Server { return nil }, 1)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("replacement did not wait for the scaling action")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.False(t, listed.Load())
+
+	lock.Unlock()
+	assert.NoError(t, <-done)
+	assert.True(t, listed.Load())
+}
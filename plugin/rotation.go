@@ -0,0 +1,62 @@
+package plugin
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// metaKeyNextRotation is the status meta key holding the time the oldest
+// server of the group reaches the maximum server age.
+const metaKeyNextRotation = "hcloud_next_rotation"
+
+// expiredServers returns the servers which are older than the maximum age,
+// the oldest first.
+func expiredServers(servers []*hcloud.Server, maxAge time.Duration, now time.Time) []*hcloud.Server {
+	var expired []*hcloud.Server
+	for _, server := range servers {
+		if now.Sub(server.Created) >= maxAge {
+			expired = append(expired, server)
+		}
+	}
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].Created.Before(expired[j].Created)
+	})
+	return expired
+}
+
+// nextRotation returns the time the oldest of the passed servers reaches the
+// maximum age. The zero time is returned if there are no servers.
+func nextRotation(servers []*hcloud.Server, maxAge time.Duration) time.Time {
+	var next time.Time
+	for _, server := range servers {
+		if expires := server.Created.Add(maxAge); next.IsZero() || expires.Before(next) {
+			next = expires
+		}
+	}
+	return next
+}
+
+// scheduleRotation starts replacing the servers of the group which exceed the
+// maximum server age in the background, one server at a time.
+func (t *TargetPlugin) scheduleRotation(config map[string]string, targetConfig *hcloudTargetConfig, servers []*hcloud.Server) {
+	if targetConfig.MaxServerAge <= 0 || len(expiredServers(servers, targetConfig.MaxServerAge, time.Now())) == 0 {
+		return
+	}
+	due := func(time.Time) bool { return true }
+	t.startReplacement(config, targetConfig, due, func(ctx context.Context) error {
+		return t.rotateServers(ctx, config, targetConfig)
+	})
+}
+
+// rotateServers replaces the servers of the group which exceed the maximum
+// server age with a surge of a single server.
+func (t *TargetPlugin) rotateServers(ctx context.Context, config map[string]string, targetConfig *hcloudTargetConfig) error {
+	log := t.logger.With("action", "rotate", "hcloud_group_id", targetConfig.GroupID)
+	selectExpired := func(servers []*hcloud.Server) []*hcloud.Server {
+		return expiredServers(servers, targetConfig.MaxServerAge, time.Now())
+	}
+	return t.replaceServers(ctx, log, config, targetConfig, selectExpired, 1)
+}
@@ -0,0 +1,52 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_expiredServers(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	servers := []*hcloud.Server{
+		{Name: "nomad-1", Created: now.Add(-15 * 24 * time.Hour)},
+		{Name: "nomad-2", Created: now.Add(-time.Hour)},
+		{Name: "nomad-3", Created: now.Add(-20 * 24 * time.Hour)},
+		{Name: "nomad-4", Created: now.Add(-14 * 24 * time.Hour)},
+	}
+
+	testCases := []struct {
+		inputMaxAge   time.Duration
+		expectedNames string
+		name          string
+	}{
+		{
+			inputMaxAge:   14 * 24 * time.Hour,
+			expectedNames: "nomad-3, nomad-1, nomad-4",
+			name:          "oldest first",
+		},
+		{
+			inputMaxAge:   30 * 24 * time.Hour,
+			expectedNames: "",
+			name:          "no expired servers",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedNames, serverNames(expiredServers(servers, tc.inputMaxAge, now)), tc.name)
+		})
+	}
+}
+
+func Test_nextRotation(t *testing.T) {
+	created := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	servers := []*hcloud.Server{
+		{Name: "nomad-1", Created: created.Add(time.Hour)},
+		{Name: "nomad-2", Created: created},
+	}
+	assert.Equal(t, created.Add(14*24*time.Hour), nextRotation(servers, 14*24*time.Hour))
+	assert.True(t, nextRotation(nil, time.Hour).IsZero())
+}
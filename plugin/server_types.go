@@ -0,0 +1,126 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+const (
+	// serverTypeCacheTTL is the time server types and their prices are cached
+	// for.
+	serverTypeCacheTTL = time.Hour
+
+	// serverTypeLabel and hourlyPriceLabel are the labels recording the server
+	// type chosen for a server and its hourly price.
+	serverTypeLabel  = "server-type"
+	hourlyPriceLabel = "hourly-price"
+)
+
+// serverTypeCache holds the server types together with their location prices.
+type serverTypeCache struct {
+	fetched time.Time
+	types   []*hcloud.ServerType
+}
+
+// availableServerTypes returns all server types with their location prices
+// from the Pricing API. The result is cached for serverTypeCacheTTL.
+func (t *TargetPlugin) availableServerTypes(ctx context.Context) ([]*hcloud.ServerType, error) {
+	t.serverTypesLock.Lock()
+	defer t.serverTypesLock.Unlock()
+
+	if time.Since(t.serverTypes.fetched) < serverTypeCacheTTL {
+		return t.serverTypes.types, nil
+	}
+
+	types, err := t.client(ctx).ServerType.All(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list server types: %v", err)
+	}
+	pricing, _, err := t.client(ctx).Pricing.Get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get pricing: %v", err)
+	}
+	prices := make(map[string][]hcloud.ServerTypeLocationPricing, len(pricing.ServerTypes))
+	for _, serverTypePricing := range pricing.ServerTypes {
+		if serverTypePricing.ServerType != nil {
+			prices[serverTypePricing.ServerType.Name] = serverTypePricing.Pricings
+		}
+	}
+	for _, serverType := range types {
+		if locationPrices, ok := prices[serverType.Name]; ok {
+			serverType.Pricings = locationPrices
+		}
+	}
+
+	t.serverTypes = serverTypeCache{fetched: time.Now(), types: types}
+	return types, nil
+}
+
+// serverTypeArchitecture returns the architecture server types have to be of,
+// which is the configured one or else the one of the image.
+func (tc *hcloudTargetConfig) serverTypeArchitecture() hcloud.Architecture {
+	if tc.Architecture != "" {
+		return hcloud.Architecture(tc.Architecture)
+	}
+	if tc.Image != nil {
+		return tc.Image.Architecture
+	}
+	return ""
+}
+
+// qualifies returns whether the server type meets the minimum requirements of
+// the config.
+func (tc *hcloudTargetConfig) qualifies(serverType *hcloud.ServerType) bool {
+	if serverType.IsDeprecated() {
+		return false
+	}
+	if serverType.Cores < tc.MinCores || serverType.Memory < tc.MinMemory || serverType.Disk < tc.MinDisk {
+		return false
+	}
+	if arch := tc.serverTypeArchitecture(); arch != "" && serverType.Architecture != arch {
+		return false
+	}
+	if tc.CPUType != "" && serverType.CPUType != hcloud.CPUType(tc.CPUType) {
+		return false
+	}
+	return true
+}
+
+// cheapestServerType returns the cheapest server type in the location of the
+// group meeting the minimum requirements together with its hourly price.
+func (t *TargetPlugin) cheapestServerType(ctx context.Context, targetConfig *hcloudTargetConfig) (*hcloud.ServerType, float64, error) {
+	types, err := t.availableServerTypes(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		cheapest      *hcloud.ServerType
+		cheapestPrice float64
+	)
+	for _, serverType := range types {
+		if !targetConfig.qualifies(serverType) {
+			continue
+		}
+		price, err := hourlyPrice(serverType, targetConfig.targetLocation())
+		if err != nil {
+			continue
+		}
+		if cheapest == nil || price < cheapestPrice || (price == cheapestPrice && serverType.Name < cheapest.Name) {
+			cheapest, cheapestPrice = serverType, price
+		}
+	}
+	if cheapest == nil {
+		return nil, 0, fmt.Errorf("no server type in the location of the group meets the requirements")
+	}
+	return cheapest, cheapestPrice, nil
+}
+
+// formatPrice formats a price as label value.
+func formatPrice(price float64) string {
+	return strconv.FormatFloat(price, 'f', -1, 64)
+}
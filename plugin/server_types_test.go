@@ -0,0 +1,100 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetPlugin_cheapestServerType(t *testing.T) {
+	serverTypes := []schema.ServerType{
+		{ID: 1, Name: "cx22", Cores: 2, Memory: 4, Disk: 40, CPUType: "shared", Architecture: "x86"},
+		{ID: 2, Name: "cax11", Cores: 2, Memory: 4, Disk: 40, CPUType: "shared", Architecture: "arm"},
+		{ID: 3, Name: "cx32", Cores: 4, Memory: 8, Disk: 80, CPUType: "shared", Architecture: "x86"},
+		{ID: 4, Name: "ccx13", Cores: 2, Memory: 8, Disk: 80, CPUType: "dedicated", Architecture: "x86"},
+		{ID: 5, Name: "cpx21", Cores: 3, Memory: 4, Disk: 80, CPUType: "shared", Architecture: "x86"},
+	}
+	prices := map[string]string{"cx22": "0.0071", "cax11": "0.0063", "cx32": "0.0113", "ccx13": "0.0238", "cpx21": "0.0136"}
+
+	testCases := []struct {
+		inputConfig   hcloudTargetConfig
+		expectedType  string
+		expectedPrice float64
+		expectedError string
+		name          string
+	}{
+		{
+			inputConfig:   hcloudTargetConfig{MinCores: 2, Image: &hcloud.Image{Architecture: hcloud.ArchitectureX86}},
+			expectedType:  "cx22",
+			expectedPrice: 0.0071,
+			name:          "cheapest for image architecture",
+		},
+		{
+			inputConfig:   hcloudTargetConfig{MinCores: 2, Architecture: "arm"},
+			expectedType:  "cax11",
+			expectedPrice: 0.0063,
+			name:          "configured architecture",
+		},
+		{
+			inputConfig:   hcloudTargetConfig{MinCores: 3, MinDisk: 60},
+			expectedType:  "cx32",
+			expectedPrice: 0.0113,
+			name:          "cheaper larger type",
+		},
+		{
+			inputConfig:   hcloudTargetConfig{MinMemory: 8, CPUType: "dedicated"},
+			expectedType:  "ccx13",
+			expectedPrice: 0.0238,
+			name:          "dedicated CPU",
+		},
+		{
+			inputConfig:   hcloudTargetConfig{MinCores: 64},
+			expectedError: "no server type in the location of the group meets the requirements",
+			name:          "no qualifying type",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests atomic.Int32
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /server_types", func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				writeJSON(w, schema.ServerTypeListResponse{ServerTypes: serverTypes})
+			})
+			mux.HandleFunc("GET /pricing", func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				var pricing schema.Pricing
+				for _, serverType := range serverTypes {
+					pricing.ServerTypes = append(pricing.ServerTypes, schema.PricingServerType{
+						ID:     serverType.ID,
+						Name:   serverType.Name,
+						Prices: []schema.PricingServerTypePrice{{Location: "fsn1", PriceHourly: schema.Price{Gross: prices[serverType.Name]}}},
+					})
+				}
+				writeJSON(w, schema.PricingGetResponse{Pricing: pricing})
+			})
+
+			tp := TargetPlugin{hcloud: newTestHCloudClient(t, mux)}
+			targetConfig := tc.inputConfig
+			targetConfig.Location = &hcloud.Location{Name: "fsn1"}
+
+			for i := 0; i < 2; i++ {
+				serverType, price, err := tp.cheapestServerType(context.Background(), &targetConfig)
+				if tc.expectedError != "" {
+					assert.EqualError(t, err, tc.expectedError, tc.name)
+					continue
+				}
+				assert.NoError(t, err, tc.name)
+				assert.Equal(t, tc.expectedType, serverType.Name, tc.name)
+				assert.Equal(t, tc.expectedPrice, price, tc.name)
+			}
+			assert.Equal(t, int32(2), requests.Load(), "server types and prices are cached")
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package plugin
+
+import (
+	"context"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// shutdownPollInterval is the interval the status of servers being shut down
+// is polled in.
+const shutdownPollInterval = 5 * time.Second
+
+// shutdownServers gracefully shuts down the operating systems of the passed
+// servers by sending an ACPI shutdown request, so that services get the chance
+// to stop cleanly before the servers are deleted. Servers which are not off
+// once the shutdown timeout has passed are powered off. Failures are logged
+// only, as the servers are deleted afterwards anyway.
+func (t *TargetPlugin) shutdownServers(ctx context.Context, log hclog.Logger, targetConfig *hcloudTargetConfig, servers []*hcloud.Server) {
+	if targetConfig.ShutdownTimeout <= 0 || len(servers) == 0 {
+		return
+	}
+
+	var actionIDs []int64
+	running := make(map[int64]*hcloud.Server)
+	for _, server := range servers {
+		if server.Status == hcloud.ServerStatusOff {
+			continue
+		}
+		action, _, err := t.client(ctx).Server.Shutdown(ctx, server)
+		if err != nil {
+			log.Warn("failed to shut down a HCloud server", "server", server.Name, "error", err)
+		} else {
+			actionIDs = append(actionIDs, action.ID)
+			log.Info("shutting down HCloud server", "server", server.Name)
+		}
+		running[server.ID] = server
+	}
+	if err := t.waitForActions(ctx, actionIDs); err != nil {
+		log.Warn("failed to wait till all HCloud shutdown actions are ready", "error", err)
+	}
+
+	t.waitForServersOff(ctx, log, running, targetConfig.ShutdownTimeout)
+
+	var remaining []*hcloud.Server
+	for _, server := range running {
+		log.Warn("HCloud server did not shut down in time, powering it off",
+			"server", server.Name, "timeout", targetConfig.ShutdownTimeout)
+		remaining = append(remaining, server)
+	}
+	t.powerOffServers(ctx, log, remaining)
+}
+
+// stopServers stops the passed servers, gracefully if a shutdown timeout is
+// configured and by cutting the power otherwise.
+func (t *TargetPlugin) stopServers(ctx context.Context, log hclog.Logger, targetConfig *hcloudTargetConfig, servers []*hcloud.Server) {
+	if targetConfig.ShutdownTimeout > 0 {
+		t.shutdownServers(ctx, log, targetConfig, servers)
+		return
+	}
+	t.powerOffServers(ctx, log, servers)
+}
+
+// powerOffServers cuts the power of the passed servers and waits for them to
+// be off.
+func (t *TargetPlugin) powerOffServers(ctx context.Context, log hclog.Logger, servers []*hcloud.Server) {
+	var actionIDs []int64
+	for _, server := range servers {
+		action, _, err := t.client(ctx).Server.Poweroff(ctx, server)
+		if err != nil {
+			log.Warn("failed to power off a HCloud server", "server", server.Name, "error", err)
+			continue
+		}
+		actionIDs = append(actionIDs, action.ID)
+	}
+	if err := t.waitForActions(ctx, actionIDs); err != nil {
+		log.Warn("failed to wait till all HCloud power off actions are ready", "error", err)
+	}
+}
+
+// waitForServersOff waits until the passed servers are off or the timeout has
+// passed. Servers which are off are removed from the passed map.
+func (t *TargetPlugin) waitForServersOff(ctx context.Context, log hclog.Logger, servers map[int64]*hcloud.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for id, server := range servers {
+			current, _, err := t.client(ctx).Server.GetByID(ctx, id)
+			if err != nil {
+				log.Warn("failed to get HCloud server status", "server", server.Name, "error", err)
+				continue
+			}
+			if current == nil || current.Status == hcloud.ServerStatusOff {
+				delete(servers, id)
+			}
+		}
+		if len(servers) == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetPlugin_shutdownServers(t *testing.T) {
+	testCases := []struct {
+		inputTimeout      time.Duration
+		inputStatus       map[string]string
+		expectedShutdowns []string
+		expectedPoweroffs []string
+		name              string
+	}{
+		{
+			inputTimeout:      50 * time.Millisecond,
+			inputStatus:       map[string]string{"1": "off", "2": "running"},
+			expectedShutdowns: []string{"1", "2"},
+			expectedPoweroffs: []string{"2"},
+			name:              "power off after timeout",
+		},
+		{
+			inputTimeout:      50 * time.Millisecond,
+			inputStatus:       map[string]string{"1": "off", "2": "off"},
+			expectedShutdowns: []string{"1", "2"},
+			name:              "graceful shutdown",
+		},
+		{
+			inputStatus: map[string]string{"1": "running", "2": "running"},
+			name:        "shutdown disabled",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				lock      sync.Mutex
+				shutdowns []string
+				poweroffs []string
+			)
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("POST /servers/{id}/actions/shutdown", func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				shutdowns = append(shutdowns, r.PathValue("id"))
+				lock.Unlock()
+				w.WriteHeader(http.StatusCreated)
+				writeJSON(w, schema.ServerActionShutdownResponse{Action: schema.Action{ID: 1, Status: "success", Progress: 100}})
+			})
+			mux.HandleFunc("POST /servers/{id}/actions/poweroff", func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				poweroffs = append(poweroffs, r.PathValue("id"))
+				lock.Unlock()
+				w.WriteHeader(http.StatusCreated)
+				writeJSON(w, schema.ServerActionPoweroffResponse{Action: schema.Action{ID: 2, Status: "success", Progress: 100}})
+			})
+			mux.HandleFunc("GET /servers/{id}", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, schema.ServerGetResponse{Server: schema.Server{Name: "nomad-" + r.PathValue("id"), Status: tc.inputStatus[r.PathValue("id")]}})
+			})
+			mux.HandleFunc("GET /actions", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, schema.ActionListResponse{Actions: []schema.Action{{ID: 1, Status: "success", Progress: 100}}})
+			})
+
+			tp := TargetPlugin{
+				logger: hclog.NewNullLogger(),
+				hcloud: newTestHCloudClient(t, mux),
+			}
+			targetConfig := &hcloudTargetConfig{GroupID: "test", ShutdownTimeout: tc.inputTimeout}
+			servers := []*hcloud.Server{
+				{ID: 1, Name: "nomad-1", Status: hcloud.ServerStatusRunning},
+				{ID: 2, Name: "nomad-2", Status: hcloud.ServerStatusRunning},
+			}
+
+			tp.shutdownServers(context.Background(), tp.logger, targetConfig, servers)
+			assert.ElementsMatch(t, tc.expectedShutdowns, shutdowns, tc.name)
+			assert.ElementsMatch(t, tc.expectedPoweroffs, poweroffs, tc.name)
+		})
+	}
+}
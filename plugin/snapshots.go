@@ -0,0 +1,272 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+	"github.com/hashicorp/nomad/api"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+const (
+	// snapshotNever never snapshots servers before they are deleted.
+	snapshotNever = "never"
+
+	// snapshotAlways snapshots every server before it is deleted.
+	snapshotAlways = "always"
+
+	// snapshotUnhealthy snapshots servers whose Nomad node is down or has
+	// failed allocations before they are deleted.
+	snapshotUnhealthy = "unhealthy"
+
+	// snapshotNodeIDLabel is the snapshot label key holding the ID of the
+	// Nomad node of the server.
+	snapshotNodeIDLabel = "nomad-node-id"
+
+	// snapshotCreatedLabel is the snapshot label key holding the Unix time the
+	// snapshot was taken at.
+	snapshotCreatedLabel = "snapshot-created"
+
+	// unhealthyAllocWindow is the time a failed allocation which has been
+	// replaced still marks its node unhealthy.
+	unhealthyAllocWindow = time.Hour
+)
+
+// snapshotsEnabled returns whether servers may be snapshotted before they are
+// deleted.
+func (tc *hcloudTargetConfig) snapshotsEnabled() bool {
+	return tc.SnapshotBeforeDelete != snapshotNever
+}
+
+// preScaleInTasks identifies, selects and drains the Nomad nodes to remove,
+// the same as RunPreScaleInTasksWithRemoteCheck. When unhealthy servers are
+// snapshotted, the health of the selected nodes is checked in between, as the
+// drain and the shutdown change the state of the nodes. The health is
+// returned keyed by server name.
+func (t *TargetPlugin) preScaleInTasks(ctx context.Context, log hclog.Logger, config map[string]string, targetConfig *hcloudTargetConfig, remoteIDs []string, count int64) ([]scaleutils.NodeResourceID, map[string]bool, error) {
+	if targetConfig.SnapshotBeforeDelete != snapshotUnhealthy {
+		nodes, err := t.clusterUtils.RunPreScaleInTasksWithRemoteCheck(ctx, config, remoteIDs, int(count))
+		return nodes, nil, err
+	}
+
+	stubs, err := t.clusterUtils.IdentifyScaleInNodes(config, int(count))
+	if err != nil {
+		return nil, nil, err
+	}
+	ids, err := t.clusterUtils.IdentifyScaleInRemoteIDs(stubs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remote := make(map[string]struct{}, len(remoteIDs))
+	for _, id := range remoteIDs {
+		remote[id] = struct{}{}
+	}
+	stubsByID := make(map[string]*api.NodeListStub, len(stubs))
+	for _, stub := range stubs {
+		stubsByID[stub.ID] = stub
+	}
+	idsByNode := make(map[string]scaleutils.NodeResourceID, len(ids))
+	var filtered []*api.NodeListStub
+	for _, id := range ids {
+		if _, ok := remote[id.RemoteResourceID]; ok {
+			idsByNode[id.NomadNodeID] = id
+			filtered = append(filtered, stubsByID[id.NomadNodeID])
+		}
+	}
+	if len(filtered) == 0 {
+		return nil, nil, fmt.Errorf("no nodes identified for scaling in action")
+	}
+	if int(count) > len(filtered) {
+		log.Warn("can only identify portion of requested nodes for removal", "requested", count, "available", len(filtered))
+	}
+
+	selected, err := t.clusterUtils.SelectScaleInNodes(filtered, config, int(count))
+	if err != nil {
+		return nil, nil, err
+	}
+	nodes := make([]scaleutils.NodeResourceID, 0, len(selected))
+	for _, stub := range selected {
+		nodes = append(nodes, idsByNode[stub.ID])
+	}
+
+	unhealthy := t.unhealthyServers(ctx, log, nodes)
+	if err := t.clusterUtils.DrainNodes(ctx, config, nodes); err != nil {
+		return nil, nil, err
+	}
+	return nodes, unhealthy, nil
+}
+
+// unhealthyServers returns whether the Nomad node of each of the passed nodes
+// is unhealthy, keyed by server name. Servers whose node health is unknown
+// count as unhealthy, so that they are snapshotted.
+func (t *TargetPlugin) unhealthyServers(ctx context.Context, log hclog.Logger, nodes []scaleutils.NodeResourceID) map[string]bool {
+	unhealthy := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		nodeUnhealthy, err := t.nomadNodeUnhealthy(ctx, node.NomadNodeID, time.Now())
+		if err != nil {
+			log.Warn("failed to check Nomad node health, taking snapshot", "server", node.RemoteResourceID, "node_id", node.NomadNodeID, "error", err)
+			nodeUnhealthy = true
+		}
+		unhealthy[node.RemoteResourceID] = nodeUnhealthy
+	}
+	return unhealthy
+}
+
+// snapshotServers takes a snapshot of the passed servers before they are
+// deleted and waits for the snapshots to be created. In unhealthy mode only
+// the servers marked in the passed health, checked before the drain, are
+// snapshotted. The servers whose snapshot failed are returned, they should be
+// kept so that they can still be investigated.
+func (t *TargetPlugin) snapshotServers(ctx context.Context, log hclog.Logger, targetConfig *hcloudTargetConfig, servers []*hcloud.Server, nodes []scaleutils.NodeResourceID, unhealthy map[string]bool) map[string]error {
+	failures := make(map[string]error)
+	if !targetConfig.snapshotsEnabled() {
+		return failures
+	}
+
+	nodeIDs := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		nodeIDs[node.RemoteResourceID] = node.NomadNodeID
+	}
+
+	actions := make(map[int64]*hcloud.Server)
+	var actionIDs []int64
+	for _, server := range servers {
+		nodeID := nodeIDs[server.Name]
+		if targetConfig.SnapshotBeforeDelete == snapshotUnhealthy && !unhealthy[server.Name] {
+			continue
+		}
+
+		now := time.Now()
+		labels := map[string]string{
+			t.config.GroupIDLabelSelector: targetConfig.GroupID,
+			snapshotNodeIDLabel:           nodeID,
+			snapshotCreatedLabel:          strconv.FormatInt(now.Unix(), 10),
+		}
+		description := fmt.Sprintf("%s before scale in at %s", server.Name, now.UTC().Format(time.RFC3339))
+		result, _, err := t.client(ctx).Server.CreateImage(ctx, server, &hcloud.ServerCreateImageOpts{
+			Type:        hcloud.ImageTypeSnapshot,
+			Description: &description,
+			Labels:      labels,
+		})
+		if err != nil {
+			log.Error("failed to snapshot a HCloud server", "server", server.Name, "error", err)
+			failures[server.Name] = fmt.Errorf("failed to snapshot server: %v", err)
+			continue
+		}
+		log.Info("taking snapshot of HCloud server", "server", server.Name, "node_id", nodeID, "image_id", result.Image.ID)
+		if result.Action != nil {
+			actions[result.Action.ID] = server
+			actionIDs = append(actionIDs, result.Action.ID)
+		}
+	}
+
+	if len(actionIDs) > 0 {
+		_, failed, err := t.ensureActionsComplete(ctx, actionIDs)
+		if err != nil {
+			for _, server := range actions {
+				failures[server.Name] = fmt.Errorf("failed to wait for snapshot: %v", err)
+			}
+		}
+		for _, id := range failed {
+			failures[actions[id].Name] = fmt.Errorf("snapshot action %d failed", id)
+		}
+	}
+
+	if err := t.pruneSnapshots(ctx, log, targetConfig); err != nil {
+		log.Error("failed to prune snapshots", "error", err)
+	}
+	return failures
+}
+
+// nomadNodeUnhealthy returns whether the Nomad node is down or has failed
+// allocations. Failed allocations only count while they are still meant to
+// run on the node or failed within the unhealthy window, so that the node
+// recovers once they have been replaced.
+func (t *TargetPlugin) nomadNodeUnhealthy(ctx context.Context, nodeID string, now time.Time) (bool, error) {
+	opts := (&api.QueryOptions{}).WithContext(ctx)
+	node, _, err := t.nomad.Nodes().Info(nodeID, opts)
+	if err != nil {
+		return false, fmt.Errorf("failed to get Nomad node: %v", err)
+	}
+	if node.Status == api.NodeStatusDown {
+		return true, nil
+	}
+
+	allocs, _, err := t.nomad.Nodes().Allocations(nodeID, opts)
+	if err != nil {
+		return false, fmt.Errorf("failed to list Nomad node allocations: %v", err)
+	}
+	cutoff := now.Add(-unhealthyAllocWindow).UnixNano()
+	for _, alloc := range allocs {
+		if alloc.ClientStatus != api.AllocClientStatusFailed {
+			continue
+		}
+		if alloc.DesiredStatus == api.AllocDesiredStatusRun || alloc.ModifyTime >= cutoff {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// pruneSnapshots deletes the snapshots of the group which are neither among
+// the newest snapshots to keep nor younger than the retention days. All
+// snapshots are kept when no retention is configured.
+func (t *TargetPlugin) pruneSnapshots(ctx context.Context, log hclog.Logger, targetConfig *hcloudTargetConfig) error {
+	if targetConfig.SnapshotRetainCount == 0 && targetConfig.SnapshotRetainDays == 0 {
+		return nil
+	}
+
+	snapshots, err := t.getSnapshots(ctx, targetConfig)
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range targetConfig.expiredSnapshots(snapshots, time.Now()) {
+		if _, err := t.client(ctx).Image.Delete(ctx, snapshot); err != nil {
+			return fmt.Errorf("failed to delete snapshot %d: %v", snapshot.ID, err)
+		}
+		log.Info("deleted expired snapshot", "image_id", snapshot.ID, "node_id", snapshot.Labels[snapshotNodeIDLabel])
+	}
+	return nil
+}
+
+// expiredSnapshots returns the snapshots which fall out of the retention
+// policy.
+func (tc *hcloudTargetConfig) expiredSnapshots(snapshots []*hcloud.Image, now time.Time) []*hcloud.Image {
+	sorted := append([]*hcloud.Image{}, snapshots...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Created.After(sorted[j].Created) })
+
+	cutoff := now.AddDate(0, 0, -tc.SnapshotRetainDays)
+	var expired []*hcloud.Image
+	for i, snapshot := range sorted {
+		if tc.SnapshotRetainCount > 0 && i < tc.SnapshotRetainCount {
+			continue
+		}
+		if tc.SnapshotRetainDays > 0 && snapshot.Created.After(cutoff) {
+			continue
+		}
+		expired = append(expired, snapshot)
+	}
+	return expired
+}
+
+// getSnapshots returns the snapshots taken of servers of the group.
+func (t *TargetPlugin) getSnapshots(ctx context.Context, targetConfig *hcloudTargetConfig) ([]*hcloud.Image, error) {
+	opts := hcloud.ImageListOpts{
+		ListOpts: hcloud.ListOpts{
+			LabelSelector: fmt.Sprintf("%s=%s,%s", t.config.GroupIDLabelSelector, targetConfig.GroupID, snapshotNodeIDLabel),
+			PerPage:       t.config.ItemsPerPage,
+		},
+		Type: []hcloud.ImageType{hcloud.ImageTypeSnapshot},
+	}
+	snapshots, err := t.client(ctx).Image.AllWithOpts(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %v", err)
+	}
+	return snapshots, nil
+}
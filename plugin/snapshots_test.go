@@ -0,0 +1,197 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad-autoscaler/sdk/helper/scaleutils"
+	"github.com/hashicorp/nomad/api"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_hcloudTargetConfig_expiredSnapshots(t *testing.T) {
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	snapshots := []*hcloud.Image{
+		{ID: 1, Created: now.AddDate(0, 0, -10)},
+		{ID: 2, Created: now.AddDate(0, 0, -1)},
+		{ID: 3, Created: now.AddDate(0, 0, -5)},
+		{ID: 4, Created: now.AddDate(0, 0, -3)},
+	}
+
+	testCases := []struct {
+		inputCount     int
+		inputDays      int
+		expectedOutput []int64
+		name           string
+	}{
+		{
+			inputCount:     2,
+			expectedOutput: []int64{3, 1},
+			name:           "keep last N",
+		},
+		{
+			inputDays:      4,
+			expectedOutput: []int64{3, 1},
+			name:           "keep last D days",
+		},
+		{
+			inputCount:     3,
+			inputDays:      2,
+			expectedOutput: []int64{1},
+			name:           "keep last N or D days",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			targetConfig := hcloudTargetConfig{SnapshotRetainCount: tc.inputCount, SnapshotRetainDays: tc.inputDays}
+			var actualOutput []int64
+			for _, snapshot := range targetConfig.expiredSnapshots(snapshots, now) {
+				actualOutput = append(actualOutput, snapshot.ID)
+			}
+			assert.Equal(t, tc.expectedOutput, actualOutput, tc.name)
+		})
+	}
+}
+
+func TestTargetPlugin_nomadNodeUnhealthy(t *testing.T) {
+	now := time.Now()
+	testCases := []struct {
+		inputStatus    string
+		inputAllocs    []*api.AllocationListStub
+		expectedOutput bool
+		name           string
+	}{
+		{
+			inputStatus:    api.NodeStatusReady,
+			inputAllocs:    []*api.AllocationListStub{{ClientStatus: api.AllocClientStatusComplete}},
+			expectedOutput: false,
+			name:           "healthy node",
+		},
+		{
+			inputStatus:    api.NodeStatusDown,
+			expectedOutput: true,
+			name:           "down node",
+		},
+		{
+			inputStatus: api.NodeStatusReady,
+			inputAllocs: []*api.AllocationListStub{{ClientStatus: api.AllocClientStatusFailed,
+				DesiredStatus: api.AllocDesiredStatusRun, ModifyTime: now.Add(-24 * time.Hour).UnixNano()}},
+			expectedOutput: true,
+			name:           "failed allocation",
+		},
+		{
+			inputStatus: api.NodeStatusReady,
+			inputAllocs: []*api.AllocationListStub{{ClientStatus: api.AllocClientStatusFailed,
+				DesiredStatus: api.AllocDesiredStatusStop, ModifyTime: now.Add(-10 * time.Minute).UnixNano()}},
+			expectedOutput: true,
+			name:           "recently replaced failed allocation",
+		},
+		{
+			inputStatus: api.NodeStatusReady,
+			inputAllocs: []*api.AllocationListStub{{ClientStatus: api.AllocClientStatusFailed,
+				DesiredStatus: api.AllocDesiredStatusStop, ModifyTime: now.Add(-2 * time.Hour).UnixNano()}},
+			expectedOutput: false,
+			name:           "long replaced failed allocation",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /v1/node/node-1", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, &api.Node{ID: "node-1", Status: tc.inputStatus})
+			})
+			mux.HandleFunc("GET /v1/node/node-1/allocations", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, tc.inputAllocs)
+			})
+			srv := httptest.NewServer(mux)
+			t.Cleanup(srv.Close)
+			nomadClient, err := api.NewClient(&api.Config{Address: srv.URL})
+			assert.NoError(t, err)
+
+			tp := TargetPlugin{nomad: nomadClient}
+			actualOutput, err := tp.nomadNodeUnhealthy(context.Background(), "node-1", now)
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.expectedOutput, actualOutput, tc.name)
+		})
+	}
+}
+
+func TestTargetPlugin_unhealthyServers(t *testing.T) {
+	nodes := map[string]*api.Node{
+		"node-1": {ID: "node-1", Status: api.NodeStatusReady},
+		"node-2": {ID: "node-2", Status: api.NodeStatusReady},
+	}
+	var checked []string
+	nomadMux := http.NewServeMux()
+	nomadMux.HandleFunc("GET /v1/node/{id}", func(w http.ResponseWriter, r *http.Request) {
+		checked = append(checked, r.PathValue("id"))
+		node, ok := nodes[r.PathValue("id")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, node)
+	})
+	nomadMux.HandleFunc("GET /v1/node/{id}/allocations", func(w http.ResponseWriter, r *http.Request) {
+		status := api.AllocClientStatusComplete
+		if r.PathValue("id") == "node-2" {
+			status = api.AllocClientStatusFailed
+		}
+		writeJSON(w, []*api.AllocationListStub{{ClientStatus: status, DesiredStatus: api.AllocDesiredStatusRun}})
+	})
+	srv := httptest.NewServer(nomadMux)
+	t.Cleanup(srv.Close)
+	nomadClient, err := api.NewClient(&api.Config{Address: srv.URL})
+	assert.NoError(t, err)
+
+	var snapshotted []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /servers/{id}/actions/create_image", func(w http.ResponseWriter, r *http.Request) {
+		snapshotted = append(snapshotted, r.PathValue("id"))
+		writeJSON(w, schema.ServerActionCreateImageResponse{
+			Action: schema.Action{ID: 1, Status: "success", Progress: 100},
+			Image:  schema.Image{ID: 1},
+		})
+	})
+	mux.HandleFunc("GET /actions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, schema.ActionListResponse{Actions: []schema.Action{{ID: 1, Status: "success", Progress: 100}}})
+	})
+
+	tp := TargetPlugin{
+		logger: hclog.NewNullLogger(),
+		config: hcloudPluginConfig{GroupIDLabelSelector: "group-id", NodeAttrID: "unique.hostname"},
+		nomad:  nomadClient,
+		hcloud: newTestHCloudClient(t, mux),
+	}
+	targetConfig := &hcloudTargetConfig{GroupID: "nomad", SnapshotBeforeDelete: snapshotUnhealthy}
+	servers := []*hcloud.Server{
+		{ID: 1, Name: "nomad-1"},
+		{ID: 2, Name: "nomad-2"},
+		{ID: 3, Name: "nomad-3"},
+	}
+	selected := []scaleutils.NodeResourceID{
+		{NomadNodeID: "node-1", RemoteResourceID: "nomad-1"},
+		{NomadNodeID: "node-2", RemoteResourceID: "nomad-2"},
+		{NomadNodeID: "node-3", RemoteResourceID: "nomad-3"},
+	}
+
+	// Only the nodes selected for removal are checked.
+	unhealthy := tp.unhealthyServers(context.Background(), tp.logger, selected)
+	assert.Equal(t, map[string]bool{"nomad-1": false, "nomad-2": true, "nomad-3": true}, unhealthy)
+	assert.Equal(t, []string{"node-1", "node-2", "node-3"}, checked)
+
+	// Drained and shut down nodes are down, which must not cause a snapshot of
+	// the servers which were healthy before.
+	nodes["node-1"].Status = api.NodeStatusDown
+	failures := tp.snapshotServers(context.Background(), tp.logger, targetConfig, servers, nil, unhealthy)
+	assert.Empty(t, failures)
+	assert.Equal(t, []string{"2", "3"}, snapshotted)
+}
@@ -0,0 +1,71 @@
+package plugin
+
+import "github.com/hetznercloud/hcloud-go/v2/hcloud"
+
+// metaKeyRemainingDelta is the status meta key holding the difference between
+// the last desired count and the current count of a step limited group.
+const metaKeyRemainingDelta = "hcloud_remaining_delta"
+
+// currentCount returns the count of the group in its scaling mode.
+func (tc *hcloudTargetConfig) currentCount(servers []*hcloud.Server) (int64, error) {
+	switch tc.ScalingMode {
+	case scalingModeVertical:
+		return tc.verticalCount(servers)
+	case scalingModeWeighted:
+		return tc.capacity(servers)
+	}
+	return int64(len(servers)), nil
+}
+
+// stepsEnabled returns whether scaling actions of the group are step limited.
+func (tc *hcloudTargetConfig) stepsEnabled() bool {
+	return tc.MaxScaleOutStep > 0 || tc.MaxScaleInStep > 0
+}
+
+// limitStep returns the count the group is scaled to in a single action when
+// moving from the current towards the desired count.
+func (tc *hcloudTargetConfig) limitStep(current, desired int64) int64 {
+	switch {
+	case tc.MaxScaleOutStep > 0 && desired-current > int64(tc.MaxScaleOutStep):
+		return current + int64(tc.MaxScaleOutStep)
+	case tc.MaxScaleInStep > 0 && current-desired > int64(tc.MaxScaleInStep):
+		return current - int64(tc.MaxScaleInStep)
+	}
+	return desired
+}
+
+// stepCount records the desired count of the group and returns the count it
+// is scaled to in this action.
+func (t *TargetPlugin) stepCount(targetConfig *hcloudTargetConfig, current, desired int64) int64 {
+	if !targetConfig.stepsEnabled() {
+		return desired
+	}
+
+	t.desiredLock.Lock()
+	if t.desired == nil {
+		t.desired = make(map[string]int64)
+	}
+	t.desired[targetConfig.GroupID] = desired
+	t.desiredLock.Unlock()
+
+	count := targetConfig.limitStep(current, desired)
+	if count != desired {
+		t.logger.Info("scaling action capped by maximum step size", "hcloud_group_id", targetConfig.GroupID,
+			"current_count", current, "desired_count", desired, "step_count", count,
+			"remaining_delta", desired-count)
+	}
+	return count
+}
+
+// remainingDelta returns the difference between the last desired count of the
+// group and its current count.
+func (t *TargetPlugin) remainingDelta(groupID string, current int64) (int64, bool) {
+	t.desiredLock.Lock()
+	defer t.desiredLock.Unlock()
+
+	desired, ok := t.desired[groupID]
+	if !ok {
+		return 0, false
+	}
+	return desired - current, true
+}
@@ -0,0 +1,75 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_hcloudTargetConfig_limitStep(t *testing.T) {
+	testCases := []struct {
+		inputOutStep  int
+		inputInStep   int
+		inputCurrent  int64
+		inputDesired  int64
+		expectedCount int64
+		name          string
+	}{
+		{
+			inputCurrent:  5,
+			inputDesired:  200,
+			expectedCount: 200,
+			name:          "no limit",
+		},
+		{
+			inputOutStep:  10,
+			inputCurrent:  5,
+			inputDesired:  200,
+			expectedCount: 15,
+			name:          "scale out capped",
+		},
+		{
+			inputOutStep:  10,
+			inputCurrent:  5,
+			inputDesired:  12,
+			expectedCount: 12,
+			name:          "scale out within step",
+		},
+		{
+			inputOutStep:  10,
+			inputInStep:   2,
+			inputCurrent:  5,
+			inputDesired:  0,
+			expectedCount: 3,
+			name:          "scale in capped",
+		},
+		{
+			inputInStep:   2,
+			inputCurrent:  5,
+			inputDesired:  50,
+			expectedCount: 50,
+			name:          "scale out with scale in step only",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			targetConfig := hcloudTargetConfig{MaxScaleOutStep: tc.inputOutStep, MaxScaleInStep: tc.inputInStep}
+			assert.Equal(t, tc.expectedCount, targetConfig.limitStep(tc.inputCurrent, tc.inputDesired), tc.name)
+		})
+	}
+}
+
+func TestTargetPlugin_remainingDelta(t *testing.T) {
+	tp := TargetPlugin{logger: hclog.NewNullLogger()}
+	targetConfig := &hcloudTargetConfig{GroupID: "test", MaxScaleOutStep: 10}
+
+	_, ok := tp.remainingDelta("test", 5)
+	assert.False(t, ok, "no scaling action yet")
+
+	assert.Equal(t, int64(15), tp.stepCount(targetConfig, 5, 200))
+	delta, ok := tp.remainingDelta("test", 15)
+	assert.True(t, ok)
+	assert.Equal(t, int64(185), delta)
+}
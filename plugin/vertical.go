@@ -0,0 +1,157 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+const (
+	// scalingModeHorizontal adds and removes servers of the group.
+	scalingModeHorizontal = "horizontal"
+
+	// scalingModeVertical changes the server type of the servers of the group,
+	// the count is the index into hcloud_vertical_server_types.
+	scalingModeVertical = "vertical"
+)
+
+// verticalServerType returns the server type at the passed index of the
+// vertical server types.
+func (tc *hcloudTargetConfig) verticalServerType(index int64) (*hcloud.ServerType, error) {
+	if index < 0 || index >= int64(len(tc.VerticalServerTypes)) {
+		return nil, fmt.Errorf("count %d is outside of the %d hcloud_vertical_server_types", index, len(tc.VerticalServerTypes))
+	}
+	return tc.VerticalServerTypes[index], nil
+}
+
+// verticalIndex returns the index of the passed server type in the vertical
+// server types.
+func (tc *hcloudTargetConfig) verticalIndex(serverType *hcloud.ServerType) (int64, error) {
+	for i, vertical := range tc.VerticalServerTypes {
+		if serverType != nil && vertical.Name == serverType.Name {
+			return int64(i), nil
+		}
+	}
+	name := "unknown"
+	if serverType != nil {
+		name = serverType.Name
+	}
+	return 0, fmt.Errorf("server type %s is not in hcloud_vertical_server_types", name)
+}
+
+// verticalCount returns the count of a group in vertical mode, which is the
+// index of the smallest server type of its servers.
+func (tc *hcloudTargetConfig) verticalCount(servers []*hcloud.Server) (int64, error) {
+	count := int64(-1)
+	for _, server := range servers {
+		index, err := tc.verticalIndex(server.ServerType)
+		if err != nil {
+			return 0, fmt.Errorf("server %s: %v", server.Name, err)
+		}
+		if count < 0 || index < count {
+			count = index
+		}
+	}
+	if count < 0 {
+		return 0, nil
+	}
+	return count, nil
+}
+
+// scaleVertical changes the server type of all servers of the group to the
+// one at the passed index. A server of that type is created if the group has
+// none.
+func (t *TargetPlugin) scaleVertical(ctx context.Context, servers []*hcloud.Server, count int64, config map[string]string, targetConfig *hcloudTargetConfig) error {
+	serverType, err := targetConfig.verticalServerType(count)
+	if err != nil {
+		return err
+	}
+	log := t.logger.With("action", "scale_vertical", "hcloud_group_id", targetConfig.GroupID,
+		"server_type", serverType.Name)
+
+	if len(servers) == 0 {
+		createConfig := *targetConfig
+		createConfig.ServerType = serverType
+		created, err := t.createServers(ctx, servers, 1, &createConfig)
+		if err != nil {
+			return err
+		}
+		return t.waitForNomadJoin(ctx, targetConfig, created)
+	}
+
+	// Servers keep the disk they have, which is the one of a larger server
+	// type after hcloud_upgrade_disk, and cannot be changed to a server type
+	// with a smaller disk. They are rejected before any server is drained.
+	for _, server := range servers {
+		if server.PrimaryDiskSize > serverType.Disk {
+			return fmt.Errorf("cannot change type of server %s to %s: its %d GB disk is larger than the %d GB disk of the server type",
+				server.Name, serverType.Name, server.PrimaryDiskSize, serverType.Disk)
+		}
+	}
+
+	if err := t.capResize(ctx, servers, serverType, targetConfig); err != nil {
+		return err
+	}
+
+	for _, server := range servers {
+		if server.ServerType != nil && server.ServerType.Name == serverType.Name {
+			continue
+		}
+		if err := t.resizeServer(ctx, log, server, serverType, config, targetConfig); err != nil {
+			return fmt.Errorf("failed to change type of server %s: %v", server.Name, err)
+		}
+	}
+	return nil
+}
+
+// resizeServer drains the Nomad node of the server, powers the server off,
+// changes its type and powers it on again. The node is made eligible again
+// whether or not the type change succeeded and awaited to be ready.
+func (t *TargetPlugin) resizeServer(ctx context.Context, log hclog.Logger, server *hcloud.Server, serverType *hcloud.ServerType, config map[string]string, targetConfig *hcloudTargetConfig) error {
+	log = log.With("server", server.Name)
+
+	nodes, err := t.clusterUtils.RunPreScaleInTasksWithRemoteCheck(ctx, config, []string{server.Name}, 1)
+	if err != nil {
+		return fmt.Errorf("failed to drain Nomad node: %v", err)
+	}
+
+	t.stopServers(ctx, log, targetConfig, []*hcloud.Server{server})
+
+	log.Info("changing server type")
+	action, _, changeErr := t.client(ctx).Server.ChangeType(ctx, server, hcloud.ServerChangeTypeOpts{
+		ServerType:  serverType,
+		UpgradeDisk: targetConfig.UpgradeDisk,
+	})
+	if changeErr == nil {
+		changeErr = t.waitForActions(ctx, []int64{action.ID})
+	}
+	if changeErr != nil {
+		log.Error("failed to change server type, restoring server", "error", changeErr)
+	}
+
+	action, _, err = t.client(ctx).Server.Poweron(ctx, server)
+	if err == nil {
+		err = t.waitForActions(ctx, []int64{action.ID})
+	}
+	if err != nil {
+		log.Error("failed to power on server", "error", err)
+	}
+
+	if err := t.clusterUtils.RunPostScaleInTasksOnFailure(nodes); err != nil {
+		log.Error("failed to make Nomad node eligible again", "error", err)
+	}
+
+	if changeErr != nil {
+		return changeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to power on server: %v", err)
+	}
+	if _, err := t.waitForNomadNode(ctx, server, targetConfig.NomadJoinTimeout); err != nil {
+		return fmt.Errorf("node did not become ready: %v", err)
+	}
+	log.Info("changed server type")
+	return nil
+}
@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_hcloudTargetConfig_verticalServerType(t *testing.T) {
+	targetConfig := &hcloudTargetConfig{
+		VerticalServerTypes: []*hcloud.ServerType{{Name: "cx22"}, {Name: "cx32"}, {Name: "cx42"}},
+	}
+
+	serverType, err := targetConfig.verticalServerType(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "cx32", serverType.Name)
+
+	_, err = targetConfig.verticalServerType(3)
+	assert.EqualError(t, err, "count 3 is outside of the 3 hcloud_vertical_server_types")
+}
+
+func Test_hcloudTargetConfig_verticalCount(t *testing.T) {
+	targetConfig := &hcloudTargetConfig{
+		VerticalServerTypes: []*hcloud.ServerType{{Name: "cx22"}, {Name: "cx32"}, {Name: "cx42"}},
+	}
+
+	testCases := []struct {
+		inputServers  []*hcloud.Server
+		expectedCount int64
+		expectedError string
+		name          string
+	}{
+		{
+			inputServers:  []*hcloud.Server{{Name: "nomad-1", ServerType: &hcloud.ServerType{Name: "cx42"}}},
+			expectedCount: 2,
+			name:          "single server",
+		},
+		{
+			inputServers: []*hcloud.Server{
+				{Name: "nomad-1", ServerType: &hcloud.ServerType{Name: "cx42"}},
+				{Name: "nomad-2", ServerType: &hcloud.ServerType{Name: "cx32"}},
+			},
+			expectedCount: 1,
+			name:          "smallest server type",
+		},
+		{
+			name: "no servers",
+		},
+		{
+			inputServers:  []*hcloud.Server{{Name: "nomad-1", ServerType: &hcloud.ServerType{Name: "cpx11"}}},
+			expectedError: "server nomad-1: server type cpx11 is not in hcloud_vertical_server_types",
+			name:          "unknown server type",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			count, err := targetConfig.verticalCount(tc.inputServers)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError, tc.name)
+				return
+			}
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.expectedCount, count, tc.name)
+		})
+	}
+}
+
+func TestTargetPlugin_scaleVertical(t *testing.T) {
+	tp := TargetPlugin{logger: hclog.NewNullLogger()}
+	targetConfig := &hcloudTargetConfig{
+		GroupID:             "nomad",
+		UpgradeDisk:         true,
+		VerticalServerTypes: []*hcloud.ServerType{{Name: "cx22", Disk: 40}, {Name: "cx32", Disk: 80}},
+	}
+	servers := []*hcloud.Server{
+		{Name: "nomad-1", ServerType: &hcloud.ServerType{Name: "cx22"}, PrimaryDiskSize: 40},
+		{Name: "nomad-2", ServerType: &hcloud.ServerType{Name: "cx32"}, PrimaryDiskSize: 80},
+	}
+
+	err := tp.scaleVertical(context.Background(), servers, 0, nil, targetConfig)
+	assert.EqualError(t, err, "cannot change type of server nomad-2 to cx22: its 80 GB disk is larger than the 40 GB disk of the server type")
+}
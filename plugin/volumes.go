@@ -0,0 +1,232 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+const (
+	// volumeRetentionDelete deletes the volume of a server once the server
+	// has been deleted.
+	volumeRetentionDelete = "delete"
+
+	// volumeRetentionRetain keeps the volume of a server once the server has
+	// been deleted.
+	volumeRetentionRetain = "retain"
+
+	// volumeRetentionPool keeps the volume of a server once the server has
+	// been deleted and attaches it to the next server created for the group.
+	volumeRetentionPool = "pool"
+
+	// volumeCollectGrace is the age unattached volumes must reach before they
+	// are collected. Volumes are created before the server they are attached
+	// to, so younger volumes may belong to a create still in flight.
+	volumeCollectGrace = 15 * time.Minute
+)
+
+// volumesEnabled returns whether a volume should be created for each server.
+func (tc *hcloudTargetConfig) volumesEnabled() bool {
+	return tc.VolumeSize > 0
+}
+
+// volumeName renders the volume name template for the server with the passed
+// name.
+func (tc *hcloudTargetConfig) volumeName(serverName string) (string, error) {
+	return renderTemplate("volume name", tc.VolumeNameTemplate, map[string]interface{}{
+		"Name":    serverName,
+		"GroupID": tc.GroupID,
+	})
+}
+
+// prepareServerVolume adds the volume of a server which is about to be created
+// to the server create options. In pool mode a free volume of the group is
+// reused if there is one, otherwise a new volume is created. Volumes already
+// claimed by servers created in the same scaling action are skipped.
+func (t *TargetPlugin) prepareServerVolume(ctx context.Context, targetConfig *hcloudTargetConfig, opts *hcloud.ServerCreateOpts, claimed map[int64]struct{}) error {
+	if !targetConfig.volumesEnabled() {
+		return nil
+	}
+
+	volume, err := t.claimPoolVolume(ctx, targetConfig, claimed)
+	if err != nil {
+		return err
+	}
+	if volume == nil {
+		if volume, err = t.createServerVolume(ctx, targetConfig, opts.Name); err != nil {
+			return err
+		}
+	}
+
+	claimed[volume.ID] = struct{}{}
+	// The options are copied for every server, therefore the volumes shared
+	// by all servers are copied before the server volume is added.
+	opts.Volumes = append(append([]*hcloud.Volume{}, opts.Volumes...), volume)
+	opts.Automount = hcloud.Ptr(targetConfig.VolumeAutomount)
+	return nil
+}
+
+// serverVolume returns the volume prepared for the server, which is appended
+// after the volumes shared by all servers. Nil is returned if there is none.
+func (tc *hcloudTargetConfig) serverVolume(opts *hcloud.ServerCreateOpts) *hcloud.Volume {
+	if !tc.volumesEnabled() || len(opts.Volumes) <= len(tc.Volumes) {
+		return nil
+	}
+	return opts.Volumes[len(opts.Volumes)-1]
+}
+
+// claimPoolVolume returns a free volume of the group in the target location.
+// Nil is returned when the retention mode is not pool or no volume is free.
+func (t *TargetPlugin) claimPoolVolume(ctx context.Context, targetConfig *hcloudTargetConfig, claimed map[int64]struct{}) (*hcloud.Volume, error) {
+	if targetConfig.VolumeRetention != volumeRetentionPool {
+		return nil, nil
+	}
+
+	volumes, err := t.getVolumes(ctx, targetConfig)
+	if err != nil {
+		return nil, err
+	}
+	location := targetConfig.targetLocation()
+	for _, volume := range volumes {
+		if _, ok := claimed[volume.ID]; ok {
+			continue
+		}
+		if volume.Server != nil || volume.Status != hcloud.VolumeStatusAvailable {
+			continue
+		}
+		if !sameLocation(volume.Location, location) {
+			continue
+		}
+		t.logger.Info("reusing HCloud volume from pool", "volume", volume.Name, "volume_id", volume.ID)
+		return volume, nil
+	}
+	return nil, nil
+}
+
+func (t *TargetPlugin) createServerVolume(ctx context.Context, targetConfig *hcloudTargetConfig, serverName string) (*hcloud.Volume, error) {
+	name, err := targetConfig.volumeName(serverName)
+	if err != nil {
+		return nil, err
+	}
+
+	volumeOpts := hcloud.VolumeCreateOpts{
+		Name:     name,
+		Size:     targetConfig.VolumeSize,
+		Location: targetConfig.targetLocation(),
+		Labels:   targetConfig.serverLabels(t.config.GroupIDLabelSelector),
+	}
+	if targetConfig.VolumeFormat != "" {
+		volumeOpts.Format = hcloud.Ptr(targetConfig.VolumeFormat)
+	}
+
+	result, _, err := t.client(ctx).Volume.Create(ctx, volumeOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create volume %s: %v", name, err)
+	}
+	if result.Action != nil {
+		if err := t.waitForActions(ctx, []int64{result.Action.ID}); err != nil {
+			t.deleteVolume(ctx, result.Volume)
+			return nil, fmt.Errorf("failed to wait for volume %s to be created: %v", name, err)
+		}
+	}
+
+	t.logger.Info("created HCloud volume", "volume", name, "volume_id", result.Volume.ID, "size", targetConfig.VolumeSize)
+	return result.Volume, nil
+}
+
+// releaseServerVolume gives up the volumes prepared for a server whose
+// creation failed. Pooled volumes are returned to the pool, other volumes
+// are deleted.
+func (t *TargetPlugin) releaseServerVolume(ctx context.Context, targetConfig *hcloudTargetConfig, opts *hcloud.ServerCreateOpts, claimed map[int64]struct{}) {
+	if !targetConfig.volumesEnabled() {
+		return
+	}
+	for _, volume := range opts.Volumes[len(targetConfig.Volumes):] {
+		delete(claimed, volume.ID)
+		if targetConfig.VolumeRetention != volumeRetentionPool {
+			t.deleteVolume(ctx, volume)
+		}
+	}
+	opts.Volumes = targetConfig.Volumes
+}
+
+// detachServerVolumes detaches the volumes of the passed servers so that they
+// can be reused by the pool, and waits for the detach actions to finish.
+func (t *TargetPlugin) detachServerVolumes(ctx context.Context, targetConfig *hcloudTargetConfig, servers []*hcloud.Server) error {
+	if !targetConfig.volumesEnabled() || targetConfig.VolumeRetention != volumeRetentionPool {
+		return nil
+	}
+
+	var actionIDs []int64
+	for _, server := range servers {
+		for _, volume := range server.Volumes {
+			action, _, err := t.client(ctx).Volume.Detach(ctx, volume)
+			if err != nil {
+				return fmt.Errorf("failed to detach volume %d from server %s: %v", volume.ID, server.Name, err)
+			}
+			actionIDs = append(actionIDs, action.ID)
+			t.logger.Info("detaching HCloud volume", "volume_id", volume.ID, "server", server.Name)
+		}
+	}
+
+	if err := t.waitForActions(ctx, actionIDs); err != nil {
+		return fmt.Errorf("failed to wait for volumes to detach: %v", err)
+	}
+	return nil
+}
+
+// sameLocation returns whether both locations refer to the same location.
+func sameLocation(a, b *hcloud.Location) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.ID != 0 && b.ID != 0 {
+		return a.ID == b.ID
+	}
+	return a.Name == b.Name
+}
+
+func (t *TargetPlugin) deleteVolume(ctx context.Context, volume *hcloud.Volume) {
+	if _, err := t.client(ctx).Volume.Delete(ctx, volume); err != nil {
+		t.logger.Error("failed to delete HCloud volume", "volume", volume.Name, "volume_id", volume.ID, "error", err)
+		return
+	}
+	t.logger.Info("deleted HCloud volume", "volume", volume.Name, "volume_id", volume.ID)
+}
+
+// collectVolumes deletes volumes carrying the group labels which are not
+// attached to any server and older than the collect grace. Volumes are only
+// collected when the retention mode is delete, otherwise unattached volumes
+// are kept on purpose.
+func (t *TargetPlugin) collectVolumes(ctx context.Context, targetConfig *hcloudTargetConfig) error {
+	if !targetConfig.volumesEnabled() || targetConfig.VolumeRetention != volumeRetentionDelete {
+		return nil
+	}
+
+	volumes, err := t.getVolumes(ctx, targetConfig)
+	if err != nil {
+		return err
+	}
+	for _, volume := range volumes {
+		if volume.Server == nil && volume.Status == hcloud.VolumeStatusAvailable && time.Since(volume.Created) >= volumeCollectGrace {
+			t.deleteVolume(ctx, volume)
+		}
+	}
+	return nil
+}
+
+func (t *TargetPlugin) getVolumes(ctx context.Context, targetConfig *hcloudTargetConfig) ([]*hcloud.Volume, error) {
+	opts := hcloud.VolumeListOpts{
+		ListOpts: hcloud.ListOpts{
+			LabelSelector: targetConfig.getSelector(t.config.GroupIDLabelSelector),
+			PerPage:       t.config.ItemsPerPage,
+		},
+	}
+	volumes, err := t.client(ctx).Volume.AllWithOpts(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list HCloud volumes: %v", err)
+	}
+	return volumes, nil
+}
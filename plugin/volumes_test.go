@@ -0,0 +1,111 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetPlugin_collectVolumes(t *testing.T) {
+	testCases := []struct {
+		retention       string
+		expectedDeleted []string
+		name            string
+	}{
+		{
+			retention:       volumeRetentionDelete,
+			expectedDeleted: []string{"/volumes/2"},
+			name:            "dangling volume deleted",
+		},
+		{
+			retention:       volumeRetentionRetain,
+			expectedDeleted: nil,
+			name:            "dangling volume retained",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				mu      sync.Mutex
+				deleted []string
+			)
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /volumes", func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "group-id=test", r.URL.Query().Get("label_selector"))
+				writeJSON(w, schema.VolumeListResponse{Volumes: []schema.Volume{
+					{ID: 1, Name: "test-a-data", Server: hcloud.Ptr(int64(10)), Status: "available"},
+					{ID: 2, Name: "test-b-data", Status: "available", Created: time.Now().Add(-time.Hour)},
+					{ID: 3, Name: "test-c-data", Status: "creating"},
+					// Created for a server create still in flight.
+					{ID: 4, Name: "test-d-data", Status: "available", Created: time.Now()},
+				}})
+			})
+			mux.HandleFunc("DELETE /volumes/{id}", func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				deleted = append(deleted, r.URL.Path)
+				w.WriteHeader(http.StatusNoContent)
+			})
+
+			tp := TargetPlugin{
+				logger: hclog.NewNullLogger(),
+				config: hcloudPluginConfig{GroupIDLabelSelector: "group-id"},
+				hcloud: newTestHCloudClient(t, mux),
+			}
+			targetConfig := &hcloudTargetConfig{
+				GroupID:         "test",
+				VolumeSize:      10,
+				VolumeRetention: tc.retention,
+			}
+
+			err := tp.collectVolumes(context.Background(), targetConfig)
+			assert.NoError(t, err, tc.name)
+			assert.Equal(t, tc.expectedDeleted, deleted, tc.name)
+		})
+	}
+}
+
+func TestTargetPlugin_claimPoolVolume(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /volumes", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, schema.VolumeListResponse{Volumes: []schema.Volume{
+			{ID: 1, Name: "attached", Server: hcloud.Ptr(int64(10)), Status: "available", Location: schema.Location{ID: 1, Name: "fsn1"}},
+			{ID: 2, Name: "other-location", Status: "available", Location: schema.Location{ID: 2, Name: "nbg1"}},
+			{ID: 3, Name: "free-a", Status: "available", Location: schema.Location{ID: 1, Name: "fsn1"}},
+			{ID: 4, Name: "free-b", Status: "available", Location: schema.Location{ID: 1, Name: "fsn1"}},
+		}})
+	})
+
+	tp := TargetPlugin{
+		logger: hclog.NewNullLogger(),
+		config: hcloudPluginConfig{GroupIDLabelSelector: "group-id"},
+		hcloud: newTestHCloudClient(t, mux),
+	}
+	targetConfig := &hcloudTargetConfig{
+		GroupID:         "test",
+		Location:        &hcloud.Location{ID: 1, Name: "fsn1"},
+		VolumeSize:      10,
+		VolumeRetention: volumeRetentionPool,
+	}
+	claimed := make(map[int64]struct{})
+
+	var claimedNames []string
+	for i := 0; i < 3; i++ {
+		volume, err := tp.claimPoolVolume(context.Background(), targetConfig, claimed)
+		assert.NoError(t, err)
+		if volume == nil {
+			break
+		}
+		claimed[volume.ID] = struct{}{}
+		claimedNames = append(claimedNames, volume.Name)
+	}
+	assert.Equal(t, []string{"free-a", "free-b"}, claimedNames)
+}
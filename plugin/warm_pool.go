@@ -0,0 +1,273 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+const (
+	// warmPoolLabel and warmPoolValue make up the label set on the powered
+	// off servers of the warm pool.
+	warmPoolLabel = "pool"
+	warmPoolValue = "warm"
+
+	// activatedLabel is the label key holding the Unix time a server was
+	// last activated from the warm pool at.
+	activatedLabel = "activated"
+
+	// metaKeyWarmPool is the status meta key holding the number of servers in
+	// the warm pool of the group.
+	metaKeyWarmPool = "hcloud_warm_pool"
+)
+
+// warmPoolConfig returns a copy of the config used to create the servers of
+// the warm pool. Servers in the pool carry the pool label, get no DNS records
+// and are not part of the group until they are activated.
+func (tc *hcloudTargetConfig) warmPoolConfig() *hcloudTargetConfig {
+	warm := *tc
+	warm.Labels = make(map[string]string, len(tc.Labels)+1)
+	for key, value := range tc.Labels {
+		warm.Labels[key] = value
+	}
+	warm.Labels[warmPoolLabel] = warmPoolValue
+	warm.DNSZone = ""
+	warm.Canary = false
+	warm.WaitForNomadJoin = false
+	warm.warmPool = true
+	return &warm
+}
+
+// getWarmServers returns the servers in the warm pool of the group regardless
+// of their status.
+func (t *TargetPlugin) getWarmServers(ctx context.Context, targetConfig *hcloudTargetConfig) ([]*hcloud.Server, error) {
+	opts := hcloud.ServerListOpts{
+		ListOpts: hcloud.ListOpts{
+			LabelSelector: targetConfig.warmPoolConfig().getSelector(t.config.GroupIDLabelSelector),
+			PerPage:       t.config.ItemsPerPage,
+		},
+	}
+	return t.client(ctx).Server.AllWithOpts(ctx, opts)
+}
+
+// activateWarmServers moves up to count powered off servers from the warm pool
+// into the group. The servers are relabelled, powered on and their Nomad nodes
+// made eligible again. The activated servers are returned, failures are only
+// logged as missing servers are created instead.
+func (t *TargetPlugin) activateWarmServers(ctx context.Context, targetConfig *hcloudTargetConfig, count int64) []*hcloud.Server {
+	log := t.logger.With("action", "warm_pool_activate", "hcloud_group_id", targetConfig.GroupID)
+
+	pool, err := t.getWarmServers(ctx, targetConfig)
+	if err != nil {
+		log.Error("failed to get warm pool servers", "error", err)
+		return nil
+	}
+	var candidates []*hcloud.Server
+	for _, server := range pool {
+		if server.Status == hcloud.ServerStatusOff {
+			candidates = append(candidates, server)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Created.Before(candidates[j].Created)
+	})
+	if int64(len(candidates)) > count {
+		candidates = candidates[:count]
+	}
+
+	var (
+		activated []*hcloud.Server
+		actionIDs []int64
+	)
+	for _, server := range candidates {
+		labels := make(map[string]string, len(server.Labels))
+		for key, value := range server.Labels {
+			if key != warmPoolLabel {
+				labels[key] = value
+			}
+		}
+		labels[activatedLabel] = strconv.FormatInt(time.Now().Unix(), 10)
+		if _, _, err := t.client(ctx).Server.Update(ctx, server, hcloud.ServerUpdateOpts{Labels: labels}); err != nil {
+			log.Warn("failed to relabel warm pool server", "server", server.Name, "error", err)
+			continue
+		}
+		action, _, err := t.client(ctx).Server.Poweron(ctx, server)
+		if err != nil {
+			log.Warn("failed to power on warm pool server", "server", server.Name, "error", err)
+			// Put the server back into the pool, so it is not left behind
+			// powered off in the group.
+			if _, _, err := t.client(ctx).Server.Update(ctx, server, hcloud.ServerUpdateOpts{Labels: server.Labels}); err != nil {
+				log.Error("failed to return server to the warm pool", "server", server.Name, "error", err)
+			}
+			continue
+		}
+		server.Labels = labels
+		actionIDs = append(actionIDs, action.ID)
+		activated = append(activated, server)
+	}
+	if err := t.waitForActions(ctx, actionIDs); err != nil {
+		log.Warn("failed to wait till all HCloud power on actions are ready", "error", err)
+	}
+
+	nodes, err := t.nomadNodes(ctx, make(map[string]string))
+	if err != nil {
+		log.Warn("failed to look up Nomad nodes", "error", err)
+	}
+	for _, server := range activated {
+		node, ok := nodes[server.Name]
+		if !ok {
+			log.Warn("failed to find Nomad node of warm pool server", "server", server.Name)
+			continue
+		}
+		if _, err := t.nomad.Nodes().ToggleEligibility(node.ID, true, nil); err != nil {
+			log.Warn("failed to make Nomad node eligible", "server", server.Name, "node_id", node.ID, "error", err)
+		}
+	}
+
+	if err := t.createDNSRecords(ctx, targetConfig, activated); err != nil {
+		log.Error("failed to create DNS records", "error", err)
+	}
+	if len(activated) > 0 {
+		log.Info("activated servers from the warm pool", "count", len(activated))
+	}
+	return activated
+}
+
+// replenishWarmPool fills the warm pool of the group in the background. Only
+// a single replenishment runs per group at a time.
+func (t *TargetPlugin) replenishWarmPool(targetConfig *hcloudTargetConfig) {
+	t.warmPoolLock.Lock()
+	if t.warmPoolFilling == nil {
+		t.warmPoolFilling = make(map[string]struct{})
+	}
+	if _, ok := t.warmPoolFilling[targetConfig.GroupID]; ok {
+		t.warmPoolLock.Unlock()
+		return
+	}
+	t.warmPoolFilling[targetConfig.GroupID] = struct{}{}
+	t.warmPoolLock.Unlock()
+
+	go func() {
+		defer func() {
+			t.warmPoolLock.Lock()
+			delete(t.warmPoolFilling, targetConfig.GroupID)
+			t.warmPoolLock.Unlock()
+		}()
+		if err := t.fillWarmPool(withProject(context.Background(), targetConfig.Project), targetConfig); err != nil {
+			t.logger.Error("failed to replenish warm pool", "hcloud_group_id", targetConfig.GroupID, "error", err)
+		}
+	}()
+}
+
+// fillWarmPool creates the servers missing from the warm pool. New servers
+// are provisioned until their Nomad node is ready, then made ineligible and
+// shut down. Servers which do not join the Nomad cluster in time are deleted.
+func (t *TargetPlugin) fillWarmPool(ctx context.Context, targetConfig *hcloudTargetConfig) error {
+	log := t.logger.With("action", "warm_pool_fill", "hcloud_group_id", targetConfig.GroupID)
+	warm := targetConfig.warmPoolConfig()
+
+	pool, err := t.getWarmServers(ctx, targetConfig)
+	if err != nil {
+		return fmt.Errorf("failed to get warm pool servers: %v", err)
+	}
+	missing := int64(targetConfig.WarmPoolSize - len(pool))
+	if missing <= 0 {
+		return nil
+	}
+
+	// Running servers in the pool are left over from an interrupted fill and
+	// only need to be stopped.
+	var running []*hcloud.Server
+	for _, server := range pool {
+		if server.Status == hcloud.ServerStatusRunning {
+			running = append(running, server)
+		}
+	}
+
+	log.Info("replenishing warm pool", "missing", missing)
+	created, err := t.createServers(ctx, running, int64(len(running))+missing, warm)
+	if err != nil {
+		log.Warn("failed to create all warm pool servers", "error", err)
+	}
+
+	var (
+		wg     sync.WaitGroup
+		lock   sync.Mutex
+		ready  []*hcloud.Server
+		failed []*hcloud.Server
+	)
+	for _, server := range created {
+		wg.Add(1)
+		go func(server *hcloud.Server) {
+			defer wg.Done()
+			err := t.provisionWarmServer(ctx, warm, server)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				log.Warn("failed to provision warm pool server, deleting server", "server", server.Name, "error", err)
+				failed = append(failed, server)
+				return
+			}
+			ready = append(ready, server)
+		}(server)
+	}
+	wg.Wait()
+
+	t.stopServers(ctx, log, warm, append(running, ready...))
+
+	if len(failed) > 0 {
+		deleted, _ := t.deleteServers(ctx, log, failed)
+		if len(deleted) > 0 {
+			t.cleanupDeletedServers(ctx, log, warm, deleted)
+		}
+		return fmt.Errorf("%d of %d warm pool servers failed to provision", len(failed), len(created))
+	}
+	return nil
+}
+
+// provisionWarmServer waits for the Nomad node of a new warm pool server and
+// makes it ineligible, so that no work is placed on it while in the pool.
+func (t *TargetPlugin) provisionWarmServer(ctx context.Context, targetConfig *hcloudTargetConfig, server *hcloud.Server) error {
+	node, err := t.waitForNomadNode(ctx, server, targetConfig.NomadJoinTimeout)
+	if err != nil {
+		return err
+	}
+	if _, err := t.nomad.Nodes().ToggleEligibility(node.ID, false, nil); err != nil {
+		return fmt.Errorf("failed to make Nomad node %s ineligible: %v", node.ID, err)
+	}
+	return nil
+}
+
+// returnToWarmPool moves drained servers of the group back into the warm pool
+// by relabelling and stopping them. Servers which could not be relabelled are
+// returned with their error.
+func (t *TargetPlugin) returnToWarmPool(ctx context.Context, log hclog.Logger, targetConfig *hcloudTargetConfig, servers []*hcloud.Server) ([]*hcloud.Server, map[string]error) {
+	var returned []*hcloud.Server
+	failures := make(map[string]error)
+	for _, server := range servers {
+		labels := make(map[string]string, len(server.Labels)+1)
+		for key, value := range server.Labels {
+			labels[key] = value
+		}
+		labels[warmPoolLabel] = warmPoolValue
+		if _, _, err := t.client(ctx).Server.Update(ctx, server, hcloud.ServerUpdateOpts{Labels: labels}); err != nil {
+			log.Error("failed to relabel server for the warm pool", "server", server.Name, "error", err)
+			failures[server.Name] = fmt.Errorf("failed to return server to the warm pool: %v", err)
+			continue
+		}
+		server.Labels = labels
+		returned = append(returned, server)
+	}
+
+	t.stopServers(ctx, log, targetConfig, returned)
+	if len(returned) > 0 {
+		log.Info("returned servers to the warm pool", "count", len(returned))
+	}
+	return returned, failures
+}
@@ -0,0 +1,154 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/nomad/api"
+	"github.com/hetznercloud/hcloud-go/v2/hcloud/schema"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_hcloudTargetConfig_warmPoolConfig(t *testing.T) {
+	targetConfig := &hcloudTargetConfig{
+		GroupID:          "test",
+		Labels:           map[string]string{"env": "prod"},
+		DNSZone:          "example.com",
+		Canary:           true,
+		WaitForNomadJoin: true,
+	}
+
+	warm := targetConfig.warmPoolConfig()
+	assert.Equal(t, map[string]string{"env": "prod", "pool": "warm"}, warm.Labels)
+	assert.Equal(t, "", warm.DNSZone)
+	assert.False(t, warm.Canary)
+	assert.False(t, warm.WaitForNomadJoin)
+	assert.True(t, warm.warmPool)
+	assert.Equal(t, map[string]string{"env": "prod"}, targetConfig.Labels)
+}
+
+func TestTargetPlugin_activateWarmServers(t *testing.T) {
+	now := time.Now()
+	pool := []schema.Server{
+		{ID: 1, Name: "nomad-1", Status: "off", Created: now.Add(-time.Hour), Labels: map[string]string{"group-id": "test", "pool": "warm"}},
+		{ID: 2, Name: "nomad-2", Status: "off", Created: now, Labels: map[string]string{"group-id": "test", "pool": "warm"}},
+		{ID: 3, Name: "nomad-3", Status: "running", Created: now.Add(-2 * time.Hour), Labels: map[string]string{"group-id": "test", "pool": "warm"}},
+	}
+	nodes := []*api.Node{
+		{ID: "node-1", Attributes: map[string]string{"unique.hostname": "nomad-1"}},
+		{ID: "node-2", Attributes: map[string]string{"unique.hostname": "nomad-2"}},
+	}
+
+	testCases := []struct {
+		inputCount        int64
+		expectedActivated []string
+		expectedPoweron   []string
+		expectedEligible  []string
+		name              string
+	}{
+		{
+			inputCount:        1,
+			expectedActivated: []string{"nomad-1"},
+			expectedPoweron:   []string{"1"},
+			expectedEligible:  []string{"node-1"},
+			name:              "oldest server first",
+		},
+		{
+			inputCount:        5,
+			expectedActivated: []string{"nomad-1", "nomad-2"},
+			expectedPoweron:   []string{"1", "2"},
+			expectedEligible:  []string{"node-1", "node-2"},
+			name:              "pool smaller than count",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				lock     sync.Mutex
+				updates  = make(map[string]map[string]string)
+				poweron  []string
+				eligible []string
+			)
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("GET /servers", func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "group-id=test,pool=warm", r.URL.Query().Get("label_selector"))
+				writeJSON(w, schema.ServerListResponse{Servers: pool})
+			})
+			mux.HandleFunc("PUT /servers/{id}", func(w http.ResponseWriter, r *http.Request) {
+				var req schema.ServerUpdateRequest
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+				id, _ := strconv.ParseInt(r.PathValue("id"), 10, 64)
+				lock.Lock()
+				updates[r.PathValue("id")] = *req.Labels
+				lock.Unlock()
+				writeJSON(w, schema.ServerUpdateResponse{Server: schema.Server{ID: id}})
+			})
+			mux.HandleFunc("POST /servers/{id}/actions/poweron", func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				poweron = append(poweron, r.PathValue("id"))
+				lock.Unlock()
+				w.WriteHeader(http.StatusCreated)
+				writeJSON(w, schema.ServerActionPoweronResponse{Action: schema.Action{ID: 1, Status: "success", Progress: 100}})
+			})
+			mux.HandleFunc("GET /actions", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, schema.ActionListResponse{Actions: []schema.Action{{ID: 1, Status: "success", Progress: 100}}})
+			})
+
+			nomadMux := http.NewServeMux()
+			nomadMux.HandleFunc("GET /v1/nodes", func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, []*api.NodeListStub{{ID: "node-1", Name: "nomad-1"}, {ID: "node-2", Name: "nomad-2"}})
+			})
+			nomadMux.HandleFunc("GET /v1/node/{id}", func(w http.ResponseWriter, r *http.Request) {
+				for _, node := range nodes {
+					if node.ID == r.PathValue("id") {
+						writeJSON(w, node)
+					}
+				}
+			})
+			nomadMux.HandleFunc("PUT /v1/node/{id}/eligibility", func(w http.ResponseWriter, r *http.Request) {
+				var req api.NodeUpdateEligibilityRequest
+				assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+				assert.Equal(t, api.NodeSchedulingEligible, req.Eligibility)
+				lock.Lock()
+				eligible = append(eligible, r.PathValue("id"))
+				lock.Unlock()
+				writeJSON(w, api.NodeEligibilityUpdateResponse{})
+			})
+			nomadSrv := httptest.NewServer(nomadMux)
+			t.Cleanup(nomadSrv.Close)
+			nomadClient, err := api.NewClient(&api.Config{Address: nomadSrv.URL})
+			assert.NoError(t, err)
+
+			tp := TargetPlugin{
+				logger: hclog.NewNullLogger(),
+				config: hcloudPluginConfig{GroupIDLabelSelector: "group-id", NodeAttrID: "unique.hostname"},
+				hcloud: newTestHCloudClient(t, mux),
+				nomad:  nomadClient,
+			}
+			targetConfig := &hcloudTargetConfig{GroupID: "test", WarmPoolSize: 3}
+
+			activated := tp.activateWarmServers(context.Background(), targetConfig, tc.inputCount)
+			var names []string
+			for _, server := range activated {
+				names = append(names, server.Name)
+				// The activation time is recorded for the Nomad join time.
+				labels := map[string]string{"group-id": "test", activatedLabel: server.Labels[activatedLabel]}
+				assert.NotEmpty(t, server.Labels[activatedLabel], tc.name)
+				assert.Equal(t, labels, server.Labels, tc.name)
+				assert.Equal(t, labels, updates[strconv.FormatInt(server.ID, 10)], tc.name)
+			}
+			assert.Equal(t, tc.expectedActivated, names, tc.name)
+			assert.ElementsMatch(t, tc.expectedPoweron, poweron, tc.name)
+			assert.ElementsMatch(t, tc.expectedEligible, eligible, tc.name)
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+)
+
+// scalingModeWeighted adds and removes servers of different types, the count
+// is the summed capacity weight of the servers.
+const scalingModeWeighted = "weighted"
+
+// weightedServerType is a server type allowed in weighted mode together with
+// its capacity weight and hourly price in the target location.
+type weightedServerType struct {
+	serverType *hcloud.ServerType
+	weight     int64
+	price      float64
+}
+
+// capacityWeights returns the parsed capacity weights keyed by server type
+// name.
+func (tc *hcloudTargetConfig) capacityWeights() (map[string]int64, error) {
+	weights := make(map[string]int64, len(tc.CapacityWeights))
+	for name, value := range tc.CapacityWeights {
+		weight, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("capacity weight %q of server type %s is not a positive integer", value, name)
+		}
+		weights[name] = weight
+	}
+	return weights, nil
+}
+
+// capacity returns the summed capacity weight of the passed servers.
+func (tc *hcloudTargetConfig) capacity(servers []*hcloud.Server) (int64, error) {
+	weights, err := tc.capacityWeights()
+	if err != nil {
+		return 0, err
+	}
+	var capacity int64
+	for _, server := range servers {
+		weight, ok := weights[server.ServerType.Name]
+		if !ok {
+			return 0, fmt.Errorf("server type %s of server %s has no capacity weight", server.ServerType.Name, server.Name)
+		}
+		capacity += weight
+	}
+	return capacity, nil
+}
+
+// weightedServerTypes looks up the server types with a capacity weight and
+// their hourly prices in the location of the group.
+func (t *TargetPlugin) weightedServerTypes(ctx context.Context, targetConfig *hcloudTargetConfig) ([]weightedServerType, error) {
+	weights, err := targetConfig.capacityWeights()
+	if err != nil {
+		return nil, err
+	}
+	available, err := t.availableServerTypes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*hcloud.ServerType, len(available))
+	for _, serverType := range available {
+		byName[serverType.Name] = serverType
+	}
+
+	var types []weightedServerType
+	for name, weight := range weights {
+		serverType, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("server type %s was not found", name)
+		}
+		price, err := hourlyPrice(serverType, targetConfig.targetLocation())
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, weightedServerType{serverType: serverType, weight: weight, price: price})
+	}
+	sort.Slice(types, func(i, j int) bool {
+		return types[i].serverType.Name < types[j].serverType.Name
+	})
+	return types, nil
+}
+
+// hourlyPrice returns the gross hourly price of the server type in the
+// passed location.
+func hourlyPrice(serverType *hcloud.ServerType, location *hcloud.Location) (float64, error) {
+	for _, pricing := range serverType.Pricings {
+		if location == nil || pricing.Location == nil || pricing.Location.Name != location.Name {
+			continue
+		}
+		price, err := strconv.ParseFloat(pricing.Hourly.Gross, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse hourly price of server type %s: %v", serverType.Name, err)
+		}
+		return price, nil
+	}
+	return 0, fmt.Errorf("server type %s is not available in the location of the group", serverType.Name)
+}
+
+// cheapestCover returns the number of servers per server type name which add
+// up to at least the passed capacity at the lowest hourly price.
+func cheapestCover(types []weightedServerType, capacity int64) map[string]int64 {
+	if capacity <= 0 || len(types) == 0 {
+		return nil
+	}
+
+	// cost[c] is the lowest price of servers adding up to at least c
+	// capacity, choice[c] the server type added last to get there.
+	cost := make([]float64, capacity+1)
+	choice := make([]int, capacity+1)
+	for c := int64(1); c <= capacity; c++ {
+		cost[c] = math.Inf(1)
+		for i, serverType := range types {
+			rest := max(c-serverType.weight, 0)
+			if price := cost[rest] + serverType.price; price < cost[c] {
+				cost[c] = price
+				choice[c] = i
+			}
+		}
+	}
+
+	counts := make(map[string]int64)
+	for c := capacity; c > 0; {
+		serverType := types[choice[c]]
+		counts[serverType.serverType.Name]++
+		c = max(c-serverType.weight, 0)
+	}
+	return counts
+}
+
+// closestRemoval returns the servers whose summed weight is at least the
+// passed excess and comes closest to it.
+func closestRemoval(servers []*hcloud.Server, weights map[string]int64, excess int64) []*hcloud.Server {
+	if excess <= 0 {
+		return nil
+	}
+
+	// reached maps every reachable weight sum to the first servers found
+	// adding up to it.
+	reached := map[int64][]*hcloud.Server{0: nil}
+	for _, server := range servers {
+		weight := weights[server.ServerType.Name]
+		sums := make([]int64, 0, len(reached))
+		for sum := range reached {
+			sums = append(sums, sum)
+		}
+		sort.Slice(sums, func(i, j int) bool { return sums[i] < sums[j] })
+		for _, sum := range sums {
+			if _, ok := reached[sum+weight]; ok {
+				continue
+			}
+			subset := make([]*hcloud.Server, len(reached[sum]), len(reached[sum])+1)
+			copy(subset, reached[sum])
+			reached[sum+weight] = append(subset, server)
+		}
+	}
+
+	best := int64(-1)
+	for sum := range reached {
+		if sum >= excess && (best < 0 || sum < best) {
+			best = sum
+		}
+	}
+	if best < 0 {
+		return servers
+	}
+	return reached[best]
+}
+
+// scaleWeighted scales the capacity of the group to the passed count. Missing
+// capacity is added with the cheapest combination of server types, excess
+// capacity is removed with the servers coming closest to it.
+func (t *TargetPlugin) scaleWeighted(ctx context.Context, servers []*hcloud.Server, count int64, config map[string]string, targetConfig *hcloudTargetConfig) error {
+	capacity, err := targetConfig.capacity(servers)
+	if err != nil {
+		return err
+	}
+	log := t.logger.With("action", "scale_weighted", "hcloud_group_id", targetConfig.GroupID,
+		"current_capacity", capacity, "desired_capacity", count)
+
+	switch {
+	case count < capacity:
+		weights, err := targetConfig.capacityWeights()
+		if err != nil {
+			return err
+		}
+		remove := closestRemoval(servers, weights, capacity-count)
+		log.Info("removing servers", "count", len(remove))
+		return t.scaleIn(ctx, remove, int64(len(remove)), config, targetConfig)
+	case count > capacity:
+		types, err := t.weightedServerTypes(ctx, targetConfig)
+		if err != nil {
+			return err
+		}
+		counts := cheapestCover(types, count-capacity)
+		for _, serverType := range types {
+			n := counts[serverType.serverType.Name]
+			if n == 0 {
+				continue
+			}
+			log.Info("adding servers", "server_type", serverType.serverType.Name, "count", n)
+			typeConfig := *targetConfig
+			typeConfig.ServerType = serverType.serverType
+			created, err := t.createServers(ctx, servers, int64(len(servers))+n, &typeConfig)
+			servers = append(servers, created...)
+			if err != nil {
+				return err
+			}
+			if err := t.waitForNomadJoin(ctx, targetConfig, created); err != nil {
+				return err
+			}
+		}
+	default:
+		log.Info("scaling not required")
+	}
+	return nil
+}
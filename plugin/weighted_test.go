@@ -0,0 +1,124 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/v2/hcloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_hcloudTargetConfig_capacity(t *testing.T) {
+	targetConfig := &hcloudTargetConfig{CapacityWeights: map[string]string{"cx22": "2", "cx52": "16"}}
+	servers := []*hcloud.Server{
+		{Name: "nomad-1", ServerType: &hcloud.ServerType{Name: "cx22"}},
+		{Name: "nomad-2", ServerType: &hcloud.ServerType{Name: "cx52"}},
+	}
+
+	capacity, err := targetConfig.capacity(servers)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(18), capacity)
+
+	_, err = targetConfig.capacity(append(servers, &hcloud.Server{Name: "nomad-3", ServerType: &hcloud.ServerType{Name: "cx32"}}))
+	assert.EqualError(t, err, "server type cx32 of server nomad-3 has no capacity weight")
+
+	targetConfig.CapacityWeights["cx32"] = "four"
+	_, err = targetConfig.capacity(servers)
+	assert.EqualError(t, err, "capacity weight \"four\" of server type cx32 is not a positive integer")
+}
+
+func Test_cheapestCover(t *testing.T) {
+	types := []weightedServerType{
+		{serverType: &hcloud.ServerType{Name: "cx22"}, weight: 2, price: 0.0071},
+		{serverType: &hcloud.ServerType{Name: "cx32"}, weight: 4, price: 0.0113},
+		{serverType: &hcloud.ServerType{Name: "cx52"}, weight: 16, price: 0.0577},
+	}
+
+	testCases := []struct {
+		inputCapacity  int64
+		expectedCounts map[string]int64
+		name           string
+	}{
+		{
+			inputCapacity:  2,
+			expectedCounts: map[string]int64{"cx22": 1},
+			name:           "smallest type",
+		},
+		{
+			inputCapacity:  8,
+			expectedCounts: map[string]int64{"cx32": 2},
+			name:           "cheaper per capacity",
+		},
+		{
+			inputCapacity:  6,
+			expectedCounts: map[string]int64{"cx22": 1, "cx32": 1},
+			name:           "mixed types",
+		},
+		{
+			inputCapacity:  3,
+			expectedCounts: map[string]int64{"cx32": 1},
+			name:           "overshoot at lowest price",
+		},
+		{
+			name: "no capacity",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			counts := cheapestCover(types, tc.inputCapacity)
+			if tc.expectedCounts == nil {
+				assert.Empty(t, counts, tc.name)
+				return
+			}
+			assert.Equal(t, tc.expectedCounts, counts, tc.name)
+		})
+	}
+}
+
+func Test_closestRemoval(t *testing.T) {
+	weights := map[string]int64{"cx22": 2, "cx32": 4, "cx52": 16}
+	servers := []*hcloud.Server{
+		{Name: "nomad-1", ServerType: &hcloud.ServerType{Name: "cx52"}},
+		{Name: "nomad-2", ServerType: &hcloud.ServerType{Name: "cx32"}},
+		{Name: "nomad-3", ServerType: &hcloud.ServerType{Name: "cx22"}},
+		{Name: "nomad-4", ServerType: &hcloud.ServerType{Name: "cx22"}},
+	}
+
+	testCases := []struct {
+		inputExcess   int64
+		expectedNames string
+		name          string
+	}{
+		{
+			inputExcess:   4,
+			expectedNames: "nomad-2",
+			name:          "exact match",
+		},
+		{
+			inputExcess:   5,
+			expectedNames: "nomad-2, nomad-3",
+			name:          "closest above excess",
+		},
+		{
+			inputExcess:   17,
+			expectedNames: "nomad-1, nomad-3",
+			name:          "large excess",
+		},
+		{
+			inputExcess:   30,
+			expectedNames: "nomad-1, nomad-2, nomad-3, nomad-4",
+			name:          "excess above capacity",
+		},
+		{
+			inputExcess:   0,
+			expectedNames: "",
+			name:          "no excess",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectedNames, serverNames(closestRemoval(servers, weights, tc.inputExcess)), tc.name)
+		})
+	}
+}